@@ -5,6 +5,7 @@
 package fleet
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
@@ -35,15 +36,19 @@ func authApiKey(r *http.Request, bulker bulk.Bulk, c cache.Cache) (*apikey.ApiKe
 		return nil, err
 	}
 
+	return authKey(r.Context(), key, r.Header.Get(logger.HeaderRequestID), bulker, c)
+}
+
+// Authenticate the API key extracted from the request, whatever the transport.
+func authKey(ctx context.Context, key *apikey.ApiKey, reqId string, bulker bulk.Bulk, c cache.Cache) (*apikey.ApiKey, error) {
+
 	if c.ValidApiKey(*key) {
 		return key, nil
 	}
 
-	reqId := r.Header.Get(logger.HeaderRequestID)
-
 	start := time.Now()
 
-	info, err := bulker.ApiKeyAuth(r.Context(), *key)
+	info, err := bulker.ApiKeyAuth(ctx, *key)
 
 	if err != nil {
 		log.Info().
@@ -80,17 +85,28 @@ func authApiKey(r *http.Request, bulker bulk.Bulk, c cache.Cache) (*apikey.ApiKe
 }
 
 func authAgent(r *http.Request, id *string, bulker bulk.Bulk, c cache.Cache) (*model.Agent, error) {
+
+	key, err := apikey.ExtractAPIKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return authAgentKey(r.Context(), key, r.Header.Get(logger.HeaderRequestID), id, bulker, c)
+}
+
+// Authenticate the access API key and retrieve the agent record it belongs to.
+func authAgentKey(ctx context.Context, key *apikey.ApiKey, reqId string, id *string, bulker bulk.Bulk, c cache.Cache) (*model.Agent, error) {
 	start := time.Now()
 
 	// authenticate
-	key, err := authApiKey(r, bulker, c)
+	key, err := authKey(ctx, key, reqId, bulker, c)
 	if err != nil {
 		return nil, err
 	}
 
 	w := log.With().
 		Str(LogAccessApiKeyId, key.Id).
-		Str(EcsHttpRequestId, r.Header.Get(logger.HeaderRequestID))
+		Str(EcsHttpRequestId, reqId)
 
 	if id != nil {
 		w = w.Str(LogAgentId, *id)
@@ -106,7 +122,7 @@ func authAgent(r *http.Request, id *string, bulker bulk.Bulk, c cache.Cache) (*m
 			Msg("authApiKey slow")
 	}
 
-	agent, err := findAgentByApiKeyId(r.Context(), bulker, key.Id)
+	agent, err := findAgentByApiKeyId(ctx, bulker, key.Id)
 	if err != nil {
 		return nil, err
 	}
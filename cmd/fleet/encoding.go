@@ -0,0 +1,338 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/miolini/datacounter"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	kEncodingGzip   = "gzip"
+	kEncodingZstd   = "zstd"
+	kEncodingBrotli = "br"
+
+	kEncodingAny       = "*"
+	kEncodingGzipAlias = "x-gzip"
+	kEncodingIdentity  = "identity"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrBodyTooLarge        = errors.New("decoded request body too large")
+)
+
+// Server preference among the encodings the agent accepts with the same weight
+var encodingPreference = []string{kEncodingZstd, kEncodingBrotli, kEncodingGzip}
+
+// Compression writer that can be reused across responses
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type codec struct {
+	name  string
+	level int
+	pool  sync.Pool
+	stats *compressionStats
+}
+
+func newCodec(name string, level int, stats *compressionStats, newF func(level int) (resetWriter, error)) (*codec, error) {
+	// Validate the level up front; the pool cannot return an error.
+	zw, err := newF(level)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &codec{name: name, level: level, stats: stats}
+	c.pool.New = func() interface{} {
+		zw, _ := newF(level)
+		return zw
+	}
+	c.pool.Put(zw)
+
+	return c, nil
+}
+
+// Encode the payload into dst
+func (c *codec) encode(dst io.Writer, payload []byte) error {
+	zw := c.pool.Get().(resetWriter)
+	zw.Reset(dst)
+
+	_, err := zw.Write(payload)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+
+	// Drop the reference to dst while pooled
+	zw.Reset(nil)
+	c.pool.Put(zw)
+
+	return errors.Wrapf(err, "encode %s", c.name)
+}
+
+func newGzipWriter(level int) (resetWriter, error) {
+	return gzip.NewWriterLevel(nil, level)
+}
+
+func newZstdWriter(level int) (resetWriter, error) {
+	return zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+	)
+}
+
+func newBrotliWriter(level int) (resetWriter, error) {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		return nil, errors.Errorf("brotli: invalid compression level: %d", level)
+	}
+	return brotli.NewWriterLevel(nil, level), nil
+}
+
+// Encodes the responses with the content coding negotiated with the agent.
+// A codec configured with level 0 is disabled.
+type responseEncoder struct {
+	codecs map[string]*codec
+	thresh int
+}
+
+func newResponseEncoder(cfg *config.Server) *responseEncoder {
+	re := &responseEncoder{
+		codecs: make(map[string]*codec),
+		thresh: cfg.CompressionThresh,
+	}
+
+	re.add(kEncodingGzip, cfg.CompressionLevel, &cntCompressGzip, newGzipWriter)
+	re.add(kEncodingZstd, cfg.CompressionLevelZstd, &cntCompressZstd, newZstdWriter)
+	re.add(kEncodingBrotli, cfg.CompressionLevelBrotli, &cntCompressBrotli, newBrotliWriter)
+
+	return re
+}
+
+func (re *responseEncoder) add(name string, level int, stats *compressionStats, newF func(level int) (resetWriter, error)) {
+	if level == flate.NoCompression {
+		return
+	}
+
+	c, err := newCodec(name, level, stats, newF)
+	if err != nil {
+		log.Warn().Err(err).Str("encoding", name).Int("lvl", level).Msg("Disable response encoding")
+		return
+	}
+
+	re.codecs[name] = c
+}
+
+// Select the codec for the response from the Accept-Encoding header of the request.
+// Returns nil if the response is sent unencoded.
+func (re *responseEncoder) negotiate(r *http.Request) *codec {
+	if re == nil || len(re.codecs) == 0 {
+		return nil
+	}
+
+	accepted := parseAcceptEncoding(r.Header.Values("Accept-Encoding"))
+
+	var (
+		best  *codec
+		bestQ float64
+	)
+	for _, name := range encodingPreference {
+		c, ok := re.codecs[name]
+		if !ok {
+			continue
+		}
+
+		q, ok := accepted[name]
+		if !ok {
+			q, ok = accepted[kEncodingAny]
+		}
+
+		// Strictly greater; ties go to the earlier encoding in the preference list
+		if ok && q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+
+	return best
+}
+
+// Write the payload, encoded if larger than the compression threshold.
+// Returns the number of bytes written on the wire.
+func (re *responseEncoder) write(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, payload []byte) (uint64, error) {
+	if re != nil && len(re.codecs) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	c := re.negotiate(r)
+	if c == nil || len(payload) <= re.thresh {
+		n, err := w.Write(payload)
+		return uint64(n), err
+	}
+
+	w.Header().Set("Content-Encoding", c.name)
+
+	wrCounter := datacounter.NewWriterCounter(w)
+	err := c.encode(wrCounter, payload)
+
+	c.stats.Observe(uint64(len(payload)), wrCounter.Count())
+
+	zlog.Trace().
+		Err(err).
+		Str("encoding", c.name).
+		Int("lvl", c.level).
+		Int("srcSz", len(payload)).
+		Uint64("dstSz", wrCounter.Count()).
+		Msg("compressing response")
+
+	return wrCounter.Count(), err
+}
+
+// Parse the Accept-Encoding header values into the weight of each encoding.
+// An encoding with weight 0 is explicitly refused.
+func parseAcceptEncoding(values []string) map[string]float64 {
+	accepted := make(map[string]float64)
+
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			name, q := item, 1.0
+			if i := strings.IndexByte(item, ';'); i >= 0 {
+				name, q = item[:i], parseQValue(item[i+1:])
+			}
+
+			name = strings.ToLower(strings.TrimSpace(name))
+			switch name {
+			case "":
+				continue
+			case kEncodingGzipAlias:
+				name = kEncodingGzip
+			}
+
+			accepted[name] = q
+		}
+	}
+
+	return accepted
+}
+
+// Parse the weight from the parameters of an Accept-Encoding item; malformed weights refuse the encoding.
+func parseQValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		i := strings.IndexByte(param, '=')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(param[:i]), "q") {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(strings.TrimSpace(param[i+1:]), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+
+	return 1
+}
+
+// Request body decoded according to its Content-Encoding
+type requestBody struct {
+	io.Reader
+	wire    *datacounter.ReaderCounter
+	decoded *datacounter.ReaderCounter
+	closeF  func()
+}
+
+// Wrap the request body to decode its Content-Encoding. The body size limit applies to the
+// bytes on the wire; the decoded size limit guards against highly compressed payloads.
+// Close must be called once the body is read.
+func newRequestBody(w http.ResponseWriter, r *http.Request, lim *config.Limit) (*requestBody, error) {
+	body := r.Body
+
+	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
+	if lim.MaxBody > 0 {
+		body = http.MaxBytesReader(w, body, lim.MaxBody)
+	}
+
+	rb := &requestBody{wire: datacounter.NewReaderCounter(body)}
+
+	var rd io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", kEncodingIdentity:
+		rd = rb.wire
+	case kEncodingGzip, kEncodingGzipAlias:
+		zr, err := gzip.NewReader(rb.wire)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode gzip body")
+		}
+		rd = zr
+	case kEncodingZstd:
+		zr, err := zstd.NewReader(rb.wire, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "decode zstd body")
+		}
+		rd, rb.closeF = zr, zr.Close
+	default:
+		return nil, errors.Wrap(ErrUnsupportedEncoding, encoding)
+	}
+
+	if rd != rb.wire {
+		rd = &limitReader{r: rd, n: lim.DecodedBodyLimit()}
+	}
+
+	rb.decoded = datacounter.NewReaderCounter(rd)
+	rb.Reader = rb.decoded
+
+	return rb, nil
+}
+
+// Number of bytes read on the wire and once decoded
+func (rb *requestBody) Count() (wire, decoded uint64) {
+	return rb.wire.Count(), rb.decoded.Count()
+}
+
+func (rb *requestBody) Close() {
+	if rb.closeF != nil {
+		rb.closeF()
+	}
+}
+
+// Like io.LimitReader but fails instead of truncating the stream
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+
+	// Read one byte past the limit to detect the overflow
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.n {
+		n, lr.n = int(lr.n), -1
+		return n, ErrBodyTooLarge
+	}
+
+	lr.n -= int64(n)
+	return n, err
+}
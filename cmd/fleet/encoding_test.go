@@ -0,0 +1,385 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package fleet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func testResponseEncoder() *responseEncoder {
+	var cfg config.Server
+	cfg.InitDefaults()
+	return newResponseEncoder(&cfg)
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var rd io.Reader
+	switch encoding {
+	case "":
+		return body
+	case kEncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		rd = zr
+	case kEncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer zr.Close()
+		rd = zr
+	case kEncodingBrotli:
+		rd = brotli.NewReader(bytes.NewReader(body))
+	default:
+		t.Fatalf("unexpected encoding %q", encoding)
+	}
+
+	out, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	return out
+}
+
+func TestParseAcceptEncoding(t *testing.T) {
+	accepted := parseAcceptEncoding([]string{"gzip, deflate", "br;q=0.5, zstd;q=0", "X-Gzip ; q=0.8", "*;q=bogus"})
+
+	assert.Equal(t, map[string]float64{
+		kEncodingGzip:   0.8,
+		"deflate":       1,
+		kEncodingBrotli: 0.5,
+		kEncodingZstd:   0,
+		kEncodingAny:    0,
+	}, accepted)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	enc := testResponseEncoder()
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", kEncodingGzip},
+		{"gzip, deflate", kEncodingGzip},
+		{"gzip, deflate, br", kEncodingBrotli},
+		{"gzip, br, zstd", kEncodingZstd},
+		{"gzip, br;q=0.9, zstd;q=0.5", kEncodingGzip},
+		{"zstd;q=0, *", kEncodingBrotli},
+		{"*;q=0.5, gzip", kEncodingGzip},
+		{"*;q=0", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept-Encoding", tc.accept)
+			}
+
+			c := enc.negotiate(r)
+			if tc.want == "" {
+				assert.Nil(t, c)
+			} else {
+				require.NotNil(t, c)
+				assert.Equal(t, tc.want, c.name)
+			}
+		})
+	}
+}
+
+func TestNegotiateDisabledCodec(t *testing.T) {
+	var cfg config.Server
+	cfg.InitDefaults()
+	cfg.CompressionLevelZstd = 0
+	enc := newResponseEncoder(&cfg)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "zstd")
+	assert.Nil(t, enc.negotiate(r))
+
+	r.Header.Set("Accept-Encoding", "zstd, gzip")
+	require.NotNil(t, enc.negotiate(r))
+	assert.Equal(t, kEncodingGzip, enc.negotiate(r).name)
+}
+
+func TestResponseEncoderWrite(t *testing.T) {
+	enc := testResponseEncoder()
+	payload := []byte(strings.Repeat(`{"id":"action-id","type":"POLICY_CHANGE"}`, 100))
+
+	for _, encoding := range []string{kEncodingGzip, kEncodingZstd, kEncodingBrotli} {
+		t.Run(encoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+
+			n, err := enc.write(zerolog.Nop(), w, r, payload)
+			require.NoError(t, err)
+
+			assert.Equal(t, encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, uint64(w.Body.Len()), n)
+			assert.Less(t, w.Body.Len(), len(payload))
+			assert.Equal(t, payload, decodeBody(t, encoding, w.Body.Bytes()))
+		})
+	}
+
+	t.Run("below threshold", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		n, err := enc.write(zerolog.Nop(), w, r, []byte(`{}`))
+		require.NoError(t, err)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, uint64(2), n)
+		assert.Equal(t, `{}`, w.Body.String())
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		w := httptest.NewRecorder()
+
+		_, err := enc.write(zerolog.Nop(), w, r, payload)
+		require.NoError(t, err)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, payload, w.Body.Bytes())
+	})
+}
+
+func TestCompressionStats(t *testing.T) {
+	src, dst := cntCompressZstd.srcBytes.Get(), cntCompressZstd.dstBytes.Get()
+
+	cntCompressZstd.Observe(1000, 100)
+
+	assert.Equal(t, src+1000, cntCompressZstd.srcBytes.Get())
+	assert.Equal(t, dst+100, cntCompressZstd.dstBytes.Get())
+	assert.Equal(t, float64(src+1000)/float64(dst+100), cntCompressZstd.ratio.Get())
+}
+
+func TestWriteArtifactEncoded(t *testing.T) {
+	enc := testResponseEncoder()
+	body := []byte(strings.Repeat("0123456789", 200))
+
+	artifact := &model.Artifact{
+		Identifier:           "endpoint-trustlist-windows-v1",
+		Body:                 body,
+		EncodedSha256:        "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882",
+		CompressionAlgorithm: "none",
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/id/sha2", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+
+	nWritten, status := writeArtifact(w, r, artifact, enc, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, kEncodingBrotli, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.Quote(artifact.EncodedSha256+"-"+kEncodingBrotli), w.Header().Get("ETag"))
+	assert.Equal(t, int64(w.Body.Len()), nWritten)
+	assert.Equal(t, body, decodeBody(t, kEncodingBrotli, w.Body.Bytes()))
+
+	// Artifacts compressed on upload are sent as is
+	artifact.CompressionAlgorithm = "zlib"
+	w = httptest.NewRecorder()
+
+	_, status = writeArtifact(w, r, artifact, enc, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.Quote(artifact.EncodedSha256), w.Header().Get("ETag"))
+	assert.Equal(t, body, w.Body.Bytes())
+}
+
+func TestWriteArtifactEncodedCached(t *testing.T) {
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	enc := testResponseEncoder()
+	artifact := &model.Artifact{
+		Identifier:           "endpoint-trustlist-windows-v1",
+		Body:                 []byte(strings.Repeat("0123456789", 200)),
+		DecodedSha256:        "decoded-sha2",
+		EncodedSha256:        "encoded-sha2",
+		CompressionAlgorithm: "none",
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/id/sha2", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	w := httptest.NewRecorder()
+
+	_, status := writeArtifact(w, r, artifact, enc, c)
+	assert.Equal(t, http.StatusOK, status)
+
+	var cached []byte
+	require.Eventually(t, func() bool {
+		var ok bool
+		cached, ok = c.GetEncodedArtifact(artifact.Identifier, artifact.DecodedSha256, kEncodingBrotli)
+		return ok
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, w.Body.Bytes(), cached)
+
+	// Served off the cache without compressing again
+	src := cntCompressBrotli.srcBytes.Get()
+	w = httptest.NewRecorder()
+
+	_, status = writeArtifact(w, r, artifact, enc, c)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, kEncodingBrotli, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, strconv.Quote(artifact.EncodedSha256+"-"+kEncodingBrotli), w.Header().Get("ETag"))
+	assert.Equal(t, cached, w.Body.Bytes())
+	assert.Equal(t, src, cntCompressBrotli.srcBytes.Get())
+}
+
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	switch encoding {
+	case kEncodingGzip:
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(body)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	case kEncodingZstd:
+		zw, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		_, err = zw.Write(body)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+	default:
+		return body
+	}
+	return buf.Bytes()
+}
+
+func TestRequestBody(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"action_id":"action-id","type":"ACTION_RESULT"}`, 100))
+	lim := &config.Limit{MaxBody: 1024 * 1024, MaxBodyDecoded: 10 * 1024 * 1024}
+
+	for _, encoding := range []string{"", kEncodingIdentity, kEncodingGzip, kEncodingGzipAlias, kEncodingZstd} {
+		t.Run("encoding "+encoding, func(t *testing.T) {
+			codec := encoding
+			if codec == kEncodingGzipAlias {
+				codec = kEncodingGzip
+			}
+			wire := encodeBody(t, codec, payload)
+
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(wire))
+			r.Header.Set("Content-Encoding", encoding)
+
+			body, err := newRequestBody(httptest.NewRecorder(), r, lim)
+			require.NoError(t, err)
+			defer body.Close()
+
+			got, err := ioutil.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, payload, got)
+
+			nWire, nDecoded := body.Count()
+			assert.Equal(t, uint64(len(wire)), nWire)
+			assert.Equal(t, uint64(len(payload)), nDecoded)
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		r.Header.Set("Content-Encoding", "compress")
+
+		_, err := newRequestBody(httptest.NewRecorder(), r, lim)
+		assert.ErrorIs(t, err, ErrUnsupportedEncoding)
+		assert.Equal(t, http.StatusUnsupportedMediaType, NewErrorResp(err).StatusCode)
+	})
+
+	t.Run("decoded too large", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encodeBody(t, kEncodingZstd, payload)))
+		r.Header.Set("Content-Encoding", kEncodingZstd)
+
+		body, err := newRequestBody(httptest.NewRecorder(), r, &config.Limit{MaxBody: 1024, MaxBodyDecoded: int64(len(payload) - 1)})
+		require.NoError(t, err)
+		defer body.Close()
+
+		_, err = ioutil.ReadAll(body)
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, NewErrorResp(err).StatusCode)
+	})
+
+	t.Run("decoded at limit", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encodeBody(t, kEncodingGzip, payload)))
+		r.Header.Set("Content-Encoding", kEncodingGzip)
+
+		body, err := newRequestBody(httptest.NewRecorder(), r, &config.Limit{MaxBodyDecoded: int64(len(payload))})
+		require.NoError(t, err)
+		defer body.Close()
+
+		got, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, payload, got)
+	})
+
+	t.Run("wire too large", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+
+		body, err := newRequestBody(httptest.NewRecorder(), r, &config.Limit{MaxBody: 100})
+		require.NoError(t, err)
+		defer body.Close()
+
+		_, err = ioutil.ReadAll(body)
+		assert.Error(t, err)
+	})
+
+	t.Run("decoded bounded with unlimited wire size", func(t *testing.T) {
+		lim := &config.Limit{}
+
+		var wire bytes.Buffer
+		zw, err := zstd.NewWriter(&wire)
+		require.NoError(t, err)
+		_, err = io.CopyN(zw, zeroReader{}, lim.DecodedBodyLimit()+1)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		r := httptest.NewRequest(http.MethodPost, "/", &wire)
+		r.Header.Set("Content-Encoding", kEncodingZstd)
+
+		body, err := newRequestBody(httptest.NewRecorder(), r, lim)
+		require.NoError(t, err)
+		defer body.Close()
+
+		_, err = io.Copy(ioutil.Discard, body)
+		assert.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/admission"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
@@ -82,6 +83,51 @@ func NewErrorResp(err error) errResp {
 				zerolog.InfoLevel,
 			},
 		},
+		{
+			ErrExpiredEnrollmentKey,
+			errResp{
+				http.StatusUnauthorized,
+				"ExpiredEnrollmentKey",
+				"enrollment key has expired",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrSharedIdConflict,
+			errResp{
+				http.StatusConflict,
+				"SharedIdConflict",
+				"shared id in use by another agent",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrIdempotencyConflict,
+			errResp{
+				http.StatusConflict,
+				"IdempotencyConflict",
+				"idempotency key reused with a different request",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrEnrollmentQuota,
+			errResp{
+				http.StatusTooManyRequests,
+				"EnrollmentQuotaExceeded",
+				"enrollment key quota exceeded",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			admission.ErrDenied,
+			errResp{
+				http.StatusForbidden,
+				"EnrollmentDenied",
+				"enrollment denied by admission control",
+				zerolog.InfoLevel,
+			},
+		},
 		{
 			context.Canceled,
 			errResp{
@@ -127,6 +173,42 @@ func NewErrorResp(err error) errResp {
 				zerolog.DebugLevel,
 			},
 		},
+		{
+			ErrorForbidden,
+			errResp{
+				http.StatusForbidden,
+				"ArtifactForbidden",
+				"artifact not authorized for agent",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrActionNotFound,
+			errResp{
+				http.StatusNotFound,
+				"ActionNotFound",
+				"action could not be found",
+				zerolog.WarnLevel,
+			},
+		},
+		{
+			ErrUnsupportedEncoding,
+			errResp{
+				http.StatusUnsupportedMediaType,
+				"UnsupportedMediaType",
+				"content encoding is not supported",
+				zerolog.InfoLevel,
+			},
+		},
+		{
+			ErrBodyTooLarge,
+			errResp{
+				http.StatusRequestEntityTooLarge,
+				"RequestEntityTooLarge",
+				"decoded request body is too large",
+				zerolog.InfoLevel,
+			},
+		},
 		{
 			os.ErrDeadlineExceeded,
 			errResp{
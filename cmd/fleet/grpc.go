@@ -0,0 +1,732 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	pb "github.com/elastic/fleet-server/v7/internal/pkg/proto"
+	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
+
+	"github.com/elastic/beats/v7/libbeat/common/transport/tlscommon"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	kGRPCAuthorization = "authorization"
+	kGRPCUserAgent     = "user-agent"
+	kGRPCRequestId     = "x-request-id"
+
+	// Suffix appended by the gRPC libraries to the user agent of the application
+	kGRPCUserAgentSuffix = " grpc-"
+
+	kArtifactChunkSize = 64 * 1024
+)
+
+// GRPCServer serves the control plane API over gRPC.  The calls share the
+// business logic, the limiters and the metrics of the HTTP routes.
+type GRPCServer struct {
+	pb.UnimplementedFleetServer
+
+	ctx context.Context
+	ct  *CheckinT
+	et  *EnrollerT
+	at  *ArtifactT
+	ack *AckT
+}
+
+func NewGRPCServer(ctx context.Context, ct *CheckinT, et *EnrollerT, at *ArtifactT, ack *AckT) *GRPCServer {
+	return &GRPCServer{
+		ctx: ctx,
+		ct:  ct,
+		et:  et,
+		at:  at,
+		ack: ack,
+	}
+}
+
+func (s *GRPCServer) Enroll(ctx context.Context, req *pb.EnrollRequest) (*pb.EnrollResponse, error) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	zlog := log.With().
+		Str(EcsHttpRequestId, firstMeta(md, kGRPCRequestId)).
+		Str("mod", kEnrollMod).
+		Logger()
+
+	// Error in the scope for deferred rolback function check
+	var err error
+
+	// Initialize rollback/cleanup for enrollment
+	// This deletes all the artifacts that were created during enrollment
+	rb := rollback.New(zlog)
+	defer func() {
+		if err != nil {
+			zlog.Error().Err(err).Msg("perform rollback on enrollment failure")
+			// Using the server context for the rollback
+			if rerr := rb.Rollback(s.ctx); rerr != nil {
+				zlog.Error().Err(rerr).Msg("rollback error on enrollment failure")
+			}
+		}
+	}()
+
+	var resp *EnrollResponse
+	resp, err = s.enroll(ctx, rb, &zlog, md, req)
+	if err != nil {
+		cntEnroll.IncError(err)
+		return nil, grpcError(zlog, err, start, "fail enroll")
+	}
+
+	var pbResp *pb.EnrollResponse
+	if pbResp, err = toPbEnrollResponse(resp); err != nil {
+		cntEnroll.IncError(err)
+		return nil, grpcError(zlog, err, start, "fail enroll")
+	}
+
+	cntEnroll.bodyOut.Add(uint64(proto.Size(pbResp)))
+
+	zlog.Info().
+		Str(LogAgentId, resp.Item.ID).
+		Str(LogPolicyId, resp.Item.PolicyId).
+		Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+		Msg("Elastic Agent successfully enrolled over gRPC")
+
+	return pbResp, nil
+}
+
+func (s *GRPCServer) enroll(ctx context.Context, rb *rollback.Rollback, zlog *zerolog.Logger, md metadata.MD, req *pb.EnrollRequest) (*EnrollResponse, error) {
+	et := s.et
+
+	limitF, err := et.limit.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer limitF()
+
+	key, err := apikey.ExtractAPIKeyFromHeader(md.Get(kGRPCAuthorization))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err = authKey(ctx, key, firstMeta(md, kGRPCRequestId), et.bulker, et.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogEnrollApiKeyId, key.Id)
+	})
+
+	ver, err := checkUserAgent(*zlog, grpcUserAgent(md), et.verCon)
+	if err != nil {
+		return nil, err
+	}
+
+	dfunc := cntEnroll.IncStart()
+	defer dfunc()
+
+	erec, err := et.fetchEnrollmentKeyRecord(ctx, key.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateIdempotencyKey(req.IdempotencyKey); err != nil {
+		return nil, err
+	}
+
+	ereq := &EnrollRequest{
+		Type:     req.Type,
+		SharedId: req.SharedId,
+	}
+	ereq.Meta.User = req.UserProvidedMetadata
+	ereq.Meta.Local = req.LocalMetadata
+	ereq.Meta.Tags = req.Tags
+
+	if err = validateEnrollRequest(ereq); err != nil {
+		return nil, err
+	}
+
+	cntEnroll.bodyIn.Add(uint64(proto.Size(req)))
+
+	return et.enroll(ctx, rb, *zlog, erec, ereq, ver, peerAddr(ctx), req.IdempotencyKey)
+}
+
+func (s *GRPCServer) Checkin(ctx context.Context, req *pb.CheckinRequest) (*pb.CheckinResponse, error) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	zlog := log.With().
+		Str(LogAgentId, req.AgentId).
+		Str(EcsHttpRequestId, firstMeta(md, kGRPCRequestId)).
+		Logger()
+
+	resp, err := s.checkin(ctx, &zlog, md, start, req)
+	if err != nil {
+		cntCheckin.IncError(err)
+		return nil, grpcError(zlog, err, start, "fail checkin")
+	}
+
+	return resp, nil
+}
+
+func (s *GRPCServer) checkin(ctx context.Context, zlog *zerolog.Logger, md metadata.MD, start time.Time, req *pb.CheckinRequest) (*pb.CheckinResponse, error) {
+	ct := s.ct
+
+	limitF, err := ct.limit.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer limitF()
+
+	agent, err := grpcAuthAgent(ctx, md, &req.AgentId, ct.bulker, ct.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogAccessApiKeyId, agent.AccessApiKeyId)
+	})
+
+	ver, err := checkUserAgent(*zlog, grpcUserAgent(md), ct.verCon)
+	if err != nil {
+		return nil, err
+	}
+
+	newVer := agent.CheckDifferentVersion(ver)
+
+	dfunc := cntCheckin.IncStart()
+	defer dfunc()
+
+	cntCheckin.bodyIn.Add(uint64(proto.Size(req)))
+
+	resp, err := ct.longPoll(ctx, *zlog, start, agent, newVer, &CheckinRequest{
+		Status:    req.Status,
+		AckToken:  req.AckToken,
+		Events:    fromPbEvents(req.Events),
+		LocalMeta: req.LocalMetadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pbResp, err := toPbCheckinResponse(resp.Actions, resp.AckToken)
+	if err != nil {
+		return nil, err
+	}
+
+	cntCheckin.bodyOut.Add(uint64(proto.Size(pbResp)))
+
+	return pbResp, nil
+}
+
+// CheckinStream is the gRPC counterpart of the server-sent events stream.
+func (s *GRPCServer) CheckinStream(req *pb.CheckinStreamRequest, srv pb.Fleet_CheckinStreamServer) error {
+	start := time.Now()
+
+	ctx := srv.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	zlog := log.With().
+		Str(LogAgentId, req.AgentId).
+		Str(EcsHttpRequestId, firstMeta(md, kGRPCRequestId)).
+		Logger()
+
+	sender := &grpcStreamSender{srv: srv}
+
+	err := s.checkinStream(ctx, &zlog, md, req, sender)
+
+	switch {
+	case err == nil, sender.started && errors.Is(err, context.Canceled):
+		zlog.Debug().Msg("stream end")
+		return nil
+	case !sender.started:
+		cntStream.IncError(err)
+		return grpcError(zlog, err, start, "fail stream")
+	default:
+		cntStream.IncError(err)
+		zlog.Warn().Err(err).Msg("stream closed on error")
+		return status.Error(codes.Unavailable, "stream closed")
+	}
+}
+
+func (s *GRPCServer) checkinStream(ctx context.Context, zlog *zerolog.Logger, md metadata.MD, req *pb.CheckinStreamRequest, sender *grpcStreamSender) error {
+	ct := s.ct
+
+	// A stream holds its slot until it ends
+	limitF, err := ct.streamLimit.Acquire()
+	if err != nil {
+		return err
+	}
+	defer limitF()
+
+	agent, err := grpcAuthAgent(ctx, md, &req.AgentId, ct.bulker, ct.cache)
+	if err != nil {
+		return err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogAccessApiKeyId, agent.AccessApiKeyId)
+	})
+
+	ver, err := checkUserAgent(*zlog, grpcUserAgent(md), ct.verCon)
+	if err != nil {
+		return err
+	}
+
+	newVer := agent.CheckDifferentVersion(ver)
+
+	dfunc := cntStream.IncStart()
+	defer dfunc()
+
+	return ct.stream(ctx, *zlog, agent, newVer, req.AckToken, sender)
+}
+
+// Sends the stream as gRPC messages
+type grpcStreamSender struct {
+	srv     pb.Fleet_CheckinStreamServer
+	started bool
+}
+
+func (s *grpcStreamSender) Start() error {
+	if err := s.srv.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	s.started = true
+	return nil
+}
+
+func (s *grpcStreamSender) Send(actions []ActionResp, ackToken string) error {
+	resp, err := toPbCheckinResponse(actions, ackToken)
+	if err != nil {
+		return err
+	}
+
+	if err = s.srv.Send(resp); err != nil {
+		return err
+	}
+
+	cntStream.bodyOut.Add(uint64(proto.Size(resp)))
+	return nil
+}
+
+// The connection is kept alive by the HTTP/2 pings of the server
+func (s *grpcStreamSender) KeepAlive() error {
+	return nil
+}
+
+func (s *GRPCServer) Ack(ctx context.Context, req *pb.AckRequest) (*pb.AckResponse, error) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	zlog := log.With().
+		Str(LogAgentId, req.AgentId).
+		Str(EcsHttpRequestId, firstMeta(md, kGRPCRequestId)).
+		Logger()
+
+	items, err := s.acks(ctx, &zlog, md, req)
+	if err != nil {
+		cntAcks.IncError(err)
+		return nil, grpcError(zlog, err, start, "fail ACK")
+	}
+
+	return toPbAckResponse(newAckResponse(items)), nil
+}
+
+func (s *GRPCServer) acks(ctx context.Context, zlog *zerolog.Logger, md metadata.MD, req *pb.AckRequest) ([]AckResponseItem, error) {
+	ack := s.ack
+
+	limitF, err := ack.limit.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer limitF()
+
+	agent, err := grpcAuthAgent(ctx, md, &req.AgentId, ack.bulk, ack.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogAccessApiKeyId, agent.AccessApiKeyId)
+	})
+
+	dfunc := cntAcks.IncStart()
+	defer dfunc()
+
+	cntAcks.bodyIn.Add(uint64(proto.Size(req)))
+
+	l := zlog.With().Int("nEvents", len(req.Events)).Logger()
+
+	return ack.handleAckEvents(ctx, l, agent, fromPbEvents(req.Events))
+}
+
+func (s *GRPCServer) Artifact(req *pb.ArtifactRequest, srv pb.Fleet_ArtifactServer) error {
+	start := time.Now()
+
+	ctx := srv.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	zlog := log.With().
+		Str("id", req.Id).
+		Str(EcsHttpRequestId, firstMeta(md, kGRPCRequestId)).
+		Str("sha2", req.Sha256).
+		Str("remoteAddr", peerAddr(ctx)).
+		Logger()
+
+	artifact, err := s.artifact(ctx, &zlog, md, req)
+	if err != nil {
+		cntArtifacts.IncError(err)
+		return grpcError(zlog, err, start, "fail artifact")
+	}
+
+	nWritten, err := sendArtifact(srv, artifact)
+	cntArtifacts.bodyOut.Add(uint64(nWritten))
+
+	if err != nil {
+		cntArtifacts.IncError(err)
+		zlog.Info().
+			Err(err).
+			Int64(EcsHttpResponseBodyBytes, nWritten).
+			Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+			Msg("fail send artifact")
+		return err
+	}
+
+	zlog.Trace().
+		Int64(EcsHttpResponseBodyBytes, nWritten).
+		Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+		Msg("Response sent")
+
+	return nil
+}
+
+func (s *GRPCServer) artifact(ctx context.Context, zlog *zerolog.Logger, md metadata.MD, req *pb.ArtifactRequest) (*model.Artifact, error) {
+	at := s.at
+
+	limitF, err := at.limit.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer limitF()
+
+	agent, err := grpcAuthAgent(ctx, md, nil, at.bulker, at.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogAccessApiKeyId, agent.AccessApiKeyId)
+	})
+
+	dfunc := cntArtifacts.IncStart()
+	defer dfunc()
+
+	return at.processRequest(ctx, *zlog, agent, req.Id, req.Sha256)
+}
+
+// Send the artifact payload in chunks; the first chunk describes the artifact.
+func sendArtifact(srv pb.Fleet_ArtifactServer, artifact *model.Artifact) (int64, error) {
+	chunk := &pb.ArtifactChunk{
+		EncodedSha256:        artifact.EncodedSha256,
+		EncodedSize:          artifact.EncodedSize,
+		CompressionAlgorithm: artifact.CompressionAlgorithm,
+		EncryptionAlgorithm:  artifact.EncryptionAlgorithm,
+	}
+
+	var nWritten int64
+	body := artifact.Body
+	for {
+		sz := len(body)
+		if sz > kArtifactChunkSize {
+			sz = kArtifactChunkSize
+		}
+		chunk.Data = body[:sz]
+
+		if err := srv.Send(chunk); err != nil {
+			return nWritten, err
+		}
+
+		nWritten += int64(sz)
+		body = body[sz:]
+
+		if len(body) == 0 {
+			return nWritten, nil
+		}
+		chunk = &pb.ArtifactChunk{}
+	}
+}
+
+func grpcAuthAgent(ctx context.Context, md metadata.MD, id *string, bulker bulk.Bulk, c cache.Cache) (*model.Agent, error) {
+	key, err := apikey.ExtractAPIKeyFromHeader(md.Get(kGRPCAuthorization))
+	if err != nil {
+		return nil, err
+	}
+
+	return authAgentKey(ctx, key, firstMeta(md, kGRPCRequestId), id, bulker, c)
+}
+
+// The gRPC libraries append their own identifier to the user agent of the agent
+func grpcUserAgent(md metadata.MD) string {
+	userAgent := firstMeta(md, kGRPCUserAgent)
+	if i := strings.Index(strings.ToLower(userAgent), kGRPCUserAgentSuffix); i >= 0 {
+		userAgent = userAgent[:i]
+	}
+	return userAgent
+}
+
+func firstMeta(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// Translate the error into a status with the code matching the HTTP response status.
+func grpcError(zlog zerolog.Logger, err error, start time.Time, msg string) error {
+	resp := NewErrorResp(err)
+
+	// Log this as warn for visibility that limit has been reached, as on checkin.
+	if errors.Is(err, limit.ErrMaxLimit) {
+		resp.Level = zerolog.WarnLevel
+	}
+
+	code := grpcCode(err, resp.StatusCode)
+
+	zlog.WithLevel(resp.Level).
+		Err(err).
+		Str("code", code.String()).
+		Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+		Msg(msg)
+
+	desc := resp.Message
+	if desc == "" {
+		desc = resp.Error
+	}
+
+	return status.Error(code, desc)
+}
+
+func grpcCode(err error, statusCode int) codes.Code {
+	switch {
+	case errors.Is(err, apikey.ErrNoAuthHeader),
+		errors.Is(err, apikey.ErrMalformedHeader),
+		errors.Is(err, apikey.ErrMalformedToken),
+		errors.Is(err, apikey.ErrInvalidToken):
+		return codes.Unauthenticated
+	}
+
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.InvalidArgument
+}
+
+func toPbAction(a ActionResp) (*pb.Action, error) {
+	data, err := json.Marshal(a.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal action data")
+	}
+
+	return &pb.Action{
+		Id:        a.Id,
+		AgentId:   a.AgentId,
+		CreatedAt: a.CreatedAt,
+		Type:      a.Type,
+		InputType: a.InputType,
+		Timeout:   a.Timeout,
+		Data:      data,
+	}, nil
+}
+
+func toPbCheckinResponse(actions []ActionResp, ackToken string) (*pb.CheckinResponse, error) {
+	resp := &pb.CheckinResponse{
+		AckToken: ackToken,
+		Actions:  make([]*pb.Action, 0, len(actions)),
+	}
+
+	for _, a := range actions {
+		action, err := toPbAction(a)
+		if err != nil {
+			return nil, err
+		}
+		resp.Actions = append(resp.Actions, action)
+	}
+
+	return resp, nil
+}
+
+func toPbEnrollResponse(resp *EnrollResponse) (*pb.EnrollResponse, error) {
+	item := resp.Item
+
+	pbResp := &pb.EnrollResponse{
+		Id:                   item.ID,
+		Active:               item.Active,
+		PolicyId:             item.PolicyId,
+		Type:                 item.Type,
+		EnrolledAt:           item.EnrolledAt,
+		UserProvidedMetadata: item.UserMeta,
+		LocalMetadata:        item.LocalMeta,
+		Tags:                 item.Tags,
+		AccessApiKeyId:       item.AccessApiKeyId,
+		AccessApiKey:         item.AccessAPIKey,
+		Status:               item.Status,
+	}
+
+	for _, v := range item.Actions {
+		a, ok := v.(ActionResp)
+		if !ok {
+			return nil, errors.Errorf("unexpected enroll action type %T", v)
+		}
+
+		action, err := toPbAction(a)
+		if err != nil {
+			return nil, err
+		}
+		pbResp.Actions = append(pbResp.Actions, action)
+	}
+
+	return pbResp, nil
+}
+
+func toPbAckResponse(resp AckResponse) *pb.AckResponse {
+	items := make([]*pb.AckItem, len(resp.Items))
+	for i, item := range resp.Items {
+		items[i] = &pb.AckItem{
+			Status:  int32(item.Status),
+			Message: item.Message,
+		}
+	}
+
+	return &pb.AckResponse{
+		Errors: resp.Errors,
+		Items:  items,
+	}
+}
+
+func fromPbEvents(events []*pb.Event) []Event {
+	if len(events) == 0 {
+		return nil
+	}
+
+	out := make([]Event, 0, len(events))
+	for _, ev := range events {
+		out = append(out, Event{
+			Type:           ev.Type,
+			SubType:        ev.Subtype,
+			AgentId:        ev.AgentId,
+			ActionId:       ev.ActionId,
+			PolicyId:       ev.PolicyId,
+			StreamId:       ev.StreamId,
+			Timestamp:      ev.Timestamp,
+			Message:        ev.Message,
+			Payload:        ev.Payload,
+			StartedAt:      ev.StartedAt,
+			CompletedAt:    ev.CompletedAt,
+			ActionData:     ev.ActionData,
+			ActionResponse: ev.ActionResponse,
+			Data:           ev.Data,
+			Error:          ev.Error,
+		})
+	}
+	return out
+}
+
+func runGRPCServer(ctx context.Context, srv pb.FleetServer, cfg *config.Server) error {
+	addr := cfg.BindGRPCAddress()
+
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(cfg.GRPC.MaxMessageSize),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time: cfg.Timeouts.CheckinTimestamp,
+		}),
+	}
+
+	var listenCfg net.ListenConfig
+
+	ln, err := listenCfg.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { ln.Close() }()
+
+	ln = wrapConnLimitter(ctx, ln, cfg)
+
+	if cfg.TLS != nil && cfg.TLS.IsEnabled() {
+		commonTlsCfg, err := tlscommon.LoadTLSServerConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(commonTlsCfg.ToConfig())))
+	} else {
+		log.Warn().Msg("gRPC exposed over insecure connection; enablement of TLS is strongly recommended")
+	}
+
+	server := grpc.NewServer(opts...)
+	pb.RegisterFleetServer(server, srv)
+
+	forceCh := make(chan struct{})
+	defer close(forceCh)
+
+	// handler to stop server
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("force gRPC server stop on ctx.Done()")
+			server.Stop()
+		case <-forceCh:
+			log.Debug().Msg("go routine forced closed on exit")
+		}
+	}()
+
+	log.Info().
+		Str("bind", addr).
+		Int("maxMessageSize", cfg.GRPC.MaxMessageSize).
+		Msg("gRPC server listening")
+
+	// Serve returns nil once stopped
+	return server.Serve(ln)
+}
@@ -0,0 +1,186 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	pb "github.com/elastic/fleet-server/v7/internal/pkg/proto"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Authenticates any API key and finds the one agent
+type grpcBulk struct {
+	ftesting.MockBulk
+	agent model.Agent
+}
+
+func (m *grpcBulk) ApiKeyAuth(ctx context.Context, key bulk.ApiKey) (*bulk.SecurityInfo, error) {
+	return &bulk.SecurityInfo{Enabled: true}, nil
+}
+
+func (m *grpcBulk) Search(ctx context.Context, index string, body []byte, opts ...bulk.Opt) (*es.ResultT, error) {
+	src, err := json.Marshal(&m.agent)
+	if err != nil {
+		return nil, err
+	}
+	return &es.ResultT{
+		HitsT: es.HitsT{
+			Hits: []es.HitT{{Id: m.agent.Id, Source: src}},
+		},
+	}, nil
+}
+
+func startGRPCServer(t *testing.T, srv pb.FleetServer) pb.FleetClient {
+	ln := bufconn.Listen(1024 * 1024)
+
+	server := grpc.NewServer()
+	pb.RegisterFleetServer(server, srv)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return ln.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewFleetClient(conn)
+}
+
+func TestGRPCAck(t *testing.T) {
+	var cfg config.Server
+	cfg.InitDefaults()
+
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	bulker := &grpcBulk{agent: model.Agent{
+		ESDocument:     model.ESDocument{Id: "agent-id"},
+		AccessApiKeyId: "key-id",
+		Active:         true,
+		Agent:          &model.AgentMetadata{Id: "agent-id", Version: "7.15.0"},
+	}}
+
+	ack := NewAckT(&cfg, bulker, c, nil, nil)
+	client := startGRPCServer(t, NewGRPCServer(context.Background(), nil, nil, nil, ack))
+
+	req := &pb.AckRequest{
+		AgentId: "agent-id",
+		Events: []*pb.Event{{
+			Type:     "ACTION_RESULT",
+			Subtype:  "FAILED",
+			ActionId: "policy:policy-id:1:1",
+			Error:    "failed to apply",
+		}},
+	}
+
+	token := apikey.ApiKey{Id: "key-id", Key: "key"}.Token()
+
+	t.Run("authenticated", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), kGRPCAuthorization, "ApiKey "+token)
+		_, err := client.Ack(ctx, req)
+		require.NoError(t, err)
+	})
+
+	t.Run("no api key", func(t *testing.T) {
+		_, err := client.Ack(context.Background(), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("wrong agent", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), kGRPCAuthorization, "ApiKey "+token)
+		_, err := client.Ack(ctx, &pb.AckRequest{AgentId: "other-agent-id"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestGRPCUserAgent(t *testing.T) {
+	md := metadata.Pairs(kGRPCUserAgent, "Elastic Agent 7.15.0 grpc-go/1.29.1")
+	assert.Equal(t, "Elastic Agent 7.15.0", grpcUserAgent(md))
+
+	md = metadata.Pairs(kGRPCUserAgent, "Elastic Agent 7.15.0-SNAPSHOT")
+	assert.Equal(t, "Elastic Agent 7.15.0-SNAPSHOT", grpcUserAgent(md))
+
+	assert.Empty(t, grpcUserAgent(metadata.MD{}))
+}
+
+type artifactStream struct {
+	pb.Fleet_ArtifactServer
+	chunks []*pb.ArtifactChunk
+}
+
+func (s *artifactStream) Send(chunk *pb.ArtifactChunk) error {
+	s.chunks = append(s.chunks, chunk)
+	return nil
+}
+
+func TestSendArtifact(t *testing.T) {
+	body := make([]byte, 2*kArtifactChunkSize+10)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	srv := &artifactStream{}
+	n, err := sendArtifact(srv, &model.Artifact{
+		Body:                 body,
+		EncodedSha256:        "sha",
+		EncodedSize:          int64(len(body)),
+		CompressionAlgorithm: "zlib",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+
+	require.Len(t, srv.chunks, 3)
+	assert.Equal(t, "sha", srv.chunks[0].EncodedSha256)
+	assert.Equal(t, "zlib", srv.chunks[0].CompressionAlgorithm)
+	assert.Empty(t, srv.chunks[1].EncodedSha256)
+
+	var got []byte
+	for _, chunk := range srv.chunks {
+		got = append(got, chunk.Data...)
+	}
+	assert.Equal(t, body, got)
+}
+
+func TestToPbCheckinResponse(t *testing.T) {
+	actions, ackToken := convertActions("agent-id", []model.Action{{
+		ESDocument: model.ESDocument{Id: "doc-id"},
+		ActionId:   "action-id",
+		Type:       "UPGRADE",
+		Data:       json.RawMessage(`{"version":"7.15.1"}`),
+	}})
+
+	resp, err := toPbCheckinResponse(actions, ackToken)
+	require.NoError(t, err)
+	assert.Equal(t, "doc-id", resp.AckToken)
+	require.Len(t, resp.Actions, 1)
+	assert.Equal(t, "action-id", resp.Actions[0].Id)
+	assert.Equal(t, "agent-id", resp.Actions[0].AgentId)
+	assert.JSONEq(t, `{"version":"7.15.1"}`, string(resp.Actions[0].Data))
+}
@@ -14,14 +14,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/action"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
 	"github.com/pkg/errors"
 
 	"github.com/julienschmidt/httprouter"
@@ -29,16 +32,23 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var ErrEventAgentIdMismatch = errors.New("event agentId mismatch")
+const kAckAlreadyAcked = "already acked"
+
+var (
+	ErrEventAgentIdMismatch = errors.New("event agentId mismatch")
+	ErrActionNotFound       = errors.New("no matching action")
+)
 
 type AckT struct {
 	cfg   *config.Server
 	limit *limit.Limiter
 	bulk  bulk.Bulk
 	cache cache.Cache
+	wh    *webhook.Dispatcher
+	as    *action.StatusBulk
 }
 
-func NewAckT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *AckT {
+func NewAckT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache, wh *webhook.Dispatcher, as *action.StatusBulk) *AckT {
 	log.Info().
 		Interface("limits", cfg.Limits.AckLimit).
 		Msg("Setting config ack_limits")
@@ -48,6 +58,8 @@ func NewAckT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *AckT {
 		bulk:  bulker,
 		cache: cache,
 		limit: limit.NewLimiter(&cfg.Limits.AckLimit),
+		wh:    wh,
+		as:    as,
 	}
 }
 
@@ -107,19 +119,18 @@ func (ack *AckT) handleAcks(zlog *zerolog.Logger, w http.ResponseWriter, r *http
 
 func (ack *AckT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, agent *model.Agent) error {
 
-	body := r.Body
-
-	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
-	if ack.cfg.Limits.AckLimit.MaxBody > 0 {
-		body = http.MaxBytesReader(w, body, ack.cfg.Limits.AckLimit.MaxBody)
+	body, err := newRequestBody(w, r, &ack.cfg.Limits.AckLimit)
+	if err != nil {
+		return err
 	}
+	defer body.Close()
 
 	raw, err := ioutil.ReadAll(body)
 	if err != nil {
 		return errors.Wrap(err, "handleAcks read body")
 	}
 
-	cntAcks.bodyIn.Add(uint64(len(raw)))
+	cntAcks.AddBodyIn(body)
 
 	var req AckRequest
 	if err := json.Unmarshal(raw, &req); err != nil {
@@ -130,11 +141,12 @@ func (ack *AckT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r *h
 
 	zlog = zlog.With().Int("nEvents", len(req.Events)).Logger()
 
-	if err = ack.handleAckEvents(r.Context(), zlog, agent, req.Events); err != nil {
+	items, err := ack.handleAckEvents(r.Context(), zlog, agent, req.Events)
+	if err != nil {
 		return err
 	}
 
-	resp := AckResponse{"acks"}
+	resp := newAckResponse(items)
 
 	data, err := json.Marshal(&resp)
 	if err != nil {
@@ -151,10 +163,21 @@ func (ack *AckT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r *h
 	return nil
 }
 
-func (ack *AckT) handleAckEvents(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, events []Event) error {
-	var policyAcks []string
-	var unenroll bool
+// Ack the events of the request. Failures of individual events are reported in the
+// returned items, indexed as the events, so that the agent only retries the failed events.
+// The error is set if the actions of the events could not be resolved or written at all.
+func (ack *AckT) handleAckEvents(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, events []Event) ([]AckResponseItem, error) {
+	items := make([]AckResponseItem, len(events))
+
+	var (
+		policyAcks []string
+		policyIdxs []int
+		actionIdxs []int
+	)
+
 	for n, ev := range events {
+		items[n] = AckResponseItem{Status: http.StatusOK, Message: http.StatusText(http.StatusOK)}
+
 		zlog.Info().
 			Str("actionType", ev.Type).
 			Str("actionSubType", ev.SubType).
@@ -164,30 +187,85 @@ func (ack *AckT) handleAckEvents(ctx context.Context, zlog zerolog.Logger, agent
 			Msg("ack event")
 
 		if ev.AgentId != "" && ev.AgentId != agent.Id {
-			return ErrEventAgentIdMismatch
+			items[n] = newAckResponseItem(ErrEventAgentIdMismatch)
+			continue
 		}
 		if strings.HasPrefix(ev.ActionId, "policy:") {
 			if ev.Error == "" {
 				// only added if no error on action
 				policyAcks = append(policyAcks, ev.ActionId)
+				policyIdxs = append(policyIdxs, n)
+			} else if err := ack.handlePolicyError(ctx, zlog, agent, ev); err != nil {
+				items[n] = newAckResponseItem(err)
+			} else {
+				ack.notifyFailed(agent, ev)
 			}
 			continue
 		}
 
-		action, ok := ack.cache.GetAction(ev.ActionId)
-		if !ok {
-			actions, err := dl.FindAction(ctx, ack.bulk, ev.ActionId)
-			if err != nil {
-				return errors.Wrap(err, "find actions")
-			}
-			if len(actions) == 0 {
-				return errors.New("no matching action")
+		actionIdxs = append(actionIdxs, n)
+	}
+
+	if len(actionIdxs) > 0 {
+		if err := ack.handleActionResults(ctx, zlog, agent, events, actionIdxs, items); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(policyAcks) > 0 {
+		if err := ack.handlePolicyChange(ctx, zlog, agent, policyAcks...); err != nil {
+			for _, n := range policyIdxs {
+				items[n] = newAckResponseItem(err)
 			}
-			action = actions[0]
+		}
+	}
+
+	return items, nil
+}
+
+// Resolve the actions of the events with one search on cache miss and write all the action results in one bulk request.
+func (ack *AckT) handleActionResults(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, events []Event, idxs []int, items []AckResponseItem) error {
+	resolved := make(map[string]model.Action, len(idxs))
+
+	var missing []string
+	for _, n := range idxs {
+		id := events[n].ActionId
+		if _, ok := resolved[id]; ok {
+			continue
+		}
+		if action, ok := ack.cache.GetAction(id); ok {
+			resolved[id] = action
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	if len(missing) > 0 {
+		actions, err := dl.FindActions(ctx, ack.bulk, uniqueStrings(missing))
+		if err != nil {
+			return errors.Wrap(err, "find actions")
+		}
+		for _, action := range actions {
 			ack.cache.SetAction(action)
+			resolved[action.ActionId] = action
+		}
+	}
+
+	var (
+		acrs      []model.ActionResult
+		acrIdxs   []int
+		acrAction []model.Action
+	)
+	for _, n := range idxs {
+		ev := events[n]
+
+		action, ok := resolved[ev.ActionId]
+		if !ok {
+			items[n] = newAckResponseItem(ErrActionNotFound)
+			continue
 		}
 
-		acr := model.ActionResult{
+		acrs = append(acrs, model.ActionResult{
 			ActionId:       ev.ActionId,
 			AgentId:        agent.Id,
 			StartedAt:      ev.StartedAt,
@@ -196,37 +274,97 @@ func (ack *AckT) handleAckEvents(ctx context.Context, zlog zerolog.Logger, agent
 			ActionResponse: ev.ActionResponse,
 			Data:           ev.Data,
 			Error:          ev.Error,
+		})
+		acrIdxs = append(acrIdxs, n)
+		acrAction = append(acrAction, action)
+	}
+
+	if len(acrs) == 0 {
+		return nil
+	}
+
+	// The error is that of the last failed item; fail the request only if no item was returned.
+	resItems, bulkErr := dl.CreateActionResults(ctx, ack.bulk, acrs)
+	if len(resItems) != len(acrs) {
+		if bulkErr == nil {
+			bulkErr = errors.New("bulk response item count mismatch")
 		}
-		if _, err := dl.CreateActionResult(ctx, ack.bulk, acr); err != nil {
-			return errors.Wrap(err, "create action result")
-		}
+		return errors.Wrap(bulkErr, "create action results")
+	}
+
+	// The side effects run once per request, for the results created and for the results
+	// of previous acks whose side effects did not complete, so that a retried ack completes them.
+	var unenroll, upgrade bool
+	for i, n := range acrIdxs {
+		res := resItems[i]
+		ev := events[n]
 
-		if ev.Error == "" {
-			if action.Type == TypeUnenroll {
-				unenroll = true
-			} else if action.Type == TypeUpgrade {
-				if err := ack.handleUpgrade(ctx, zlog, agent); err != nil {
-					return err
-				}
+		if errors.Is(es.TranslateError(res.Status, res.Error), es.ErrElasticVersionConflict) {
+			zlog.Debug().Str("actionId", ev.ActionId).Int("n", n).Msg("ack event already acked")
+			items[n] = AckResponseItem{Status: http.StatusOK, Message: kAckAlreadyAcked}
+			if ev.Error == "" {
+				unenroll = unenroll || (acrAction[i].Type == TypeUnenroll && agent.Active)
+				upgrade = upgrade || (acrAction[i].Type == TypeUpgrade && agent.UpgradeStartedAt != "")
 			}
+			continue
+		}
+
+		if res.Status < 200 || res.Status > 299 {
+			items[n] = newBulkAckResponseItem(res, bulkErr)
+			continue
+		}
+
+		if ev.Error != "" {
+			ack.as.Failed(acrAction[i])
+			ack.notifyFailed(agent, ev)
+			continue
+		}
+		ack.as.Acked(acrAction[i])
+
+		switch acrAction[i].Type {
+		case TypeUnenroll:
+			unenroll = true
+		case TypeUpgrade:
+			upgrade = true
 		}
 	}
 
-	if len(policyAcks) > 0 {
-		if err := ack.handlePolicyChange(ctx, zlog, agent, policyAcks...); err != nil {
-			return err
+	if upgrade {
+		if err := ack.handleUpgrade(ctx, zlog, agent); err != nil {
+			setActionAckErrors(items, events, acrIdxs, acrAction, TypeUpgrade, err)
 		}
 	}
 
 	if unenroll {
 		if err := ack.handleUnenroll(ctx, zlog, agent); err != nil {
-			return err
+			setActionAckErrors(items, events, acrIdxs, acrAction, TypeUnenroll, err)
 		}
 	}
 
 	return nil
 }
 
+// Fail the acks of the actions of the type whose side effect failed with a retryable
+// status; the retried ack completes the side effect.
+func setActionAckErrors(items []AckResponseItem, events []Event, idxs []int, actions []model.Action, actionType string, err error) {
+	for i, n := range idxs {
+		if actions[i].Type == actionType && events[n].Error == "" {
+			items[n] = AckResponseItem{Status: http.StatusServiceUnavailable, Message: err.Error()}
+		}
+	}
+}
+
+// Notify an action failure once the ack is recorded; duplicate acks are not notified again.
+func (ack *AckT) notifyFailed(agent *model.Agent, ev Event) {
+	ack.wh.Notify(webhook.Event{
+		Type:     webhook.EventActionFailed,
+		AgentId:  agent.Id,
+		PolicyId: agent.PolicyId,
+		ActionId: ev.ActionId,
+		Error:    ev.Error,
+	})
+}
+
 func (ack *AckT) handlePolicyChange(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, actionIds ...string) error {
 	// If more than one, pick the winner;
 	// 0) Correct policy id
@@ -295,6 +433,51 @@ func (ack *AckT) handlePolicyChange(ctx context.Context, zlog zerolog.Logger, ag
 	return errors.Wrap(err, "handlePolicyChange update")
 }
 
+// Record on the agent the policy revision it failed to apply; cleared by handlePolicyChange
+// once that revision or a later one is acked.
+func (ack *AckT) handlePolicyError(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, ev Event) error {
+	rev, ok := policy.RevisionFromString(ev.ActionId)
+	if !ok {
+		zlog.Warn().Str("actionId", ev.ActionId).Msg("ack policy error on invalid revision")
+		return nil
+	}
+
+	cntPolicyApplyFailed.Inc(rev.PolicyId)
+
+	ts := ev.Timestamp
+	if ts == "" {
+		ts = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	doc := bulk.UpdateFields{
+		dl.FieldLastPolicyApplyError: model.PolicyApplyError{
+			PolicyId:       rev.PolicyId,
+			RevisionIdx:    rev.RevisionIdx,
+			CoordinatorIdx: rev.CoordinatorIdx,
+			Error:          ev.Error,
+			Timestamp:      ts,
+		},
+	}
+
+	body, err := doc.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "handlePolicyError marshal")
+	}
+
+	if err = ack.bulk.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh(), bulk.WithRetryOnConflict(3)); err != nil {
+		return errors.Wrap(err, "handlePolicyError update")
+	}
+
+	zlog.Info().
+		Str(LogPolicyId, rev.PolicyId).
+		Int64("policyRevision", rev.RevisionIdx).
+		Int64("policyCoordinator", rev.CoordinatorIdx).
+		Str("error", ev.Error).
+		Msg("ack policy error")
+
+	return nil
+}
+
 func (ack *AckT) handleUnenroll(ctx context.Context, zlog zerolog.Logger, agent *model.Agent) error {
 	apiKeys := _getAPIKeyIDs(agent)
 	if len(apiKeys) > 0 {
@@ -321,6 +504,12 @@ func (ack *AckT) handleUnenroll(ctx context.Context, zlog zerolog.Logger, agent
 		return errors.Wrap(err, "handleUnenroll update")
 	}
 
+	ack.wh.Notify(webhook.Event{
+		Type:     webhook.EventAgentUnenrolled,
+		AgentId:  agent.Id,
+		PolicyId: agent.PolicyId,
+	})
+
 	zlog.Info().Msg("ack unenroll")
 	return nil
 }
@@ -342,6 +531,12 @@ func (ack *AckT) handleUpgrade(ctx context.Context, zlog zerolog.Logger, agent *
 		return errors.Wrap(err, "handleUpgrade update")
 	}
 
+	ack.wh.Notify(webhook.Event{
+		Type:     webhook.EventAgentUpgraded,
+		AgentId:  agent.Id,
+		PolicyId: agent.PolicyId,
+	})
+
 	zlog.Info().
 		Str("lastReportedVersion", agent.Agent.Version).
 		Str("upgradedAt", now).
@@ -370,9 +565,16 @@ func _getAPIKeyIDs(agent *model.Agent) []string {
 // to allow for *other* changes to the agent record while we running the script.
 // (For example, say the background bulk check-in timestamp update task fires)
 //
+// The last policy apply error is cleared once the failed revision, a later one,
+// or a revision of another policy is applied; an older revision leaves it in place.
+//
 // WARNING: This assumes the input data is sanitized.
 
-const kUpdatePolicyPrefix = `{"script":{"lang":"painless","source":"if (ctx._source.policy_id == params.id) {ctx._source.remove('default_api_key_history');ctx._source.` +
+const kUpdatePolicyPrefix = `{"script":{"lang":"painless","source":"if (ctx._source.policy_id == params.id) {ctx._source.remove('default_api_key_history');def perr = ctx._source.` +
+	dl.FieldLastPolicyApplyError +
+	`;if (perr != null && (perr.policy_id != params.id || perr.revision_idx == null || perr.revision_idx <= params.rev)) {ctx._source.remove('` +
+	dl.FieldLastPolicyApplyError +
+	`');}ctx._source.` +
 	dl.FieldPolicyRevisionIdx +
 	` = params.rev;ctx._source.` +
 	dl.FieldPolicyCoordinatorIdx +
@@ -398,3 +600,49 @@ func makeUpdatePolicyBody(policyId string, newRev, coordIdx int64) []byte {
 
 	return buf.Bytes()
 }
+
+func newAckResponse(items []AckResponseItem) AckResponse {
+	resp := AckResponse{Action: "acks", Items: items}
+	for _, item := range items {
+		if item.Status != http.StatusOK {
+			resp.Errors = true
+			break
+		}
+	}
+	return resp
+}
+
+func newAckResponseItem(err error) AckResponseItem {
+	resp := NewErrorResp(err)
+	return AckResponseItem{Status: resp.StatusCode, Message: err.Error()}
+}
+
+// Keep the status of the failed bulk item; the agent retries on 429 and 5xx.
+// The status is not set if the bulk request of the item failed.
+func newBulkAckResponseItem(res bulk.BulkIndexerResponseItem, bulkErr error) AckResponseItem {
+	if res.Status == 0 {
+		msg := http.StatusText(http.StatusServiceUnavailable)
+		if bulkErr != nil {
+			msg = bulkErr.Error()
+		}
+		return AckResponseItem{Status: http.StatusServiceUnavailable, Message: msg}
+	}
+
+	msg := http.StatusText(res.Status)
+	if err := es.TranslateError(res.Status, res.Error); err != nil {
+		msg = err.Error()
+	}
+	return AckResponseItem{Status: res.Status, Message: msg}
+}
+
+func uniqueStrings(arr []string) []string {
+	seen := make(map[string]struct{}, len(arr))
+	out := arr[:0:0]
+	for _, s := range arr {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -5,9 +5,29 @@
 package fleet
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"encoding/json"
+	"errors"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkMakeUpdatePolicyBody(b *testing.B) {
@@ -37,3 +57,329 @@ func TestMakeUpdatePolicyBody(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHandleAckEventsNotifyFailed(t *testing.T) {
+	received := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+	}))
+	defer srv.Close()
+
+	var cfg config.Webhooks
+	cfg.InitDefaults()
+	cfg.Endpoints = []config.WebhookEndpoint{{Name: "paging", URL: srv.URL}}
+	wh, err := webhook.New(&cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	ack := &AckT{bulk: &ackBulk{}, wh: wh}
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "agent-id"},
+		PolicyId:   "policy-id",
+	}
+
+	_, err = ack.handleAckEvents(ctx, log.Logger, agent, []Event{
+		{ActionId: "policy:policy-id:2:1", AgentId: "agent-id", Error: "failed to apply policy"},
+	})
+	require.NoError(t, err)
+
+	select {
+	case body := <-received:
+		var ev webhook.Event
+		require.NoError(t, json.Unmarshal(body, &ev))
+		assert.Equal(t, webhook.EventActionFailed, ev.Type)
+		assert.Equal(t, "agent-id", ev.AgentId)
+		assert.Equal(t, "policy-id", ev.PolicyId)
+		assert.Equal(t, "policy:policy-id:2:1", ev.ActionId)
+		assert.Equal(t, "failed to apply policy", ev.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
+
+// Finds the known actions and fails the creation of the results listed in failIds.
+// Creating a document id twice fails with a version conflict.
+type ackBulk struct {
+	ftesting.MockBulk
+	actions  []model.Action
+	failIds  map[string]bool
+	searches [][]byte
+	creates  [][]bulk.MultiOp
+	created  map[string]bool
+	updates  []string
+	bodies   [][]byte
+
+	// number of updates to fail before succeeding
+	failUpdates int
+}
+
+func (m *ackBulk) Update(ctx context.Context, index, id string, body []byte, opts ...bulk.Opt) error {
+	m.updates = append(m.updates, id)
+	m.bodies = append(m.bodies, body)
+	if m.failUpdates > 0 {
+		m.failUpdates--
+		return errors.New("update failed")
+	}
+	return nil
+}
+
+func (m *ackBulk) Search(ctx context.Context, index string, body []byte, opts ...bulk.Opt) (*es.ResultT, error) {
+	m.searches = append(m.searches, body)
+
+	var hits []es.HitT
+	for _, action := range m.actions {
+		if !bytes.Contains(body, []byte(`"`+action.ActionId+`"`)) {
+			continue
+		}
+		src, err := json.Marshal(&action)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, es.HitT{Id: action.ActionId, Source: src})
+	}
+	return &es.ResultT{HitsT: es.HitsT{Hits: hits}}, nil
+}
+
+func (m *ackBulk) MCreate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.creates = append(m.creates, ops)
+
+	items := make([]bulk.BulkIndexerResponseItem, len(ops))
+	for i, op := range ops {
+		var acr model.ActionResult
+		if err := json.Unmarshal(op.Body, &acr); err != nil {
+			return nil, err
+		}
+		switch {
+		case m.failIds[acr.ActionId]:
+			items[i] = bulk.BulkIndexerResponseItem{
+				Status: http.StatusTooManyRequests,
+				Error:  &es.ErrorT{Type: "es_rejected_execution_exception", Reason: "rejected"},
+			}
+		case m.created[op.Id]:
+			items[i] = bulk.BulkIndexerResponseItem{
+				Status: http.StatusConflict,
+				Error:  &es.ErrorT{Type: "version_conflict_engine_exception", Reason: "document already exists"},
+			}
+		default:
+			if m.created == nil {
+				m.created = make(map[string]bool)
+			}
+			m.created[op.Id] = true
+			items[i] = bulk.BulkIndexerResponseItem{Status: http.StatusCreated}
+		}
+	}
+	return items, nil
+}
+
+func TestHandleAckEventsBulk(t *testing.T) {
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	bulker := &ackBulk{
+		actions: []model.Action{
+			{ActionId: "action-1", Type: "INPUT_ACTION"},
+			{ActionId: "action-2", Type: "INPUT_ACTION"},
+			{ActionId: "action-3", Type: "INPUT_ACTION"},
+		},
+		failIds: map[string]bool{"action-2": true},
+	}
+
+	ack := &AckT{bulk: bulker, cache: c}
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "agent-id"},
+		PolicyId:   "policy-id",
+	}
+
+	items, err := ack.handleAckEvents(context.Background(), log.Logger, agent, []Event{
+		{ActionId: "action-1", AgentId: "agent-id"},
+		{ActionId: "action-2", AgentId: "agent-id"},
+		{ActionId: "action-unknown", AgentId: "agent-id"},
+		{ActionId: "action-3", AgentId: "other-agent-id"},
+		{ActionId: "action-3"},
+		{ActionId: "action-1", Error: "failed"},
+	})
+	require.NoError(t, err)
+
+	// One search for all the actions, one bulk request for all the results
+	assert.Len(t, bulker.searches, 1)
+	require.Len(t, bulker.creates, 1)
+	assert.Len(t, bulker.creates[0], 4)
+
+	require.Len(t, items, 6)
+	assert.Equal(t, http.StatusOK, items[0].Status)
+	assert.Equal(t, http.StatusTooManyRequests, items[1].Status)
+	assert.Equal(t, http.StatusNotFound, items[2].Status)
+	assert.Equal(t, http.StatusBadRequest, items[3].Status)
+	assert.Equal(t, http.StatusOK, items[4].Status)
+	assert.Equal(t, http.StatusOK, items[5].Status)
+
+	resp := newAckResponse(items)
+	assert.True(t, resp.Errors)
+
+	resp = newAckResponse(items[:1])
+	assert.False(t, resp.Errors)
+}
+
+func TestHandleAckEventsDuplicate(t *testing.T) {
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	bulker := &ackBulk{
+		actions: []model.Action{{ActionId: "upgrade-action", Type: TypeUpgrade}},
+	}
+
+	ack := &AckT{bulk: bulker, cache: c}
+	agent := &model.Agent{
+		ESDocument: model.ESDocument{Id: "agent-id"},
+		Agent:      &model.AgentMetadata{Id: "agent-id", Version: "7.15.0"},
+	}
+	events := []Event{
+		{ActionId: "upgrade-action", AgentId: "agent-id"},
+		{ActionId: "upgrade-action", AgentId: "agent-id"},
+	}
+
+	items, err := ack.handleAckEvents(context.Background(), log.Logger, agent, events)
+	require.NoError(t, err)
+	assert.Equal(t, AckResponseItem{Status: http.StatusOK, Message: http.StatusText(http.StatusOK)}, items[0])
+	assert.Equal(t, AckResponseItem{Status: http.StatusOK, Message: kAckAlreadyAcked}, items[1])
+
+	// Retried ack
+	items, err = ack.handleAckEvents(context.Background(), log.Logger, agent, events[:1])
+	require.NoError(t, err)
+	assert.Equal(t, AckResponseItem{Status: http.StatusOK, Message: kAckAlreadyAcked}, items[0])
+
+	// Same document id for every ack of the action by the agent
+	require.Len(t, bulker.creates, 2)
+	assert.Equal(t, dl.ActionResultId("upgrade-action", "agent-id"), bulker.creates[0][0].Id)
+	assert.Equal(t, bulker.creates[0][0].Id, bulker.creates[1][0].Id)
+	assert.NotEqual(t, dl.ActionResultId("upgrade-action", "agent-id"), dl.ActionResultId("upgrade-action", "other-agent-id"))
+
+	// Upgrade handled once
+	assert.Equal(t, []string{"agent-id"}, bulker.updates)
+}
+
+func TestHandleAckEventsRetrySideEffect(t *testing.T) {
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	bulker := &ackBulk{
+		actions:     []model.Action{{ActionId: "upgrade-action", Type: TypeUpgrade}},
+		failUpdates: 1,
+	}
+
+	ack := &AckT{bulk: bulker, cache: c}
+	agent := &model.Agent{
+		ESDocument:       model.ESDocument{Id: "agent-id"},
+		Active:           true,
+		Agent:            &model.AgentMetadata{Id: "agent-id", Version: "7.15.0"},
+		UpgradeStartedAt: "2021-09-01T10:00:00Z",
+	}
+	events := []Event{{ActionId: "upgrade-action", AgentId: "agent-id"}}
+
+	// The result is written but the upgrade is not recorded
+	items, err := ack.handleAckEvents(context.Background(), log.Logger, agent, events)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, items[0].Status)
+
+	// The retried ack conflicts and completes the upgrade
+	items, err = ack.handleAckEvents(context.Background(), log.Logger, agent, events)
+	require.NoError(t, err)
+	assert.Equal(t, AckResponseItem{Status: http.StatusOK, Message: kAckAlreadyAcked}, items[0])
+	assert.Equal(t, []string{"agent-id", "agent-id"}, bulker.updates)
+
+	// Nothing left to complete once the upgrade is recorded
+	agent.UpgradeStartedAt = ""
+	_, err = ack.handleAckEvents(context.Background(), log.Logger, agent, events)
+	require.NoError(t, err)
+	assert.Len(t, bulker.updates, 2)
+}
+
+func TestHandleAckEventsNotifyFailedOnce(t *testing.T) {
+	var mut sync.Mutex
+	var received int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		received++
+		mut.Unlock()
+	}))
+	defer srv.Close()
+
+	var cfg config.Webhooks
+	cfg.InitDefaults()
+	cfg.Endpoints = []config.WebhookEndpoint{{Name: "paging", URL: srv.URL}}
+	wh, err := webhook.New(&cfg)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wh.Run(ctx)
+
+	c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+	require.NoError(t, err)
+
+	bulker := &ackBulk{actions: []model.Action{{ActionId: "input-action", Type: "INPUT_ACTION"}}}
+	ack := &AckT{bulk: bulker, cache: c, wh: wh}
+	agent := &model.Agent{ESDocument: model.ESDocument{Id: "agent-id"}, PolicyId: "policy-id"}
+	events := []Event{{ActionId: "input-action", AgentId: "agent-id", Error: "failed"}}
+
+	for i := 0; i < 3; i++ {
+		_, err = ack.handleAckEvents(ctx, log.Logger, agent, events)
+		require.NoError(t, err)
+	}
+
+	count := func() int {
+		mut.Lock()
+		defer mut.Unlock()
+		return received
+	}
+	require.Eventually(t, func() bool { return count() == 1 }, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, count())
+}
+
+func TestHandleAckEventsPolicyError(t *testing.T) {
+	bulker := &ackBulk{}
+	ack := &AckT{bulk: bulker}
+	agent := &model.Agent{
+		ESDocument:        model.ESDocument{Id: "agent-id"},
+		PolicyId:          "policy-error-id",
+		PolicyRevisionIdx: 1,
+	}
+	failed := cntPolicyApplyFailed.Get("policy-error-id")
+
+	items, err := ack.handleAckEvents(context.Background(), log.Logger, agent, []Event{
+		{ActionId: "policy:policy-error-id:2:1", AgentId: "agent-id", Error: "failed to apply policy", Timestamp: "2021-09-01T10:00:00Z"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, items[0].Status)
+	assert.Equal(t, failed+1, cntPolicyApplyFailed.Get("policy-error-id"))
+
+	require.Equal(t, []string{"agent-id"}, bulker.updates)
+	var doc struct {
+		Doc map[string]model.PolicyApplyError `json:"doc"`
+	}
+	require.NoError(t, json.Unmarshal(bulker.bodies[0], &doc))
+	assert.Equal(t, model.PolicyApplyError{
+		PolicyId:       "policy-error-id",
+		RevisionIdx:    2,
+		CoordinatorIdx: 1,
+		Error:          "failed to apply policy",
+		Timestamp:      "2021-09-01T10:00:00Z",
+	}, doc.Doc[dl.FieldLastPolicyApplyError])
+
+	// A later revision applied clears the error
+	items, err = ack.handleAckEvents(context.Background(), log.Logger, agent, []Event{
+		{ActionId: "policy:policy-error-id:3:1", AgentId: "agent-id"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, items[0].Status)
+	assert.Equal(t, failed+1, cntPolicyApplyFailed.Get("policy-error-id"))
+
+	require.Len(t, bulker.bodies, 2)
+	assert.Contains(t, string(bulker.bodies[1]), "perr.revision_idx <= params.rev")
+	assert.Contains(t, string(bulker.bodies[1]), "ctx._source.remove('"+dl.FieldLastPolicyApplyError+"')")
+}
@@ -11,8 +11,9 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"io"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
@@ -22,17 +23,30 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 	"github.com/elastic/fleet-server/v7/internal/pkg/throttle"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
 	defaultMaxParallel = 8           // TODO: configurable
 	defaultThrottleTTL = time.Minute // TODO: configurable
+
+	// How long a policy fetched for artifact authorization is reused
+	defaultPolicyCacheTTL = 30 * time.Second
+
+	// Bounds the shared fetch of a policy, which outlives the request that started it
+	defaultPolicyFetchTimeout = 30 * time.Second
+
+	// Artifacts are content addressed by sha2 in the url; safe to cache indefinitely.
+	// Marked private as the route requires agent authorization.
+	kArtifactCacheControl = "private, max-age=86400, immutable"
+	kArtifactContentType  = "application/octet-stream"
 )
 
 var (
@@ -40,16 +54,20 @@ var (
 	ErrorBadSha2      = errors.New("malformed sha256")
 	ErrorRecord       = errors.New("artifact record mismatch")
 	ErrorMismatchSha2 = errors.New("mismatched sha256")
+	ErrorForbidden    = errors.New("artifact not referenced by agent policy")
 )
 
 type ArtifactT struct {
 	bulker     bulk.Bulk
 	cache      cache.Cache
+	pm         policy.Monitor
 	esThrottle *throttle.Throttle
 	limit      *limit.Limiter
+	enc        *responseEncoder
+	policies   *policyCache
 }
 
-func NewArtifactT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *ArtifactT {
+func NewArtifactT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache, pm policy.Monitor) *ArtifactT {
 	log.Info().
 		Interface("limits", cfg.Limits.ArtifactLimit).
 		Int("maxParallel", defaultMaxParallel).
@@ -58,8 +76,11 @@ func NewArtifactT(cfg *config.Server, bulker bulk.Bulk, cache cache.Cache) *Arti
 	return &ArtifactT{
 		bulker:     bulker,
 		cache:      cache,
+		pm:         pm,
 		limit:      limit.NewLimiter(&cfg.Limits.ArtifactLimit),
 		esThrottle: throttle.NewThrottle(defaultMaxParallel),
+		enc:        newResponseEncoder(cfg),
+		policies:   newPolicyCache(defaultPolicyCacheTTL, defaultPolicyFetchTimeout),
 	}
 }
 
@@ -80,13 +101,14 @@ func (rt Router) handleArtifacts(w http.ResponseWriter, r *http.Request, ps http
 		Str("remoteAddr", r.RemoteAddr).
 		Logger()
 
-	rdr, err := rt.at.handleArtifacts(&zlog, r, id, sha2)
+	artifact, err := rt.at.handleArtifacts(&zlog, r, id, sha2)
 
 	var nWritten int64
 	if err == nil {
-		nWritten, err = io.Copy(w, rdr)
+		var statusCode int
+		nWritten, statusCode = writeArtifact(w, r, artifact, rt.at.enc, rt.at.cache)
 		zlog.Trace().
-			Err(err).
+			Int(EcsHttpResponseCode, statusCode).
 			Int64(EcsHttpResponseBodyBytes, nWritten).
 			Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
 			Msg("Response sent")
@@ -111,7 +133,93 @@ func (rt Router) handleArtifacts(w http.ResponseWriter, r *http.Request, ps http
 	}
 }
 
-func (at ArtifactT) handleArtifacts(zlog *zerolog.Logger, r *http.Request, id, sha2 string) (io.Reader, error) {
+// Write the artifact payload. Conditional (If-None-Match, If-Range) and ranged
+// requests are served directly off the cached payload; no refetch from Elastic.
+func writeArtifact(w http.ResponseWriter, r *http.Request, artifact *model.Artifact, enc *responseEncoder, c cache.Cache) (int64, int) {
+	hdr := w.Header()
+	hdr.Set("Content-Type", kArtifactContentType)
+	hdr.Set("Cache-Control", kArtifactCacheControl)
+
+	body, etag := encodeArtifact(hdr, r, artifact, enc, c)
+	hdr.Set("ETag", strconv.Quote(etag))
+
+	// Last-Modified is optional; If-Range falls back on the ETag when absent.
+	var modtime time.Time
+	if t, err := time.Parse(time.RFC3339, artifact.Created); err == nil {
+		modtime = t
+	}
+
+	// ServeContent handles the preconditions, Range and Content-Length.
+	aw := &artifactWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	http.ServeContent(aw, r, "", modtime, bytes.NewReader(body))
+
+	return aw.nWritten, aw.statusCode
+}
+
+// Encode the artifact body with the codec negotiated with the agent. The encoded body
+// is a distinct representation: it gets its own ETag and ranges apply to the encoded bytes.
+// Artifacts already compressed on upload are sent as is. The encoded bodies are cached
+// next to the artifact so that each artifact is compressed once per encoding.
+func encodeArtifact(hdr http.Header, r *http.Request, artifact *model.Artifact, enc *responseEncoder, c cache.Cache) ([]byte, string) {
+	if enc == nil || len(enc.codecs) == 0 || isCompressedArtifact(artifact) {
+		return artifact.Body, artifact.EncodedSha256
+	}
+
+	hdr.Add("Vary", "Accept-Encoding")
+
+	cd := enc.negotiate(r)
+	if cd == nil || len(artifact.Body) <= enc.thresh {
+		return artifact.Body, artifact.EncodedSha256
+	}
+
+	etag := artifact.EncodedSha256 + "-" + cd.name
+
+	if c != nil {
+		if body, ok := c.GetEncodedArtifact(artifact.Identifier, artifact.DecodedSha256, cd.name); ok {
+			hdr.Set("Content-Encoding", cd.name)
+			return body, etag
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := cd.encode(&buf, artifact.Body); err != nil {
+		log.Warn().Err(err).Str("artifact_id", artifact.Identifier).Msg("Fail encode artifact; send unencoded")
+		return artifact.Body, artifact.EncodedSha256
+	}
+
+	cd.stats.Observe(uint64(len(artifact.Body)), uint64(buf.Len()))
+	hdr.Set("Content-Encoding", cd.name)
+
+	if c != nil {
+		c.SetEncodedArtifact(artifact.Identifier, artifact.DecodedSha256, cd.name, buf.Bytes())
+	}
+
+	return buf.Bytes(), etag
+}
+
+func isCompressedArtifact(artifact *model.Artifact) bool {
+	return artifact.CompressionAlgorithm != "" && artifact.CompressionAlgorithm != "none"
+}
+
+// Track bytes written and status code on the artifact response
+type artifactWriter struct {
+	http.ResponseWriter
+	statusCode int
+	nWritten   int64
+}
+
+func (aw *artifactWriter) WriteHeader(statusCode int) {
+	aw.statusCode = statusCode
+	aw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (aw *artifactWriter) Write(p []byte) (int, error) {
+	n, err := aw.ResponseWriter.Write(p)
+	aw.nWritten += int64(n)
+	return n, err
+}
+
+func (at ArtifactT) handleArtifacts(zlog *zerolog.Logger, r *http.Request, id, sha2 string) (*model.Artifact, error) {
 	limitF, err := at.limit.Acquire()
 	if err != nil {
 		return nil, err
@@ -144,7 +252,7 @@ type artHandler struct {
 	c      cache.Cache
 }
 
-func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, id, sha2 string) (io.Reader, error) {
+func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, id, sha2 string) (*model.Artifact, error) {
 
 	// Input validation
 	if err := validateSha2String(sha2); err != nil {
@@ -152,7 +260,7 @@ func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, age
 	}
 
 	// Determine whether the agent should have access to this artifact
-	if err := at.authorizeArtifact(ctx, agent, id, sha2); err != nil {
+	if err := at.authorizeArtifact(ctx, zlog, agent, id, sha2); err != nil {
 		zlog.Warn().Err(err).Msg("Unauthorized GET on artifact")
 		return nil, err
 	}
@@ -182,22 +290,61 @@ func (at ArtifactT) processRequest(ctx context.Context, zlog zerolog.Logger, age
 		Str("created", artifact.Created).
 		Msg("Artifact GET")
 
-	// Write the payload
-	rdr := bytes.NewReader(artifact.Body)
-	return rdr, nil
+	return artifact, nil
 }
 
-// TODO: Pull the policy record for this agent and validate that the
-// requested artifact is assigned to this policy.  This will prevent
-// agents from retrieving artifacts that they do not have access to.
-// Note that this is racy, the policy could have changed to allow an
-// artifact before this instantiation of FleetServer has its local
-// copy updated.  Take the race conditions into consideration.
-//
-// Initial implementation is dependent on security by obscurity; ie.
-// it should be difficult for an attacker to guess a guid.
-func (at ArtifactT) authorizeArtifact(ctx context.Context, agent *model.Agent, ident, sha2 string) error {
-	return nil // TODO
+// Validate that the requested artifact is referenced by the inputs on the agent's policy.
+// The local copy of the policy held by the policy monitor may lag behind the policies
+// index; ie. the policy could have changed to allow an artifact before this instance
+// of FleetServer has seen the update.  If the local copy does not authorize the artifact,
+// fall back to the latest revision of the policy in Elastic before refusing the request.
+func (at ArtifactT) authorizeArtifact(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, ident, sha2 string) error {
+	if agent.PolicyId == "" {
+		return ErrorForbidden
+	}
+
+	if pp, ok := at.pm.LatestPolicy(agent.PolicyId); ok && pp.HasArtifact(ident, sha2) {
+		return nil
+	}
+
+	pp, err := at.fetchPolicy(ctx, zlog, agent.PolicyId)
+	if errors.Is(err, dl.ErrNotFound) {
+		return ErrorForbidden
+	} else if err != nil {
+		return err
+	}
+
+	if !pp.HasArtifact(ident, sha2) {
+		return ErrorForbidden
+	}
+
+	return nil
+}
+
+// Fetch the latest revision of the policy from Elastic. The policy is cached for a short
+// time and concurrent requests for the same policy share one search, so that agents
+// with a policy unknown to the monitor do not search Elastic on every artifact request.
+func (at ArtifactT) fetchPolicy(ctx context.Context, zlog zerolog.Logger, policyId string) (*policy.ParsedPolicy, error) {
+	return at.policies.get(ctx, policyId, func(fetchCtx context.Context) (*policy.ParsedPolicy, error) {
+		return at.searchPolicy(fetchCtx, zlog, policyId)
+	})
+}
+
+func (at ArtifactT) searchPolicy(ctx context.Context, zlog zerolog.Logger, policyId string) (*policy.ParsedPolicy, error) {
+	start := time.Now()
+	p, err := dl.FindLatestPolicy(ctx, at.bulker, policyId)
+
+	zlog.Debug().
+		Err(err).
+		Str(LogPolicyId, policyId).
+		Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+		Msg("fetch policy for artifact authorization")
+
+	if err != nil {
+		return nil, errors.Wrap(err, "fetchPolicy")
+	}
+
+	return policy.NewParsedPolicy(p)
 }
 
 // Return artifact from cache by sha2 or fetch directly from Elastic.
@@ -297,3 +444,82 @@ func validateSha2Data(data []byte, sha2 string) error {
 
 	return nil
 }
+
+type policyCacheEntry struct {
+	pp      *policy.ParsedPolicy
+	err     error
+	expires time.Time
+}
+
+// Short lived cache of the policies fetched for artifact authorization.
+// Policies not found are cached as well.
+type policyCache struct {
+	ttl     time.Duration
+	timeout time.Duration
+	group   singleflight.Group
+
+	mut     sync.Mutex
+	entries map[string]policyCacheEntry
+}
+
+func newPolicyCache(ttl, timeout time.Duration) *policyCache {
+	return &policyCache{
+		ttl:     ttl,
+		timeout: timeout,
+		entries: make(map[string]policyCacheEntry),
+	}
+}
+
+// Return the cached policy or fetch it.  The fetch is shared by all concurrent callers,
+// so it runs detached from the caller's context; a caller that goes away stops waiting
+// without failing the others.
+func (pc *policyCache) get(ctx context.Context, policyId string, fetchF func(context.Context) (*policy.ParsedPolicy, error)) (*policy.ParsedPolicy, error) {
+	now := time.Now()
+
+	pc.mut.Lock()
+	entry, ok := pc.entries[policyId]
+	if ok && now.After(entry.expires) {
+		delete(pc.entries, policyId)
+		ok = false
+	}
+	pc.mut.Unlock()
+
+	if ok {
+		return entry.pp, entry.err
+	}
+
+	ch := pc.group.DoChan(policyId, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+		defer cancel()
+
+		pp, err := fetchF(fetchCtx)
+		if err == nil || errors.Is(err, dl.ErrNotFound) {
+			pc.put(policyId, policyCacheEntry{pp: pp, err: err, expires: time.Now().Add(pc.ttl)})
+		}
+		return pp, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		pp, _ := res.Val.(*policy.ParsedPolicy)
+		return pp, res.Err
+	}
+}
+
+// Insert the entry, evicting the expired ones so that the cache does not grow with
+// every policy ever fetched.
+func (pc *policyCache) put(policyId string, entry policyCacheEntry) {
+	now := time.Now()
+
+	pc.mut.Lock()
+	defer pc.mut.Unlock()
+
+	for id, e := range pc.entries {
+		if now.After(e.expires) {
+			delete(pc.entries, id)
+		}
+	}
+	pc.entries[policyId] = entry
+}
@@ -0,0 +1,230 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package fleet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+)
+
+func TestWriteArtifact(t *testing.T) {
+	artifact := &model.Artifact{
+		Identifier:    "endpoint-trustlist-windows-v1",
+		Body:          []byte("0123456789"),
+		Created:       "2021-06-01T00:00:00Z",
+		EncodedSha256: "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882",
+	}
+	etag := strconv.Quote(artifact.EncodedSha256)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		status   int
+		body     string
+		hdrRange string
+	}{
+		{
+			name:   "full",
+			status: http.StatusOK,
+			body:   "0123456789",
+		},
+		{
+			name:    "if-none-match",
+			headers: map[string]string{"If-None-Match": etag},
+			status:  http.StatusNotModified,
+		},
+		{
+			name:    "if-none-match stale",
+			headers: map[string]string{"If-None-Match": `"bogus"`},
+			status:  http.StatusOK,
+			body:    "0123456789",
+		},
+		{
+			name:     "range",
+			headers:  map[string]string{"Range": "bytes=2-5"},
+			status:   http.StatusPartialContent,
+			body:     "2345",
+			hdrRange: "bytes 2-5/10",
+		},
+		{
+			name:     "if-range match",
+			headers:  map[string]string{"Range": "bytes=6-", "If-Range": etag},
+			status:   http.StatusPartialContent,
+			body:     "6789",
+			hdrRange: "bytes 6-9/10",
+		},
+		{
+			name:    "if-range mismatch",
+			headers: map[string]string{"Range": "bytes=6-", "If-Range": `"bogus"`},
+			status:  http.StatusOK,
+			body:    "0123456789",
+		},
+		{
+			name:     "range not satisfiable",
+			headers:  map[string]string{"Range": "bytes=20-"},
+			status:   http.StatusRequestedRangeNotSatisfiable,
+			hdrRange: "bytes */10",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/fleet/artifacts/id/sha2", nil)
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			nWritten, status := writeArtifact(w, r, artifact, nil, nil)
+
+			assert.Equal(t, tc.status, status)
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+			assert.Equal(t, kArtifactCacheControl, w.Header().Get("Cache-Control"))
+			if tc.body != "" {
+				assert.Equal(t, tc.body, w.Body.String())
+				assert.Equal(t, int64(len(tc.body)), nWritten)
+				assert.Equal(t, strconv.Itoa(len(tc.body)), w.Header().Get("Content-Length"))
+				assert.Equal(t, kArtifactContentType, w.Header().Get("Content-Type"))
+			}
+			assert.Equal(t, tc.hdrRange, w.Header().Get("Content-Range"))
+		})
+	}
+}
+
+func TestPolicyCache(t *testing.T) {
+	pc := newPolicyCache(time.Hour, time.Second)
+
+	var fetches int32
+	release := make(chan struct{})
+	fetchF := func(context.Context) (*policy.ParsedPolicy, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return &policy.ParsedPolicy{}, nil
+	}
+
+	// Concurrent readers of the same policy share one fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pp, err := pc.get(context.Background(), "policy-id", fetchF)
+			assert.NoError(t, err)
+			assert.NotNil(t, pp)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Cached
+	_, err := pc.get(context.Background(), "policy-id", fetchF)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Not found is cached, other errors are not
+	notFound := func(context.Context) (*policy.ParsedPolicy, error) {
+		atomic.AddInt32(&fetches, 1)
+		return nil, dl.ErrNotFound
+	}
+	_, err = pc.get(context.Background(), "missing-id", notFound)
+	assert.ErrorIs(t, err, dl.ErrNotFound)
+	_, err = pc.get(context.Background(), "missing-id", notFound)
+	assert.ErrorIs(t, err, dl.ErrNotFound)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	failed := func(context.Context) (*policy.ParsedPolicy, error) {
+		atomic.AddInt32(&fetches, 1)
+		return nil, errors.New("search failed")
+	}
+	_, err = pc.get(context.Background(), "failed-id", failed)
+	assert.Error(t, err)
+	_, err = pc.get(context.Background(), "failed-id", failed)
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+}
+
+func TestPolicyCacheExpires(t *testing.T) {
+	pc := newPolicyCache(time.Millisecond, time.Second)
+
+	var fetches int
+	fetchF := func(context.Context) (*policy.ParsedPolicy, error) {
+		fetches++
+		return &policy.ParsedPolicy{}, nil
+	}
+
+	_, err := pc.get(context.Background(), "policy-id", fetchF)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = pc.get(context.Background(), "policy-id", fetchF)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// Expired entries of other policies are evicted on insert
+	_, err = pc.get(context.Background(), "other-id", fetchF)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = pc.get(context.Background(), "policy-id", fetchF)
+	require.NoError(t, err)
+	pc.mut.Lock()
+	assert.Len(t, pc.entries, 1)
+	pc.mut.Unlock()
+}
+
+func TestPolicyCacheDetachedFetch(t *testing.T) {
+	pc := newPolicyCache(time.Hour, time.Second)
+
+	release := make(chan struct{})
+	fetchF := func(ctx context.Context) (*policy.ParsedPolicy, error) {
+		select {
+		case <-release:
+			return &policy.ParsedPolicy{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The caller that started the fetch goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := pc.get(ctx, "policy-id", fetchF)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	waiter := make(chan error)
+	go func() {
+		_, err := pc.get(context.Background(), "policy-id", fetchF)
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// The shared fetch carries on for the other caller
+	close(release)
+	assert.NoError(t, <-waiter)
+}
@@ -6,8 +6,6 @@ package fleet
 
 import (
 	"bytes"
-	"compress/flate"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -23,6 +21,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
@@ -33,7 +32,6 @@ import (
 
 	"github.com/hashicorp/go-version"
 	"github.com/julienschmidt/httprouter"
-	"github.com/miolini/datacounter"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -46,9 +44,8 @@ var (
 	ErrFailInjectApiKey = errors.New("fail inject api key")
 )
 
-const (
-	kEncodingGzip = "gzip"
-)
+// Error of the result recorded for the actions expired before delivery
+const kActionExpired = "expired"
 
 func (rt Router) handleCheckin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	start := time.Now()
@@ -91,12 +88,17 @@ type CheckinT struct {
 	cfg    *config.Server
 	cache  cache.Cache
 	bc     *checkin.Bulk
+	ev     *checkin.Events
+	as     *action.StatusBulk
 	pm     policy.Monitor
 	gcp    monitor.GlobalCheckpointProvider
 	ad     *action.Dispatcher
 	tr     *action.TokenResolver
 	bulker bulk.Bulk
 	limit  *limit.Limiter
+	enc    *responseEncoder
+
+	streamLimit *limit.Limiter
 }
 
 func NewCheckinT(
@@ -104,6 +106,8 @@ func NewCheckinT(
 	cfg *config.Server,
 	c cache.Cache,
 	bc *checkin.Bulk,
+	ev *checkin.Events,
+	as *action.StatusBulk,
 	pm policy.Monitor,
 	gcp monitor.GlobalCheckpointProvider,
 	ad *action.Dispatcher,
@@ -113,6 +117,7 @@ func NewCheckinT(
 
 	log.Info().
 		Interface("limits", cfg.Limits.CheckinLimit).
+		Interface("stream_limits", cfg.Limits.StreamLimit).
 		Dur("long_poll_timeout", cfg.Timeouts.CheckinLongPoll).
 		Dur("long_poll_timestamp", cfg.Timeouts.CheckinTimestamp).
 		Dur("long_poll_jitter", cfg.Timeouts.CheckinJitter).
@@ -123,12 +128,17 @@ func NewCheckinT(
 		cfg:    cfg,
 		cache:  c,
 		bc:     bc,
+		ev:     ev,
+		as:     as,
 		pm:     pm,
 		gcp:    gcp,
 		ad:     ad,
 		tr:     tr,
 		limit:  limit.NewLimiter(&cfg.Limits.CheckinLimit),
 		bulker: bulker,
+		enc:    newResponseEncoder(cfg),
+
+		streamLimit: limit.NewLimiter(&cfg.Limits.StreamLimit),
 	}
 
 	return ct
@@ -174,33 +184,46 @@ func (ct *CheckinT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 
 	ctx := r.Context()
 
-	body := r.Body
-
-	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
-	if ct.cfg.Limits.CheckinLimit.MaxBody > 0 {
-		body = http.MaxBytesReader(w, body, ct.cfg.Limits.CheckinLimit.MaxBody)
+	body, err := newRequestBody(w, r, &ct.cfg.Limits.CheckinLimit)
+	if err != nil {
+		return err
 	}
-
-	readCounter := datacounter.NewReaderCounter(body)
+	defer body.Close()
 
 	var req CheckinRequest
-	decoder := json.NewDecoder(readCounter)
+	decoder := json.NewDecoder(body)
 	if err := decoder.Decode(&req); err != nil {
 		return errors.Wrap(err, "decode checkin request")
 	}
 
-	cntCheckin.bodyIn.Add(readCounter.Count())
+	cntCheckin.AddBodyIn(body)
 
-	// Compare local_metadata content and update if different
-	rawMeta, err := parseMeta(zlog, agent, &req)
+	resp, err := ct.longPoll(ctx, zlog, start, agent, ver, &req)
 	if err != nil {
 		return err
 	}
 
+	return ct.writeResponse(zlog, w, r, *resp)
+}
+
+// Long poll for the actions of the agent once the checkin request is authenticated and decoded.
+func (ct *CheckinT) longPoll(ctx context.Context, zlog zerolog.Logger, start time.Time, agent *model.Agent, ver string, req *CheckinRequest) (*CheckinResponse, error) {
+
+	// Queue the reported events for persistence; does not block
+	if len(req.Events) > 0 {
+		ct.recordEvents(zlog, agent, req.Events)
+	}
+
+	// Compare local_metadata content and update if different
+	rawMeta, err := parseMeta(zlog, agent, req)
+	if err != nil {
+		return nil, err
+	}
+
 	// Resolve AckToken from request, fallback on the agent record
-	seqno, err := ct.resolveSeqNo(ctx, zlog, req, agent)
+	seqno, err := ct.resolveSeqNo(ctx, zlog, *req, agent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Subscribe to actions dispatcher
@@ -211,7 +234,7 @@ func (ct *CheckinT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 	// Subscribe to policy manager for changes on PolicyId > policyRev
 	sub, err := ct.pm.Subscribe(agent.Id, agent.PolicyId, agent.PolicyRevisionIdx, agent.PolicyCoordinatorIdx)
 	if err != nil {
-		return errors.Wrap(err, "subscribe policy monitor")
+		return nil, errors.Wrap(err, "subscribe policy monitor")
 	}
 	defer ct.pm.Unsubscribe(sub)
 
@@ -228,13 +251,15 @@ func (ct *CheckinT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 		Dur("setupDuration", setupDuration).
 		Dur("jitter", jitter).
 		Dur("pollDuration", pollDuration).
-		Uint64("bodyCount", readCounter.Count()).
 		Msg("checkin start long poll")
 
 	// Chill out for for a bit. Long poll.
 	longPoll := time.NewTicker(pollDuration)
 	defer longPoll.Stop()
 
+	// Baseline for status transitions, in case this server has not seen the agent yet
+	ct.bc.Observe(agent.Id, agent.PolicyId, agent.LastCheckinStatus, agent.PolicyRevisionIdx)
+
 	// Intial update on checkin, and any user fields that might have changed
 	ct.bc.CheckIn(agent.Id, req.Status, rawMeta, seqno, ver)
 
@@ -247,25 +272,30 @@ func (ct *CheckinT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 	// Check agent pending actions first
 	pendingActions, err := ct.fetchAgentPendingActions(ctx, seqno, agent.Id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	actions, ackToken = convertActions(agent.Id, pendingActions)
+	actions, ackToken = ct.deliverActions(ctx, zlog, agent.Id, pendingActions)
 
 	if len(actions) == 0 {
 	LOOP:
 		for {
 			select {
 			case <-ctx.Done():
-				return ctx.Err()
+				return nil, ctx.Err()
 			case acdocs := <-actCh:
-				var acs []ActionResp
-				acs, ackToken = convertActions(agent.Id, acdocs)
+				acs, token := ct.deliverActions(ctx, zlog, agent.Id, acdocs)
+				if token != "" {
+					ackToken = token
+				}
+				if len(acs) == 0 {
+					continue
+				}
 				actions = append(actions, acs...)
 				break LOOP
 			case policy := <-sub.Output():
 				actionResp, err := processPolicy(ctx, zlog, ct.bulker, agent.Id, policy)
 				if err != nil {
-					return errors.Wrap(err, "processPolicy")
+					return nil, errors.Wrap(err, "processPolicy")
 				}
 				actions = append(actions, *actionResp)
 				break LOOP
@@ -289,13 +319,11 @@ func (ct *CheckinT) processRequest(zlog zerolog.Logger, w http.ResponseWriter, r
 			Msg("Action delivered to agent on checkin")
 	}
 
-	resp := CheckinResponse{
+	return &CheckinResponse{
 		AckToken: ackToken,
 		Action:   "checkin",
 		Actions:  actions,
-	}
-
-	return ct.writeResponse(zlog, w, r, resp)
+	}, nil
 }
 
 func (ct *CheckinT) writeResponse(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, resp CheckinResponse) error {
@@ -305,56 +333,10 @@ func (ct *CheckinT) writeResponse(zlog zerolog.Logger, w http.ResponseWriter, r
 		return errors.Wrap(err, "writeResponse marshal")
 	}
 
-	compressionLevel := ct.cfg.CompressionLevel
-	compressThreshold := ct.cfg.CompressionThresh
-
-	if len(payload) > compressThreshold && compressionLevel != flate.NoCompression && acceptsEncoding(r, kEncodingGzip) {
-
-		wrCounter := datacounter.NewWriterCounter(w)
-
-		zipper, err := gzip.NewWriterLevel(wrCounter, compressionLevel)
-		if err != nil {
-			return errors.Wrap(err, "writeResponse new gzip")
-		}
-
-		w.Header().Set("Content-Encoding", kEncodingGzip)
-
-		if _, err = zipper.Write(payload); err != nil {
-			return errors.Wrap(err, "writeResponse gzip write")
-		}
-
-		if err = zipper.Close(); err != nil {
-			err = errors.Wrap(err, "writeResponse gzip close")
-		}
-
-		cntCheckin.bodyOut.Add(wrCounter.Count())
+	nWritten, err := ct.enc.write(zlog, w, r, payload)
+	cntCheckin.bodyOut.Add(nWritten)
 
-		zlog.Trace().
-			Err(err).
-			Int("lvl", compressionLevel).
-			Int("srcSz", len(payload)).
-			Uint64("dstSz", wrCounter.Count()).
-			Msg("compressing checkin response")
-	} else {
-		var nWritten int
-		nWritten, err = w.Write(payload)
-		cntCheckin.bodyOut.Add(uint64(nWritten))
-
-		if err != nil {
-			err = errors.Wrap(err, "writeResponse payload")
-		}
-	}
-
-	return err
-}
-
-func acceptsEncoding(r *http.Request, encoding string) bool {
-	for _, v := range r.Header.Values("Accept-Encoding") {
-		if v == encoding {
-			return true
-		}
-	}
-	return false
+	return errors.Wrap(err, "writeResponse payload")
 }
 
 // Resolve AckToken from request, fallback on the agent record
@@ -388,14 +370,86 @@ func (ct *CheckinT) fetchAgentPendingActions(ctx context.Context, seqno sqn.SeqN
 		return nil, errors.Wrap(err, "fetchAgentPendingActions")
 	}
 
-	return actions, err
+	// Actions scheduled past the rollout slot of the agent are dispatched once due
+	ready, held, _ := action.SplitHeld(agentId, actions, time.Now())
+	if len(held) > 0 {
+		ct.ad.Hold(agentId, held)
+	}
+
+	return ready, err
 }
 
-func convertActions(agentId string, actions []model.Action) ([]ActionResp, string) {
-	var ackToken string
-	sz := len(actions)
+// Convert the actions sent to the agent and count their delivery.
+// Expired actions are not sent; their result is recorded as expired for the agent.
+// The ack token is empty if it does not move.
+func (ct *CheckinT) deliverActions(ctx context.Context, zlog zerolog.Logger, agentId string, actions []model.Action) ([]ActionResp, string) {
+	actions, ackToken := ct.ad.Deliver(agentId, actions)
+
+	live, expired := splitExpiredActions(actions, time.Now())
+	if len(expired) > 0 {
+		ct.recordExpiredActions(ctx, zlog, agentId, expired)
+	}
+	ct.as.Delivered(live...)
+
+	resp, _ := convertActions(agentId, live)
+	return resp, ackToken
+}
+
+// Write the expired result of the actions for the agent. Failures are logged and dropped,
+// the agent does not retry expired actions.
+func (ct *CheckinT) recordExpiredActions(ctx context.Context, zlog zerolog.Logger, agentId string, actions []model.Action) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	acrs := make([]model.ActionResult, len(actions))
+	for i, action := range actions {
+		acrs[i] = model.ActionResult{
+			ESDocument:  model.ESDocument{Id: dl.ExpiredActionResultId(action.ActionId, agentId)},
+			ActionId:    action.ActionId,
+			AgentId:     agentId,
+			CompletedAt: now,
+			Error:       kActionExpired,
+		}
+	}
+
+	items, err := dl.CreateActionResults(ctx, ct.bulker, acrs)
+
+	var failed int
+	for _, item := range items {
+		// Expired on a previous delivery
+		if item.Error != nil && !errors.Is(es.TranslateError(item.Status, item.Error), es.ErrElasticVersionConflict) {
+			failed++
+		}
+	}
+
+	zlog.Debug().
+		Err(err).
+		Int("cnt", len(acrs)).
+		Int("failed", failed).
+		Msg("record expired actions")
+}
+
+// Split the actions sent to the agent from those expired at the time of delivery
+func splitExpiredActions(actions []model.Action, now time.Time) (live, expired []model.Action) {
+	for _, a := range actions {
+		if action.Expired(a, now) {
+			expired = append(expired, a)
+		} else {
+			live = append(live, a)
+		}
+	}
+	return live, expired
+}
+
+// The ack token of the last action
+func lastActionToken(actions []model.Action) string {
+	if sz := len(actions); sz > 0 {
+		return actions[sz-1].Id
+	}
+	return ""
+}
 
-	respList := make([]ActionResp, 0, sz)
+func convertActions(agentId string, actions []model.Action) ([]ActionResp, string) {
+	respList := make([]ActionResp, 0, len(actions))
 	for _, action := range actions {
 		respList = append(respList, ActionResp{
 			AgentId:   agentId,
@@ -408,11 +462,64 @@ func convertActions(agentId string, actions []model.Action) ([]ActionResp, strin
 		})
 	}
 
-	if sz > 0 {
-		ackToken = actions[sz-1].Id
+	return respList, lastActionToken(actions)
+}
+
+// Enrich the events reported by the agent and queue them for the agent events data stream.
+// Events beyond the per checkin limit, oversize events and events that do not fit
+// in the queue are dropped.
+func (ct *CheckinT) recordEvents(zlog zerolog.Logger, agent *model.Agent, events []Event) {
+	cfg := &ct.cfg.Events
+	if ct.ev == nil || !cfg.Enabled {
+		return
+	}
+
+	dropped := 0
+	if cfg.MaxPerCheckin > 0 && len(events) > cfg.MaxPerCheckin {
+		dropped = len(events) - cfg.MaxPerCheckin
+		events = events[:cfg.MaxPerCheckin]
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	docs := make([][]byte, 0, len(events))
+	for _, event := range events {
+		doc := EventDoc{
+			Event:             event,
+			Timestamp:         event.Timestamp,
+			PolicyRevisionIdx: agent.PolicyRevisionIdx,
+		}
+		doc.AgentId = agent.Id
+		doc.PolicyId = agent.PolicyId
+		if _, err := time.Parse(time.RFC3339Nano, doc.Timestamp); err != nil {
+			doc.Timestamp = now
+		}
+
+		body, err := json.Marshal(doc)
+		if err != nil {
+			zlog.Debug().Err(err).Msg("fail marshal agent event")
+			dropped++
+			continue
+		}
+		if cfg.MaxSize > 0 && len(body) > cfg.MaxSize {
+			cntCheckin.eventsOversize.Inc()
+			continue
+		}
+		docs = append(docs, body)
 	}
 
-	return respList, ackToken
+	queued := ct.ev.Add(docs...)
+	dropped += len(docs) - queued
+
+	cntCheckin.eventsIn.Add(uint64(queued))
+	cntCheckin.eventsDropped.Add(uint64(dropped))
+
+	if dropped > 0 {
+		zlog.Debug().
+			Int("queued", queued).
+			Int("dropped", dropped).
+			Msg("agent events dropped")
+	}
 }
 
 // A new policy exists for this agent.  Perform the following:
@@ -499,15 +606,26 @@ func processPolicy(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, a
 		agent.DefaultApiKey = defaultOutputApiKey.Agent()
 	}
 
-	rewrittenPolicy, err := rewritePolicy(pp, agent.DefaultApiKey)
+	resp, err := newPolicyChangeAction(agent.Id, pp, agent.DefaultApiKey)
 	if err != nil {
 		zlog.Error().Err(err).Msg("fail rewrite policy")
 		return nil, err
 	}
 
+	return resp, nil
+}
+
+// Build the POLICY_CHANGE action that delivers the policy to the agent
+// with the default output api key injected.
+func newPolicyChangeAction(agentId string, pp *policy.ParsedPolicy, apiKey string) (*ActionResp, error) {
+	rewrittenPolicy, err := rewritePolicy(pp, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
 	r := policy.RevisionFromPolicy(pp.Policy)
 	resp := ActionResp{
-		AgentId:   agent.Id,
+		AgentId:   agentId,
 		CreatedAt: pp.Policy.Timestamp,
 		Data:      rewrittenPolicy,
 		Id:        r.String(),
@@ -5,11 +5,23 @@
 package fleet
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/action"
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertActionsEmpty(t *testing.T) {
@@ -34,3 +46,160 @@ func TestConvertActions(t *testing.T) {
 	})
 	assert.Equal(t, token, "")
 }
+
+func TestDeliverActionsExpired(t *testing.T) {
+	mockBulk := &eventsBulk{}
+	ct := &CheckinT{bulker: mockBulk, ad: action.NewDispatcher(nil)}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	actions := []model.Action{
+		{ESDocument: model.ESDocument{Id: "doc-1"}, ActionId: "expired", Expiration: past},
+		{ESDocument: model.ESDocument{Id: "doc-2"}, ActionId: "live"},
+		{ESDocument: model.ESDocument{Id: "doc-3"}, ActionId: "expired-last", Expiration: past},
+	}
+	resp, token := ct.deliverActions(context.Background(), log.Logger, "agent-id", actions)
+	require.Len(t, resp, 1)
+	assert.Equal(t, "live", resp[0].Id)
+	assert.Equal(t, "doc-3", token)
+
+	docs := mockBulk.flushed()
+	require.Len(t, docs, 2)
+	for i, actionId := range []string{"expired", "expired-last"} {
+		var acr model.ActionResult
+		require.NoError(t, json.Unmarshal(docs[i], &acr))
+		assert.Equal(t, actionId, acr.ActionId)
+		assert.Equal(t, "agent-id", acr.AgentId)
+		assert.Equal(t, kActionExpired, acr.Error)
+		assert.Equal(t, dl.ExpiredActionResultId(actionId, "agent-id"), mockBulk.ids[i])
+		assert.NotEqual(t, dl.ActionResultId(actionId, "agent-id"), mockBulk.ids[i])
+	}
+
+	// Nothing to record when all actions are live
+	_, token = ct.deliverActions(context.Background(), log.Logger, "agent-id", actions[1:2])
+	assert.Equal(t, "doc-2", token)
+	assert.Len(t, mockBulk.flushed(), 2)
+}
+
+func TestDeliverActionsHeld(t *testing.T) {
+	ad := action.NewDispatcher(nil)
+	sub := ad.Subscribe("agent-id", nil)
+	defer ad.Unsubscribe(sub)
+
+	ct := &CheckinT{bulker: &eventsBulk{}, ad: ad}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	ad.Hold("agent-id", []model.Action{
+		{ESDocument: model.ESDocument{Id: "doc-2", SeqNo: 2}, ActionId: "upgrade", StartTime: future},
+	})
+
+	// The actions around the held one are delivered, the token stays below it
+	actions := []model.Action{
+		{ESDocument: model.ESDocument{Id: "doc-1", SeqNo: 1}, ActionId: "policy-change"},
+		{ESDocument: model.ESDocument{Id: "doc-3", SeqNo: 3}, ActionId: "unenroll"},
+	}
+	resp, token := ct.deliverActions(context.Background(), log.Logger, "agent-id", actions)
+	require.Len(t, resp, 2)
+	assert.Equal(t, "policy-change", resp[0].Id)
+	assert.Equal(t, "unenroll", resp[1].Id)
+	assert.Equal(t, "doc-1", token)
+
+	// Fetched again on the next checkin, not sent again
+	resp, token = ct.deliverActions(context.Background(), log.Logger, "agent-id", actions[1:])
+	assert.Empty(t, resp)
+	assert.Equal(t, "", token)
+}
+
+type eventsBulk struct {
+	ftesting.MockBulk
+
+	mut  sync.Mutex
+	ids  []string
+	docs [][]byte
+}
+
+func (m *eventsBulk) MCreate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for _, op := range ops {
+		m.ids = append(m.ids, op.Id)
+		m.docs = append(m.docs, op.Body)
+	}
+	return make([]bulk.BulkIndexerResponseItem, len(ops)), nil
+}
+
+func (m *eventsBulk) flushed() [][]byte {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.docs
+}
+
+func TestRecordEvents(t *testing.T) {
+	mockBulk := &eventsBulk{}
+	ev := checkin.NewEvents(mockBulk, 16, 10*time.Millisecond)
+
+	ct := &CheckinT{
+		cfg: &config.Server{
+			Events: config.Events{
+				Enabled:       true,
+				MaxPerCheckin: 3,
+				MaxSize:       512,
+			},
+		},
+		ev: ev,
+	}
+
+	agent := &model.Agent{
+		ESDocument:        model.ESDocument{Id: "agent-id"},
+		PolicyId:          "policy-id",
+		PolicyRevisionIdx: 4,
+	}
+
+	events := []Event{
+		{Type: "STATE", SubType: "RUNNING", Timestamp: "2021-09-01T10:00:00.123Z", Message: "running"},
+		{Type: "STATE", SubType: "FAILED", Timestamp: "bogus", Message: "failed"},
+		{Type: "ERROR", Message: strings.Repeat("x", 1024)},
+		{Type: "STATE", Message: "over the limit"},
+	}
+	ct.recordEvents(log.Logger, agent, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ev.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		return len(mockBulk.flushed()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var docs []EventDoc
+	for _, body := range mockBulk.flushed() {
+		var doc EventDoc
+		require.NoError(t, json.Unmarshal(body, &doc))
+		docs = append(docs, doc)
+	}
+
+	for _, doc := range docs {
+		assert.Equal(t, "agent-id", doc.AgentId)
+		assert.Equal(t, "policy-id", doc.PolicyId)
+		assert.Equal(t, int64(4), doc.PolicyRevisionIdx)
+		_, err := time.Parse(time.RFC3339Nano, doc.Timestamp)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "running", docs[0].Message)
+	assert.Equal(t, "2021-09-01T10:00:00.123Z", docs[0].Timestamp)
+	assert.Equal(t, "failed", docs[1].Message)
+	assert.NotEqual(t, "bogus", docs[1].Timestamp)
+}
+
+func TestRecordEventsDisabled(t *testing.T) {
+	mockBulk := &eventsBulk{}
+	ev := checkin.NewEvents(mockBulk, 1, time.Second)
+
+	ct := &CheckinT{
+		cfg: &config.Server{Events: config.Events{Enabled: false}},
+		ev:  ev,
+	}
+	ct.recordEvents(log.Logger, &model.Agent{}, []Event{{Type: "STATE"}})
+
+	// Nothing was queued so the single slot is still available
+	assert.Equal(t, 1, ev.Add([]byte(`{}`)))
+}
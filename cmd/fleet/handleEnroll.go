@@ -6,27 +6,33 @@ package fleet
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/elastic/fleet-server/v7/internal/pkg/admission"
 	"github.com/elastic/fleet-server/v7/internal/pkg/apikey"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
 	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
 
 	"github.com/gofrs/uuid"
 	"github.com/hashicorp/go-version"
 	"github.com/julienschmidt/httprouter"
-	"github.com/miolini/datacounter"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -35,6 +41,16 @@ import (
 const (
 	kEnrollMod = "enroll"
 
+	kEnrollQuotaRetryOnConflict = 3
+
+	kMaxEnrollTags   = 64
+	kMaxEnrollTagLen = 128
+
+	kIdempotencyKeyHeader = "Idempotency-Key"
+	kMaxIdempotencyKeyLen = 256
+
+	unenrolledReasonReplaced = "replaced" // reason agent was unenrolled
+
 	EnrollEphemeral = "EPHEMERAL"
 	EnrollPermanent = "PERMANENT"
 	EnrollTemporary = "TEMPORARY"
@@ -43,28 +59,45 @@ const (
 var (
 	ErrUnknownEnrollType     = errors.New("unknown enroll request type")
 	ErrInactiveEnrollmentKey = errors.New("inactive enrollment key")
+	ErrExpiredEnrollmentKey  = errors.New("expired enrollment key")
+	ErrEnrollmentQuota       = errors.New("enrollment key quota exceeded")
+	ErrInvalidUserMeta       = errors.New("user provided metadata must be an object")
+	ErrInvalidTags           = errors.New("invalid tags")
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+	ErrSharedIdConflict      = errors.New("shared id in use by another agent")
+	ErrIdempotencyConflict   = errors.New("idempotency key reused with a different request")
 )
 
 type EnrollerT struct {
-	verCon version.Constraints
-	cfg    *config.Server
-	bulker bulk.Bulk
-	cache  cache.Cache
-	limit  *limit.Limiter
+	verCon   version.Constraints
+	cfg      *config.Server
+	bulker   bulk.Bulk
+	cache    cache.Cache
+	pm       policy.Monitor
+	limit    *limit.Limiter
+	admit    *admission.Admission
+	selector *policy.Selector
+	wh       *webhook.Dispatcher
+	enc      *responseEncoder
 }
 
-func NewEnrollerT(verCon version.Constraints, cfg *config.Server, bulker bulk.Bulk, c cache.Cache) (*EnrollerT, error) {
+func NewEnrollerT(verCon version.Constraints, cfg *config.Server, bulker bulk.Bulk, c cache.Cache, pm policy.Monitor, admit *admission.Admission, selector *policy.Selector, wh *webhook.Dispatcher) (*EnrollerT, error) {
 
 	log.Info().
 		Interface("limits", cfg.Limits.EnrollLimit).
 		Msg("Setting config enroll_limit")
 
 	return &EnrollerT{
-		verCon: verCon,
-		cfg:    cfg,
-		limit:  limit.NewLimiter(&cfg.Limits.EnrollLimit),
-		bulker: bulker,
-		cache:  c,
+		verCon:   verCon,
+		cfg:      cfg,
+		limit:    limit.NewLimiter(&cfg.Limits.EnrollLimit),
+		bulker:   bulker,
+		cache:    c,
+		pm:       pm,
+		admit:    admit,
+		selector: selector,
+		wh:       wh,
+		enc:      newResponseEncoder(cfg),
 	}, nil
 
 }
@@ -121,7 +154,7 @@ func (rt Router) handleEnroll(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	if err = writeResponse(zlog, w, resp, start); err != nil {
+	if err = rt.et.writeResponse(zlog, w, r, resp, start); err != nil {
 		cntEnroll.IncError(err)
 		zlog.Error().
 			Err(err).
@@ -168,42 +201,383 @@ func (et *EnrollerT) processRequest(rb *rollback.Rollback, zlog zerolog.Logger,
 		return nil, err
 	}
 
-	body := r.Body
-
-	// Limit the size of the body to prevent malicious agent from exhausting RAM in server
-	if et.cfg.Limits.EnrollLimit.MaxBody > 0 {
-		body = http.MaxBytesReader(w, body, et.cfg.Limits.EnrollLimit.MaxBody)
+	idempotencyKey := r.Header.Get(kIdempotencyKeyHeader)
+	if err = validateIdempotencyKey(idempotencyKey); err != nil {
+		return nil, err
 	}
 
-	readCounter := datacounter.NewReaderCounter(body)
+	body, err := newRequestBody(w, r, &et.cfg.Limits.EnrollLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
 
 	// Parse the request body
-	req, err := decodeEnrollRequest(readCounter)
+	req, err := decodeEnrollRequest(body)
 	if err != nil {
 		return nil, err
 	}
 
-	cntEnroll.bodyIn.Add(readCounter.Count())
+	cntEnroll.AddBodyIn(body)
 
-	return et._enroll(r.Context(), rb, zlog, req, erec.PolicyId, ver)
+	return et.enroll(r.Context(), rb, zlog, erec, req, ver, r.RemoteAddr, idempotencyKey)
 }
 
-func (et *EnrollerT) _enroll(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, req *EnrollRequest, policyId, ver string) (*EnrollResponse, error) {
+// Admit the decoded enroll request and enroll the agent with the enrollment key.
+func (et *EnrollerT) enroll(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, erec *model.EnrollmentApiKey, req *EnrollRequest, ver, remoteAddr, idempotencyKey string) (*EnrollResponse, error) {
+
+	// Evaluate the request against the admission rules
+	if et.admit != nil {
+		decision := et.admit.Evaluate(admission.Request{
+			RemoteAddr: remoteAddr,
+			KeyName:    erec.Name,
+			Version:    ver,
+			LocalMeta:  req.Meta.Local,
+		})
+		if !decision.Allow {
+			zlog.Warn().
+				Str("rule", decision.Rule).
+				Str("reason", decision.Reason).
+				Str("remoteAddr", remoteAddr).
+				Msg("enrollment denied by admission control")
+			return nil, errors.Wrap(admission.ErrDenied, decision.Reason)
+		}
+	}
 
-	if req.SharedId != "" {
-		// TODO: Support pre-existing install
-		return nil, errors.New("preexisting install not yet supported")
+	// A retried request gets the agent enrolled by the earlier attempt
+	if idempotencyKey != "" {
+		resp, err := et.replayEnrollment(ctx, rb, zlog, erec, req, idempotencyKey)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+
+	// Reserve a slot against the enrollment key quota, if any. The quota is read from
+	// the current key record; the cached one may predate it.
+	if err := et.reserveEnrollment(ctx, rb, zlog, erec); err != nil {
+		return nil, err
+	}
+
+	return et._enroll(ctx, rb, zlog, req, erec, ver, idempotencyKey)
+}
+
+// Validate the idempotency key supplied with the request, if any.
+func validateIdempotencyKey(key string) error {
+	if len(key) > kMaxIdempotencyKeyLen {
+		return errors.Wrapf(ErrInvalidIdempotencyKey, "longer than %d characters", kMaxIdempotencyKeyLen)
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return errors.Wrap(ErrInvalidIdempotencyKey, "must be printable ascii")
+		}
+	}
+	return nil
+}
+
+// Look up the agent enrolled by an earlier attempt of a retried request and hand it
+// a fresh access api key.  The access api key handed out on the earlier attempt may
+// never have reached the agent, so it is invalidated.  Returns nil when there was no
+// earlier attempt within the idempotency window.  A request that does not match the
+// earlier attempt is refused; it would otherwise take over the agent.
+func (et *EnrollerT) replayEnrollment(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, erec *model.EnrollmentApiKey, req *EnrollRequest, idempotencyKey string) (*EnrollResponse, error) {
+	fingerprint, err := enrollFingerprint(req)
+	if err != nil {
+		return nil, err
+	}
+
+	agent, ok := et.cache.GetEnrollment(erec.Id, idempotencyKey)
+	if !ok {
+		var err error
+		since := time.Now().Add(-et.cfg.Enroll.IdempotencyWindow)
+		agent, err = dl.FindAgentByIdempotencyKey(ctx, et.bulker, erec.Id, idempotencyKey, since)
+		if errors.Is(err, dl.ErrNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "find agent by idempotency key")
+		}
+	}
+
+	zlog = zlog.With().
+		Str(LogAgentId, agent.Id).
+		Str("idempotencyKey", idempotencyKey).
+		Logger()
+
+	if agent.IdempotencyFingerprint != fingerprint {
+		zlog.Warn().Msg("idempotency key reused with a different enrollment request")
+		return nil, ErrIdempotencyConflict
+	}
+
+	accessApiKey, err := generateAccessApiKey(ctx, et.bulker, agent.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Register invalidate API key function for enrollment error rollback
+	rb.Register("invalidate API key", func(ctx context.Context) error {
+		return invalidateApiKey(ctx, zlog, et.bulker, accessApiKey.Id)
+	})
+
+	fields := bulk.UpdateFields{
+		dl.FieldAccessAPIKeyID: accessApiKey.Id,
+		dl.FieldUpdatedAt:      time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// Deliver the policy inline as the earlier attempt did
+	var actions []interface{}
+	if et.cfg.Enroll.InlinePolicy {
+		prevDefaultApiKeyId := agent.DefaultApiKeyId
+
+		action, err := et.replayInlinePolicy(ctx, rb, zlog, &agent)
+		if err != nil {
+			return nil, err
+		}
+		if action != nil {
+			actions = append(actions, *action)
+		}
+
+		if agent.DefaultApiKeyId != prevDefaultApiKeyId {
+			fields[dl.FieldDefaultApiKey] = agent.DefaultApiKey
+			fields[dl.FieldDefaultApiKeyId] = agent.DefaultApiKeyId
+			fields[dl.FieldPolicyOutputPermissionsHash] = agent.PolicyOutputPermissionsHash
+		}
+	}
+
+	body, err := fields.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "replay enrollment marshal")
+	}
+
+	if err = et.bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh()); err != nil {
+		return nil, errors.Wrap(err, "replay enrollment update")
+	}
+
+	// The record no longer references the previous access api key
+	if agent.AccessApiKeyId != "" {
+		if err = invalidateApiKey(ctx, zlog, et.bulker, agent.AccessApiKeyId); err != nil {
+			zlog.Warn().Err(err).Msg("fail invalidate previous access apiKey")
+		}
+	}
+
+	agent.AccessApiKeyId = accessApiKey.Id
+	et.cacheEnrollment(agent)
+	et.cache.SetApiKey(*accessApiKey, true)
+
+	zlog.Info().
+		Str(LogAccessApiKeyId, accessApiKey.Id).
+		Msg("replayed enrollment of retried request")
+
+	resp := newEnrollResponse(&agent, accessApiKey)
+	resp.Item.Actions = actions
+
+	return resp, nil
+}
+
+// Prepare the POLICY_CHANGE action of a replayed enrollment.  The output api key of the
+// earlier attempt is handed out again, unless the output permissions have changed since.
+func (et *EnrollerT) replayInlinePolicy(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, agent *model.Agent) (*ActionResp, error) {
+	pp, ok := et.pm.LatestPolicy(agent.PolicyId)
+	if ok && pp.Default.Role != nil && agent.DefaultApiKey != "" && agent.PolicyOutputPermissionsHash == pp.Default.Role.Sha2 {
+		action, err := newPolicyChangeAction(agent.Id, pp, agent.DefaultApiKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "inline policy")
+		}
+		return action, nil
+	}
+
+	return et.prepareInlinePolicy(ctx, rb, zlog, agent)
+}
+
+// Fingerprint of the enrollment request, a retried request must match the earlier attempt
+func enrollFingerprint(req *EnrollRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", errors.Wrap(err, "enroll fingerprint")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Cache an agent enrolled with an idempotency key for the rest of the idempotency window.
+func (et *EnrollerT) cacheEnrollment(agent model.Agent) {
+	enrolledAt, err := time.Parse(time.RFC3339, agent.EnrolledAt)
+	if err != nil {
+		return
+	}
+	if ttl := time.Until(enrolledAt.Add(et.cfg.Enroll.IdempotencyWindow)); ttl > 0 {
+		et.cache.SetEnrollment(agent.EnrollmentApiKeyId, agent.IdempotencyKey, agent, ttl)
+	}
+}
+
+// Reserve an enrollment against the quota on the enrollment key record.
+// The quota is evaluated in a script against the current record in Elastic,
+// which keeps the reservation atomic across Fleet Server instances.
+func (et *EnrollerT) reserveEnrollment(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, erec *model.EnrollmentApiKey) error {
+	now := time.Now().UTC()
+
+	body, err := makeReserveEnrollmentBody(now)
+	if err != nil {
+		return errors.Wrap(err, "reserve enrollment marshal")
+	}
+
+	err = et.bulker.Update(ctx, dl.FleetEnrollmentAPIKeys, erec.Id, body, bulk.WithRetryOnConflict(kEnrollQuotaRetryOnConflict))
+	if err != nil {
+		// The reason thrown by the script when the quota has been exhausted,
+		// any other script failure is a server error
+		var esErr *es.ErrElastic
+		if errors.As(err, &esErr) && esErr.Cause.Type == "script_exception" && esErr.Cause.Cause.Reason == kEnrollQuotaExceeded {
+			return ErrEnrollmentQuota
+		}
+		return errors.Wrap(err, "reserve enrollment")
 	}
 
+	// Register release of the reservation for enrollment error rollback
+	rb.Register("release enrollment", func(ctx context.Context) error {
+		return releaseEnrollment(ctx, zlog, et.bulker, erec.Id, now)
+	})
+
+	return nil
+}
+
+func releaseEnrollment(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, id string, since time.Time) error {
+	zlog = zlog.With().Str(LogEnrollApiKeyId, id).Logger()
+
+	body, err := makeReleaseEnrollmentBody(since)
+	if err != nil {
+		return err
+	}
+
+	if err = bulker.Update(ctx, dl.FleetEnrollmentAPIKeys, id, body, bulk.WithRetryOnConflict(kEnrollQuotaRetryOnConflict)); err != nil {
+		zlog.Error().Err(err).Msg("fail release enrollment reservation")
+		return err
+	}
+
+	zlog.Debug().Msg("enrollment reservation released")
+	return nil
+}
+
+// Reason thrown by the reservation script when the quota has been exhausted
+const kEnrollQuotaExceeded = "enrollment quota exceeded"
+
+// Count an enrollment against the quota; start a new window if the current one has lapsed.
+// Throws when the quota has been exhausted; noop when the key carries no quota.
+const kReserveEnrollmentSource = `def src = ctx._source;
+if (src.max_enrollments != null && src.max_enrollments > 0) {
+  long cnt = src.enrollments == null ? 0 : src.enrollments;
+  if (src.enrollment_window != null && src.enrollment_window > 0) {
+    if (src.enrollment_window_start == null || ZonedDateTime.parse(src.enrollment_window_start).toInstant().toEpochMilli() + src.enrollment_window * 1000L <= params.now) {
+      src.enrollment_window_start = params.ts;
+      cnt = 0;
+    }
+  }
+  if (cnt >= src.max_enrollments) {
+    throw new IllegalArgumentException(params.exceeded);
+  }
+  src.enrollments = cnt + 1;
+} else {
+  ctx.op = 'noop';
+}`
+
+// Give back a reservation, unless the window it was counted in has since lapsed.
+// Noop when the key carries no quota, nothing was reserved then.
+const kReleaseEnrollmentSource = `def src = ctx._source;
+if (src.max_enrollments != null && src.max_enrollments > 0 && src.enrollments != null && src.enrollments > 0 && (src.enrollment_window_start == null || ZonedDateTime.parse(src.enrollment_window_start).toInstant().toEpochMilli() <= params.since)) {
+  src.enrollments -= 1;
+} else {
+  ctx.op = 'noop';
+}`
+
+func makeReserveEnrollmentBody(now time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": kReserveEnrollmentSource,
+			"params": map[string]interface{}{
+				"now":      now.UnixNano() / int64(time.Millisecond),
+				"ts":       now.Format(time.RFC3339),
+				"exceeded": kEnrollQuotaExceeded,
+			},
+		},
+	})
+}
+
+func makeReleaseEnrollmentBody(since time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": kReleaseEnrollmentSource,
+			"params": map[string]interface{}{
+				"since": since.UnixNano() / int64(time.Millisecond),
+			},
+		},
+	})
+}
+
+func (et *EnrollerT) _enroll(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, req *EnrollRequest, erec *model.EnrollmentApiKey, ver, idempotencyKey string) (*EnrollResponse, error) {
+
 	now := time.Now()
 
-	// Generate an ID here so we can pre-create the api key and avoid a round trip
-	u, err := uuid.NewV4()
+	// Pick the policy the agent is assigned to
+	policyId, err := et.selectPolicy(ctx, zlog, req, erec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look for the agent record of a pre-existing install
+	var existing *model.Agent
+	if req.SharedId != "" {
+		agent, err := findAgentBySharedId(ctx, et.bulker, req.SharedId)
+		switch {
+		case err == nil:
+			if !canReuseAgent(&agent, erec, policyId) {
+				zlog.Warn().
+					Str("sharedId", req.SharedId).
+					Str(LogAgentId, agent.Id).
+					Str(LogPolicyId, agent.PolicyId).
+					Msg("shared id matches an active agent of another enrollment; refuse re-enrollment")
+				return nil, ErrSharedIdConflict
+			}
+			existing = &agent
+		case !errors.Is(err, dl.ErrNotFound):
+			return nil, err
+		default:
+			zlog.Debug().Str("sharedId", req.SharedId).Msg("no agent record for shared id; enroll as new agent")
+		}
+	}
+
+	var agentId string
+	if existing != nil {
+		agentId = existing.Id
+	} else {
+		// Generate an ID here so we can pre-create the api key and avoid a round trip
+		u, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+
+		agentId = u.String()
+	}
+
+	hostId, err := localMetaHostId(req.Meta.Local)
 	if err != nil {
 		return nil, err
 	}
 
-	agentId := u.String()
+	var fingerprint string
+	if idempotencyKey != "" {
+		if fingerprint, err = enrollFingerprint(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// Look for the active records of previous installs on the same host
+	var duplicates []model.Agent
+	if et.cfg.Enroll.ReplaceDuplicateHosts {
+		duplicates, err = findDuplicateAgents(ctx, et.bulker, hostId, policyId, agentId)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Update the local metadata agent id
 	localMeta, err := updateLocalMetaAgentId(req.Meta.Local, agentId)
@@ -223,49 +597,378 @@ func (et *EnrollerT) _enroll(ctx context.Context, rb *rollback.Rollback, zlog ze
 	})
 
 	agentData := model.Agent{
-		Active:         true,
-		PolicyId:       policyId,
-		Type:           req.Type,
-		EnrolledAt:     now.UTC().Format(time.RFC3339),
-		LocalMetadata:  localMeta,
-		AccessApiKeyId: accessApiKey.Id,
-		ActionSeqNo:    []int64{sqn.UndefinedSeqNo},
+		Active:               true,
+		PolicyId:             policyId,
+		UserProvidedMetadata: req.Meta.User,
+		Type:                 req.Type,
+		EnrolledAt:           now.UTC().Format(time.RFC3339),
+		LocalMetadata:        localMeta,
+		AccessApiKeyId:       accessApiKey.Id,
+		Tags:                 req.Meta.Tags,
+		ActionSeqNo:          []int64{sqn.UndefinedSeqNo},
+		SharedId:             req.SharedId,
+		EnrollmentApiKeyId:   erec.Id,
+		IdempotencyKey:         idempotencyKey,
+		IdempotencyFingerprint: fingerprint,
+		HostId:                 hostId,
 		Agent: &model.AgentMetadata{
 			Id:      agentId,
 			Version: ver,
 		},
 	}
+	agentData.Id = agentId
 
-	err = createFleetAgent(ctx, et.bulker, agentId, agentData)
+	// Duplicates are sorted most recently enrolled first
+	if len(duplicates) > 0 {
+		agentData.ReplacedAgentId = duplicates[0].Id
+	}
+
+	// Deliver the current policy along with the enroll response
+	var actions []interface{}
+	if et.cfg.Enroll.InlinePolicy {
+		action, err := et.prepareInlinePolicy(ctx, rb, zlog, &agentData)
+		if err != nil {
+			return nil, err
+		}
+		if action != nil {
+			actions = append(actions, *action)
+		}
+	}
+
+	if existing != nil {
+		if err = et.reenrollFleetAgent(ctx, rb, zlog, existing, agentData); err != nil {
+			return nil, err
+		}
+	} else {
+		err = createFleetAgent(ctx, et.bulker, agentId, agentData)
+		if err != nil {
+			return nil, err
+		}
+
+		// Register delete fleet agent for enrollment error rollback
+		rb.Register("delete agent", func(ctx context.Context) error {
+			return deleteAgent(ctx, zlog, et.bulker, agentId)
+		})
+	}
+
+	// Retire the records replaced by this enrollment.  This is best effort;
+	// a record that fails to retire is unenrolled later on by the unenroll timeout.
+	for i := range duplicates {
+		if err := replaceAgent(ctx, zlog, et.bulker, &duplicates[i], agentId); err != nil {
+			zlog.Warn().Err(err).Str("replacedAgentId", duplicates[i].Id).Msg("fail retire replaced agent")
+			continue
+		}
+		et.wh.Notify(webhook.Event{
+			Type:     webhook.EventAgentUnenrolled,
+			AgentId:  duplicates[i].Id,
+			PolicyId: duplicates[i].PolicyId,
+			Reason:   unenrolledReasonReplaced,
+		})
+	}
+
+	// Remember the enrollment in case the request is retried
+	if idempotencyKey != "" {
+		et.cacheEnrollment(agentData)
+	}
+
+	// We are Kool & and the Gang; cache the access key to avoid the roundtrip on impending checkin
+	et.cache.SetApiKey(*accessApiKey, true)
+
+	et.wh.Notify(webhook.Event{
+		Type:     webhook.EventAgentEnrolled,
+		AgentId:  agentId,
+		PolicyId: policyId,
+	})
+
+	resp := newEnrollResponse(&agentData, accessApiKey)
+	resp.Item.Actions = actions
+
+	return resp, nil
+}
+
+// Prepare the POLICY_CHANGE action for the agent to apply right after enrollment.
+// The default output api key is generated up front and set on the agent record
+// before it is written, sparing the first checkin from doing so.  Returns nil when
+// the policy cannot be delivered inline; the agent then receives it on checkin.
+func (et *EnrollerT) prepareInlinePolicy(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, agent *model.Agent) (*ActionResp, error) {
+	zlog = zlog.With().Str(LogPolicyId, agent.PolicyId).Logger()
+
+	pp, ok := et.pm.LatestPolicy(agent.PolicyId)
+	if !ok {
+		zlog.Debug().Msg("policy not loaded; deliver policy on checkin")
+		return nil, nil
+	}
+
+	if pp.Default.Role == nil {
+		zlog.Warn().Str("name", pp.Default.Name).Msg("policy does not contain required output permission section; deliver policy on checkin")
+		return nil, nil
+	}
+
+	outputApiKey, err := generateOutputApiKey(ctx, et.bulker, agent.Id, pp.Default.Name, pp.Default.Role.Raw)
 	if err != nil {
 		return nil, err
 	}
 
-	// Register delete fleet agent for enrollment error rollback
-	rb.Register("delete agent", func(ctx context.Context) error {
-		return deleteAgent(ctx, zlog, et.bulker, agentId)
+	// Register invalidate output API key function for enrollment error rollback
+	rb.Register("invalidate output API key", func(ctx context.Context) error {
+		return invalidateApiKey(ctx, zlog, et.bulker, outputApiKey.Id)
 	})
 
-	resp := EnrollResponse{
+	action, err := newPolicyChangeAction(agent.Id, pp, outputApiKey.Agent())
+	if err != nil {
+		return nil, errors.Wrap(err, "inline policy")
+	}
+
+	agent.DefaultApiKey = outputApiKey.Agent()
+	agent.DefaultApiKeyId = outputApiKey.Id
+	agent.PolicyOutputPermissionsHash = pp.Default.Role.Sha2
+
+	zlog.Debug().
+		Str(LogDefaultOutputApiKeyId, outputApiKey.Id).
+		Str("hash.sha256", pp.Default.Role.Sha2).
+		Msg("deliver policy inline with enrollment")
+
+	return action, nil
+}
+
+func newEnrollResponse(agent *model.Agent, accessApiKey *apikey.ApiKey) *EnrollResponse {
+	return &EnrollResponse{
 		Action: "created",
 		Item: EnrollResponseItem{
-			ID:             agentId,
-			Active:         agentData.Active,
-			PolicyId:       agentData.PolicyId,
-			Type:           agentData.Type,
-			EnrolledAt:     agentData.EnrolledAt,
-			UserMeta:       agentData.UserProvidedMetadata,
-			LocalMeta:      agentData.LocalMetadata,
-			AccessApiKeyId: agentData.AccessApiKeyId,
+			ID:             agent.Id,
+			Active:         agent.Active,
+			PolicyId:       agent.PolicyId,
+			Type:           agent.Type,
+			EnrolledAt:     agent.EnrolledAt,
+			UserMeta:       agent.UserProvidedMetadata,
+			LocalMeta:      agent.LocalMetadata,
+			Tags:           agent.Tags,
+			AccessApiKeyId: agent.AccessApiKeyId,
 			AccessAPIKey:   accessApiKey.Token(),
 			Status:         "online",
 		},
 	}
+}
 
-	// We are Kool & and the Gang; cache the access key to avoid the roundtrip on impending checkin
-	et.cache.SetApiKey(*accessApiKey, true)
+// Update the agent record of a pre-existing install in place.  The agent id is retained,
+// the access api key is replaced and the policy revision is reset so that the current
+// policy is delivered on the next checkin.  The api keys held by the previous install
+// are invalidated once the record no longer references them.
+func (et *EnrollerT) reenrollFleetAgent(ctx context.Context, rb *rollback.Rollback, zlog zerolog.Logger, existing *model.Agent, agent model.Agent) error {
+	zlog = zlog.With().
+		Str(LogAgentId, existing.Id).
+		Str("sharedId", agent.SharedId).
+		Logger()
+
+	doc := bulk.UpdateFields{
+		dl.FieldActive:                      agent.Active,
+		dl.FieldPolicyId:                    agent.PolicyId,
+		dl.FieldType:                        agent.Type,
+		dl.FieldEnrolledAt:                  agent.EnrolledAt,
+		dl.FieldLocalMetadata:               agent.LocalMetadata,
+		dl.FieldUserProvidedMetadata:        agent.UserProvidedMetadata,
+		dl.FieldTags:                        agent.Tags,
+		dl.FieldAccessAPIKeyID:              agent.AccessApiKeyId,
+		dl.FieldActionSeqNo:                 agent.ActionSeqNo,
+		dl.FieldAgent:                       agent.Agent,
+		dl.FieldPolicyRevisionIdx:           0,
+		dl.FieldPolicyCoordinatorIdx:        0,
+		dl.FieldPolicyOutputPermissionsHash: nullIfEmpty(agent.PolicyOutputPermissionsHash),
+		dl.FieldDefaultApiKey:               nullIfEmpty(agent.DefaultApiKey),
+		dl.FieldDefaultApiKeyId:             nullIfEmpty(agent.DefaultApiKeyId),
+		dl.FieldUnenrolledAt:                nil,
+		dl.FieldUnenrollStartAt:             nil,
+		dl.FieldUnenrolledReason:            nil,
+		dl.FieldReplacedAgentId:             nullIfEmpty(agent.ReplacedAgentId),
+		dl.FieldEnrollmentApiKeyId:          agent.EnrollmentApiKeyId,
+		dl.FieldIdempotencyKey:              nullIfEmpty(agent.IdempotencyKey),
+		dl.FieldIdempotencyFingerprint:      nullIfEmpty(agent.IdempotencyFingerprint),
+		dl.FieldHostId:                      nullIfEmpty(agent.HostId),
+		dl.FieldUpdatedAt:                   agent.EnrolledAt,
+	}
+
+	body, err := doc.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "reenroll marshal")
+	}
+
+	// Snapshot the original record before the update for rollback
+	orig, err := json.Marshal(existing)
+	if err != nil {
+		return errors.Wrap(err, "reenroll marshal original")
+	}
+
+	if err = et.bulker.Update(ctx, dl.FleetAgents, existing.Id, body, bulk.WithRefresh()); err != nil {
+		return errors.Wrap(err, "reenroll update")
+	}
+
+	// Register restore fleet agent for enrollment error rollback
+	rb.Register("restore agent", func(ctx context.Context) error {
+		return restoreAgent(ctx, zlog, et.bulker, existing.Id, orig)
+	})
+
+	// Retire the api keys held by the previous install
+	if apiKeys := _getAPIKeyIDs(existing); len(apiKeys) > 0 {
+		if err = et.bulker.ApiKeyInvalidate(ctx, apiKeys...); err != nil {
+			zlog.Error().Err(err).Strs(LogApiKeyId, apiKeys).Msg("fail invalidate previous apiKeys")
+			return errors.Wrap(err, "reenroll invalidate apikey")
+		}
+	}
+
+	zlog.Info().
+		Str(LogAccessApiKeyId, agent.AccessApiKeyId).
+		Msg("re-enrolled pre-existing install")
+
+	return nil
+}
+
+func restoreAgent(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, agentID string, data []byte) error {
+	zlog = zlog.With().Str(LogAgentId, agentID).Logger()
+
+	if _, err := bulker.Index(ctx, dl.FleetAgents, agentID, data, bulk.WithRefresh()); err != nil {
+		zlog.Error().Err(err).Msg("agent record failed to restore")
+		return err
+	}
+	zlog.Info().Msg("agent record restored")
+	return nil
+}
+
+// Select the policy for the enrolling agent.  The policy of the enrollment key
+// is used unless a policy selection rule matches the request and the policy
+// picked by that rule exists.
+func (et *EnrollerT) selectPolicy(ctx context.Context, zlog zerolog.Logger, req *EnrollRequest, erec *model.EnrollmentApiKey) (string, error) {
+	if et.selector == nil {
+		return erec.PolicyId, nil
+	}
+
+	policyId, rule := et.selector.Select(policy.SelectRequest{
+		KeyName:   erec.Name,
+		LocalMeta: req.Meta.Local,
+		UserMeta:  req.Meta.User,
+	})
+	if policyId == "" || policyId == erec.PolicyId {
+		return erec.PolicyId, nil
+	}
+
+	zlog = zlog.With().
+		Str("rule", rule).
+		Str(LogPolicyId, policyId).
+		Str("enrollmentPolicyId", erec.PolicyId).
+		Logger()
 
-	return &resp, nil
+	// Policies not yet loaded by the monitor are looked up in Elastic
+	if _, ok := et.pm.LatestPolicy(policyId); !ok {
+		_, err := dl.FindLatestPolicy(ctx, et.bulker, policyId)
+		if errors.Is(err, dl.ErrNotFound) || errors.Is(err, es.ErrIndexNotFound) {
+			zlog.Warn().Msg("policy selected by rule does not exist; fall back to enrollment key policy")
+			return erec.PolicyId, nil
+		} else if err != nil {
+			return "", errors.Wrap(err, "select policy")
+		}
+	}
+
+	zlog.Debug().Msg("policy selected by rule")
+	return policyId, nil
+}
+
+func findAgentBySharedId(ctx context.Context, bulker bulk.Bulk, sharedId string) (model.Agent, error) {
+	agent, err := dl.FindAgent(ctx, bulker, dl.QueryAgentBySharedID, dl.FieldSharedId, sharedId)
+	if errors.Is(err, es.ErrIndexNotFound) {
+		return agent, dl.ErrNotFound
+	}
+	return agent, err
+}
+
+// An agent record is reused by a re-enrollment presenting its shared id only if the record is
+// no longer active, or was enrolled with the same enrollment key or into the same policy;
+// otherwise the holder of any enrollment key could take over the record of any agent.
+func canReuseAgent(agent *model.Agent, erec *model.EnrollmentApiKey, policyId string) bool {
+	switch {
+	case !agent.Active, agent.UnenrolledAt != "":
+		return true
+	case agent.EnrollmentApiKeyId != "" && agent.EnrollmentApiKeyId == erec.Id:
+		return true
+	case agent.PolicyId != "" && agent.PolicyId == policyId:
+		return true
+	}
+	return false
+}
+
+// Clear optional fields of a re-enrolled record that the new enrollment does not set.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// The host id reported in the local metadata of the agent, empty if not reported.
+func localMetaHostId(localMeta json.RawMessage) (string, error) {
+	meta, err := smap.Parse(localMeta)
+	if err != nil {
+		return "", errors.Wrap(err, "parse local metadata")
+	}
+
+	hostId, _ := meta.GetValue("host.id")
+	return hostId, nil
+}
+
+// Find the active agents enrolled in the policy from the same host as the
+// enrolling agent, skipping the enrolling agent's own record.
+func findDuplicateAgents(ctx context.Context, bulker bulk.Bulk, hostId, policyId, agentId string) ([]model.Agent, error) {
+	if hostId == "" {
+		return nil, nil
+	}
+
+	agents, err := dl.FindActiveAgentsByHostID(ctx, bulker, hostId, policyId)
+	if err != nil {
+		if errors.Is(err, es.ErrIndexNotFound) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "find duplicate agents")
+	}
+
+	duplicates := agents[:0]
+	for _, agent := range agents {
+		if agent.Id != agentId {
+			duplicates = append(duplicates, agent)
+		}
+	}
+	return duplicates, nil
+}
+
+// Unenroll an agent record replaced by a new enrollment from the same host.
+func replaceAgent(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, agent *model.Agent, agentId string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	fields := bulk.UpdateFields{
+		dl.FieldActive:           false,
+		dl.FieldUnenrolledAt:     now,
+		dl.FieldUnenrolledReason: unenrolledReasonReplaced,
+		dl.FieldUpdatedAt:        now,
+	}
+	body, err := fields.Marshal()
+	if err != nil {
+		return err
+	}
+	apiKeys := _getAPIKeyIDs(agent)
+
+	zlog = zlog.With().
+		Str(LogAgentId, agentId).
+		Str("replacedAgentId", agent.Id).
+		Strs(LogApiKeyId, apiKeys).
+		Logger()
+
+	if len(apiKeys) > 0 {
+		if err = bulker.ApiKeyInvalidate(ctx, apiKeys...); err != nil {
+			return errors.Wrap(err, "invalidate apikey")
+		}
+	}
+	if err = bulker.Update(ctx, dl.FleetAgents, agent.Id, body, bulk.WithRefresh()); err != nil {
+		return errors.Wrap(err, "unenroll update")
+	}
+
+	zlog.Info().Msg("unenrolled agent replaced by new enrollment from same host")
+	return nil
 }
 
 func deleteAgent(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, agentID string) error {
@@ -326,15 +1029,15 @@ LOOP:
 	return nil
 }
 
-func writeResponse(zlog zerolog.Logger, w http.ResponseWriter, resp *EnrollResponse, start time.Time) error {
+func (et *EnrollerT) writeResponse(zlog zerolog.Logger, w http.ResponseWriter, r *http.Request, resp *EnrollResponse, start time.Time) error {
 
 	data, err := json.Marshal(resp)
 	if err != nil {
 		return errors.Wrap(err, "marshal enrollResponse")
 	}
 
-	numWritten, err := w.Write(data)
-	cntEnroll.bodyOut.Add(uint64(numWritten))
+	numWritten, err := et.enc.write(zlog, w, r, data)
+	cntEnroll.bodyOut.Add(numWritten)
 
 	if err != nil {
 		return errors.Wrap(err, "fail send enroll response")
@@ -344,7 +1047,7 @@ func writeResponse(zlog zerolog.Logger, w http.ResponseWriter, resp *EnrollRespo
 		Str(LogAgentId, resp.Item.ID).
 		Str(LogPolicyId, resp.Item.PolicyId).
 		Str(LogAccessApiKeyId, resp.Item.AccessApiKeyId).
-		Int(EcsHttpResponseBodyBytes, numWritten).
+		Uint64(EcsHttpResponseBodyBytes, numWritten).
 		Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
 		Msg("Elastic Agent successfully enrolled")
 
@@ -444,6 +1147,9 @@ func generateOutputApiKey(ctx context.Context, bulk bulk.Bulk, agentId, outputNa
 func (et *EnrollerT) fetchEnrollmentKeyRecord(ctx context.Context, id string) (*model.EnrollmentApiKey, error) {
 
 	if key, ok := et.cache.GetEnrollmentApiKey(id); ok {
+		if err := validateEnrollmentKeyExpiry(&key, time.Now()); err != nil {
+			return nil, err
+		}
 		return &key, nil
 	}
 
@@ -457,6 +1163,10 @@ func (et *EnrollerT) fetchEnrollmentKeyRecord(ctx context.Context, id string) (*
 		return nil, ErrInactiveEnrollmentKey
 	}
 
+	if err = validateEnrollmentKeyExpiry(&rec, time.Now()); err != nil {
+		return nil, err
+	}
+
 	cost := int64(len(rec.ApiKey))
 	et.cache.SetEnrollmentApiKey(id, rec, cost)
 
@@ -471,12 +1181,90 @@ func decodeEnrollRequest(data io.Reader) (*EnrollRequest, error) {
 		return nil, errors.Wrap(err, "decode enroll request")
 	}
 
-	// Validate
+	if err := validateEnrollRequest(&req); err != nil {
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+func validateEnrollRequest(req *EnrollRequest) error {
 	switch req.Type {
 	case EnrollEphemeral, EnrollPermanent, EnrollTemporary:
 	default:
-		return nil, ErrUnknownEnrollType
+		return ErrUnknownEnrollType
 	}
 
-	return &req, nil
+	if err := validateUserMeta(req.Meta.User); err != nil {
+		return err
+	}
+
+	return validateTags(req.Meta.Tags)
+}
+
+// The user provided metadata is stored as an object on the agent record
+func validateUserMeta(data json.RawMessage) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ErrInvalidUserMeta
+	}
+	return nil
+}
+
+// Tags are limited in number and length, and to a conservative character set
+func validateTags(tags []string) error {
+	if len(tags) > kMaxEnrollTags {
+		return errors.Wrapf(ErrInvalidTags, "too many tags %d, max %d", len(tags), kMaxEnrollTags)
+	}
+
+	for _, tag := range tags {
+		if len(tag) == 0 || len(tag) > kMaxEnrollTagLen {
+			return errors.Wrapf(ErrInvalidTags, "tag length must be between 1 and %d", kMaxEnrollTagLen)
+		}
+		for _, c := range tag {
+			if !isTagChar(c) {
+				return errors.Wrapf(ErrInvalidTags, "invalid character %q in tag %q", c, tag)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isTagChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '-', c == '_', c == '.', c == ':', c == '/', c == '@', c == ' ':
+		return true
+	}
+	return false
+}
+
+// Validate that the enrollment key has not passed its expiration, if any.
+// A key with an unparseable expiration is treated as expired.
+func validateEnrollmentKeyExpiry(rec *model.EnrollmentApiKey, now time.Time) error {
+	if rec.ExpireAt == "" {
+		return nil
+	}
+
+	expireAt, err := time.Parse(time.RFC3339, rec.ExpireAt)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("id", rec.Id).
+			Str("expireAt", rec.ExpireAt).
+			Msg("enrollment key has an invalid expiration")
+		return ErrExpiredEnrollmentKey
+	}
+
+	if !now.Before(expireAt) {
+		return ErrExpiredEnrollmentKey
+	}
+
+	return nil
 }
@@ -0,0 +1,735 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package fleet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	"github.com/elastic/fleet-server/v7/internal/pkg/rollback"
+	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+type enrollBulk struct {
+	ftesting.MockBulk
+
+	updates     map[string][]byte
+	indexed     map[string][]byte
+	invalidated []string
+	invalidErr  error
+	updateErr   error
+	policies    []model.Policy
+	agents      []model.Agent
+	searches    [][]byte
+}
+
+func (m *enrollBulk) Update(ctx context.Context, index, id string, body []byte, opts ...bulk.Opt) error {
+	if m.updateErr != nil {
+		return m.updateErr
+	}
+	m.updates[id] = body
+	return nil
+}
+
+func (m *enrollBulk) Index(ctx context.Context, index, id string, body []byte, opts ...bulk.Opt) (string, error) {
+	m.indexed[id] = body
+	return id, nil
+}
+
+func (m *enrollBulk) Search(ctx context.Context, index string, body []byte, opts ...bulk.Opt) (*es.ResultT, error) {
+	m.searches = append(m.searches, body)
+
+	// Policies are looked up by id
+	if index == dl.FleetPolicies {
+		var hits []es.HitT
+		for _, p := range m.policies {
+			if !bytes.Contains(body, []byte(`"`+p.PolicyId+`"`)) {
+				continue
+			}
+			src, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+			hits = append(hits, es.HitT{Source: src})
+		}
+		return &es.ResultT{HitsT: es.HitsT{Hits: hits}}, nil
+	}
+
+	var hits []es.HitT
+	for _, a := range m.agents {
+		src, err := json.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, es.HitT{Id: a.Id, Source: src})
+	}
+
+	agg := es.Aggregation{}
+	for _, p := range m.policies {
+		src, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		agg.Buckets = append(agg.Buckets, es.Bucket{
+			Key:          p.PolicyId,
+			Aggregations: map[string]es.HitsT{dl.FieldRevisionIdx: {Hits: []es.HitT{{Source: src}}}},
+		})
+	}
+	return &es.ResultT{
+		HitsT:        es.HitsT{Hits: hits},
+		Aggregations: map[string]es.Aggregation{dl.FieldPolicyId: agg},
+	}, nil
+}
+
+func (m *enrollBulk) ApiKeyCreate(ctx context.Context, name, ttl string, roles []byte, meta interface{}) (*bulk.ApiKey, error) {
+	return &bulk.ApiKey{Id: "new-access-key", Key: "secret"}, nil
+}
+
+func (m *enrollBulk) ApiKeyInvalidate(ctx context.Context, ids ...string) error {
+	if m.invalidErr != nil {
+		return m.invalidErr
+	}
+	m.invalidated = append(m.invalidated, ids...)
+	return nil
+}
+
+func TestReenrollFleetAgent(t *testing.T) {
+	existing := &model.Agent{
+		Active:                      false,
+		PolicyId:                    "old-policy",
+		AccessApiKeyId:              "old-access-key",
+		DefaultApiKeyId:             "old-default-key",
+		DefaultApiKey:               "old-default-key:secret",
+		PolicyRevisionIdx:           3,
+		PolicyCoordinatorIdx:        1,
+		PolicyOutputPermissionsHash: "abcd",
+		SharedId:                    "shared",
+		UnenrolledAt:                "2021-06-01T00:00:00Z",
+	}
+	existing.Id = "agent-id"
+
+	agent := model.Agent{
+		Active:         true,
+		PolicyId:       "new-policy",
+		Type:           EnrollPermanent,
+		EnrolledAt:     "2021-07-01T00:00:00Z",
+		AccessApiKeyId: "new-access-key",
+		ActionSeqNo:    []int64{sqn.UndefinedSeqNo},
+		SharedId:       "shared",
+		Agent: &model.AgentMetadata{
+			Id:      "agent-id",
+			Version: "8.0.0",
+		},
+	}
+
+	t.Run("success", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}, indexed: map[string][]byte{}}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		err := et.reenrollFleetAgent(context.Background(), rb, zerolog.Nop(), existing, agent)
+		require.NoError(t, err)
+
+		var doc struct {
+			Doc map[string]interface{} `json:"doc"`
+		}
+		require.NoError(t, json.Unmarshal(bulker.updates["agent-id"], &doc))
+
+		assert.Equal(t, true, doc.Doc[dl.FieldActive])
+		assert.Equal(t, "new-policy", doc.Doc[dl.FieldPolicyId])
+		assert.Equal(t, "new-access-key", doc.Doc[dl.FieldAccessAPIKeyID])
+		assert.EqualValues(t, 0, doc.Doc[dl.FieldPolicyRevisionIdx])
+		assert.EqualValues(t, 0, doc.Doc[dl.FieldPolicyCoordinatorIdx])
+		for _, field := range []string{dl.FieldPolicyOutputPermissionsHash, dl.FieldDefaultApiKey, dl.FieldDefaultApiKeyId, dl.FieldUnenrolledAt} {
+			v, ok := doc.Doc[field]
+			assert.True(t, ok, field)
+			assert.Nil(t, v, field)
+		}
+
+		assert.ElementsMatch(t, []string{"old-access-key", "old-default-key"}, bulker.invalidated)
+		assert.Empty(t, bulker.indexed)
+	})
+
+	t.Run("rollback on invalidate failure", func(t *testing.T) {
+		bulker := &enrollBulk{
+			updates:    map[string][]byte{},
+			indexed:    map[string][]byte{},
+			invalidErr: errors.New("invalidate failed"),
+		}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		err := et.reenrollFleetAgent(context.Background(), rb, zerolog.Nop(), existing, agent)
+		require.Error(t, err)
+
+		require.NoError(t, rb.Rollback(context.Background()))
+
+		var restored model.Agent
+		require.NoError(t, json.Unmarshal(bulker.indexed["agent-id"], &restored))
+		assert.Equal(t, "old-access-key", restored.AccessApiKeyId)
+		assert.Equal(t, "old-policy", restored.PolicyId)
+		assert.EqualValues(t, 3, restored.PolicyRevisionIdx)
+	})
+}
+
+func TestValidateEnrollmentKeyExpiry(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		expireAt string
+		err      error
+	}{
+		{"no expiration", "", nil},
+		{"future", "2021-07-01T13:00:00Z", nil},
+		{"future with millis", "2021-07-01T12:00:00.500Z", nil},
+		{"past", "2021-07-01T11:00:00Z", ErrExpiredEnrollmentKey},
+		{"exact", "2021-07-01T12:00:00Z", ErrExpiredEnrollmentKey},
+		{"invalid", "bogus", ErrExpiredEnrollmentKey},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := model.EnrollmentApiKey{ExpireAt: tc.expireAt}
+			err := validateEnrollmentKeyExpiry(&rec, now)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, NewErrorResp(ErrExpiredEnrollmentKey).StatusCode)
+}
+
+func TestReserveEnrollment(t *testing.T) {
+	erec := &model.EnrollmentApiKey{MaxEnrollments: 2}
+	erec.Id = "enroll-key-id"
+
+	scriptOf := func(t *testing.T, body []byte) (string, map[string]interface{}) {
+		var doc struct {
+			Script struct {
+				Source string                 `json:"source"`
+				Params map[string]interface{} `json:"params"`
+			} `json:"script"`
+		}
+		require.NoError(t, json.Unmarshal(body, &doc))
+		return doc.Script.Source, doc.Script.Params
+	}
+
+	t.Run("reserve and release", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		require.NoError(t, et.reserveEnrollment(context.Background(), rb, zerolog.Nop(), erec))
+
+		source, params := scriptOf(t, bulker.updates["enroll-key-id"])
+		assert.Equal(t, kReserveEnrollmentSource, source)
+		assert.Contains(t, params, "now")
+		assert.Contains(t, params, "ts")
+		assert.Equal(t, kEnrollQuotaExceeded, params["exceeded"])
+
+		// Rollback gives the reservation back
+		require.NoError(t, rb.Rollback(context.Background()))
+
+		source, params = scriptOf(t, bulker.updates["enroll-key-id"])
+		assert.Equal(t, kReleaseEnrollmentSource, source)
+		assert.Contains(t, params, "since")
+	})
+
+	t.Run("quota exceeded", func(t *testing.T) {
+		esErr := &es.ErrElastic{Status: http.StatusBadRequest, Type: "illegal_argument_exception"}
+		esErr.Cause.Type = "script_exception"
+		esErr.Cause.Cause.Type = "illegal_argument_exception"
+		esErr.Cause.Cause.Reason = kEnrollQuotaExceeded
+
+		bulker := &enrollBulk{updates: map[string][]byte{}, updateErr: esErr}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		err := et.reserveEnrollment(context.Background(), rb, zerolog.Nop(), erec)
+		assert.Equal(t, ErrEnrollmentQuota, err)
+		assert.Equal(t, http.StatusTooManyRequests, NewErrorResp(err).StatusCode)
+
+		// Nothing to release
+		require.NoError(t, rb.Rollback(context.Background()))
+		assert.Empty(t, bulker.updates)
+	})
+
+	t.Run("script failure", func(t *testing.T) {
+		esErr := &es.ErrElastic{Status: http.StatusBadRequest, Type: "illegal_argument_exception"}
+		esErr.Cause.Type = "script_exception"
+		esErr.Cause.Cause.Type = "date_time_parse_exception"
+		esErr.Cause.Cause.Reason = "Text 'bogus' could not be parsed at index 0"
+
+		bulker := &enrollBulk{updates: map[string][]byte{}, updateErr: esErr}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		err := et.reserveEnrollment(context.Background(), rb, zerolog.Nop(), erec)
+		assert.False(t, errors.Is(err, ErrEnrollmentQuota))
+		assert.True(t, errors.As(err, &esErr))
+		assert.NotEqual(t, http.StatusTooManyRequests, NewErrorResp(err).StatusCode)
+	})
+
+	t.Run("elastic failure", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}, updateErr: es.ErrElasticNotFound}
+		et := &EnrollerT{bulker: bulker}
+		rb := rollback.New(zerolog.Nop())
+
+		err := et.reserveEnrollment(context.Background(), rb, zerolog.Nop(), erec)
+		assert.True(t, errors.Is(err, es.ErrElasticNotFound))
+	})
+}
+
+func TestDecodeEnrollRequest(t *testing.T) {
+	longTag := strings.Repeat("a", kMaxEnrollTagLen+1)
+	manyTags := `"` + strings.Repeat(`t", "`, kMaxEnrollTags) + `t"`
+
+	tests := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{
+			name: "user metadata and tags",
+			body: `{"type": "PERMANENT", "metadata": {"user_provided": {"site": "a"}, "tags": ["linux", "prod:eu-west-1", "team/ops@corp"]}}`,
+		},
+		{
+			name: "no metadata",
+			body: `{"type": "PERMANENT"}`,
+		},
+		{
+			name: "null user metadata",
+			body: `{"type": "PERMANENT", "metadata": {"user_provided": null}}`,
+		},
+		{
+			name: "user metadata not an object",
+			body: `{"type": "PERMANENT", "metadata": {"user_provided": "bogus"}}`,
+			err:  ErrInvalidUserMeta,
+		},
+		{
+			name: "empty tag",
+			body: `{"type": "PERMANENT", "metadata": {"tags": [""]}}`,
+			err:  ErrInvalidTags,
+		},
+		{
+			name: "tag too long",
+			body: `{"type": "PERMANENT", "metadata": {"tags": ["` + longTag + `"]}}`,
+			err:  ErrInvalidTags,
+		},
+		{
+			name: "tag invalid charset",
+			body: `{"type": "PERMANENT", "metadata": {"tags": ["<script>"]}}`,
+			err:  ErrInvalidTags,
+		},
+		{
+			name: "too many tags",
+			body: `{"type": "PERMANENT", "metadata": {"tags": [` + manyTags + `]}}`,
+			err:  ErrInvalidTags,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := decodeEnrollRequest(strings.NewReader(tc.body))
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "expected %v, got %v", tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, EnrollPermanent, req.Type)
+		})
+	}
+}
+
+func TestSelectPolicy(t *testing.T) {
+	selector, err := policy.NewSelector(&config.PolicySelection{
+		Rules: []config.PolicySelectionRule{
+			{
+				Name:          "linux",
+				PolicyID:      "linux-policy",
+				LocalMetadata: []config.MetadataField{{Field: "os.family", Pattern: "debian"}},
+			},
+			{
+				Name:         "containers",
+				PolicyID:     "missing-policy",
+				UserMetadata: []config.MetadataField{{Field: "kind", Pattern: "container"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	erec := &model.EnrollmentApiKey{Name: "site-a", PolicyId: "site-policy"}
+	bulker := &enrollBulk{policies: []model.Policy{{PolicyId: "site-policy"}, {PolicyId: "linux-policy"}}}
+	pm := &latestPolicyMonitor{policies: map[string]*policy.ParsedPolicy{}}
+	et := &EnrollerT{bulker: bulker, pm: pm, selector: selector}
+
+	tests := []struct {
+		name      string
+		localMeta string
+		userMeta  string
+		policyId  string
+	}{
+		{"no match", `{"os": {"family": "darwin"}}`, "", "site-policy"},
+		{"match", `{"os": {"family": "debian"}}`, "", "linux-policy"},
+		{"match missing policy", "", `{"kind": "container"}`, "site-policy"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &EnrollRequest{}
+			req.Meta.Local = json.RawMessage(tc.localMeta)
+			req.Meta.User = json.RawMessage(tc.userMeta)
+
+			policyId, err := et.selectPolicy(context.Background(), zerolog.Nop(), req, erec)
+			require.NoError(t, err)
+			assert.Equal(t, tc.policyId, policyId)
+		})
+	}
+
+	// A policy loaded by the monitor is not looked up
+	pm.policies["linux-policy"] = &policy.ParsedPolicy{}
+	bulker.searches = nil
+	req := &EnrollRequest{}
+	req.Meta.Local = json.RawMessage(`{"os": {"family": "debian"}}`)
+	policyId, err := et.selectPolicy(context.Background(), zerolog.Nop(), req, erec)
+	require.NoError(t, err)
+	assert.Equal(t, "linux-policy", policyId)
+	assert.Empty(t, bulker.searches)
+
+	// No selector configured
+	et = &EnrollerT{bulker: bulker}
+	policyId, err = et.selectPolicy(context.Background(), zerolog.Nop(), req, erec)
+	require.NoError(t, err)
+	assert.Equal(t, "site-policy", policyId)
+}
+
+func TestFindDuplicateAgents(t *testing.T) {
+	self := model.Agent{}
+	self.Id = "agent-id"
+	old := model.Agent{AccessApiKeyId: "old-access-key"}
+	old.Id = "old-agent-id"
+
+	t.Run("same host", func(t *testing.T) {
+		bulker := &enrollBulk{agents: []model.Agent{old, self}}
+		hostId, err := localMetaHostId(json.RawMessage(`{"host": {"id": "host-1"}}`))
+		require.NoError(t, err)
+		assert.Equal(t, "host-1", hostId)
+
+		duplicates, err := findDuplicateAgents(context.Background(), bulker, hostId, "policy-id", "agent-id")
+		require.NoError(t, err)
+		require.Len(t, duplicates, 1)
+		assert.Equal(t, "old-agent-id", duplicates[0].Id)
+
+		require.Len(t, bulker.searches, 1)
+		assert.Contains(t, string(bulker.searches[0]), `"host-1"`)
+		assert.Contains(t, string(bulker.searches[0]), `"policy-id"`)
+	})
+
+	t.Run("no host id", func(t *testing.T) {
+		bulker := &enrollBulk{agents: []model.Agent{old}}
+
+		hostId, err := localMetaHostId(json.RawMessage(`{"os": {"family": "linux"}}`))
+		require.NoError(t, err)
+		assert.Empty(t, hostId)
+
+		duplicates, err := findDuplicateAgents(context.Background(), bulker, hostId, "policy-id", "agent-id")
+		require.NoError(t, err)
+		assert.Empty(t, duplicates)
+		assert.Empty(t, bulker.searches)
+	})
+}
+
+func TestReplaceAgent(t *testing.T) {
+	old := &model.Agent{
+		Active:          true,
+		AccessApiKeyId:  "old-access-key",
+		DefaultApiKeyId: "old-default-key",
+	}
+	old.Id = "old-agent-id"
+
+	bulker := &enrollBulk{updates: map[string][]byte{}}
+	require.NoError(t, replaceAgent(context.Background(), zerolog.Nop(), bulker, old, "agent-id"))
+
+	var doc struct {
+		Doc map[string]interface{} `json:"doc"`
+	}
+	require.NoError(t, json.Unmarshal(bulker.updates["old-agent-id"], &doc))
+	assert.Equal(t, false, doc.Doc[dl.FieldActive])
+	assert.Equal(t, unenrolledReasonReplaced, doc.Doc[dl.FieldUnenrolledReason])
+	assert.NotEmpty(t, doc.Doc[dl.FieldUnenrolledAt])
+	assert.ElementsMatch(t, []string{"old-access-key", "old-default-key"}, bulker.invalidated)
+
+	// The record is left alone when the keys fail to invalidate
+	bulker = &enrollBulk{updates: map[string][]byte{}, invalidErr: errors.New("invalidate failed")}
+	assert.Error(t, replaceAgent(context.Background(), zerolog.Nop(), bulker, old, "agent-id"))
+	assert.Empty(t, bulker.updates)
+}
+
+func TestValidateIdempotencyKey(t *testing.T) {
+	assert.NoError(t, validateIdempotencyKey(""))
+	assert.NoError(t, validateIdempotencyKey("0b6f7c1e-6a1e-4b3c-9b43-3d1f1f0b9c55"))
+	assert.True(t, errors.Is(validateIdempotencyKey("has space"), ErrInvalidIdempotencyKey))
+	assert.True(t, errors.Is(validateIdempotencyKey(strings.Repeat("k", kMaxIdempotencyKeyLen+1)), ErrInvalidIdempotencyKey))
+}
+
+func TestReplayEnrollment(t *testing.T) {
+	erec := &model.EnrollmentApiKey{PolicyId: "policy-id"}
+	erec.Id = "enroll-key-id"
+
+	orig := model.Agent{
+		Active:             true,
+		PolicyId:           "policy-id",
+		Type:               EnrollPermanent,
+		EnrolledAt:         time.Now().UTC().Format(time.RFC3339),
+		AccessApiKeyId:     "old-access-key",
+		EnrollmentApiKeyId: erec.Id,
+		IdempotencyKey:     "retry-me",
+		Tags:               []string{"linux"},
+	}
+	orig.Id = "agent-id"
+
+	req := &EnrollRequest{Type: EnrollPermanent}
+	req.Meta.Local = json.RawMessage(`{"host": {"id": "host-id"}}`)
+	fingerprint, err := enrollFingerprint(req)
+	require.NoError(t, err)
+	orig.IdempotencyFingerprint = fingerprint
+
+	cfg := &config.Server{Enroll: config.ServerEnroll{IdempotencyWindow: time.Hour}}
+
+	newEnroller := func(t *testing.T, bulker bulk.Bulk) *EnrollerT {
+		c, err := cache.New(cache.Config{NumCounters: 100, MaxCost: 100000})
+		require.NoError(t, err)
+		return &EnrollerT{cfg: cfg, bulker: bulker, cache: c}
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}, agents: []model.Agent{orig}}
+		et := newEnroller(t, bulker)
+		rb := rollback.New(zerolog.Nop())
+
+		resp, err := et.replayEnrollment(context.Background(), rb, zerolog.Nop(), erec, req, "retry-me")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+
+		assert.Equal(t, "agent-id", resp.Item.ID)
+		assert.Equal(t, "policy-id", resp.Item.PolicyId)
+		assert.Equal(t, []string{"linux"}, resp.Item.Tags)
+		assert.Equal(t, "new-access-key", resp.Item.AccessApiKeyId)
+		assert.NotEmpty(t, resp.Item.AccessAPIKey)
+
+		var doc struct {
+			Doc map[string]interface{} `json:"doc"`
+		}
+		require.NoError(t, json.Unmarshal(bulker.updates["agent-id"], &doc))
+		assert.Equal(t, "new-access-key", doc.Doc[dl.FieldAccessAPIKeyID])
+		assert.Equal(t, []string{"old-access-key"}, bulker.invalidated)
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}, agents: []model.Agent{orig}}
+		et := newEnroller(t, bulker)
+		rb := rollback.New(zerolog.Nop())
+
+		other := &EnrollRequest{Type: EnrollPermanent}
+		other.Meta.Local = json.RawMessage(`{"host": {"id": "other-host"}}`)
+		resp, err := et.replayEnrollment(context.Background(), rb, zerolog.Nop(), erec, other, "retry-me")
+		assert.True(t, errors.Is(err, ErrIdempotencyConflict))
+		assert.Nil(t, resp)
+		assert.Empty(t, bulker.updates)
+		assert.Empty(t, bulker.invalidated)
+		assert.Equal(t, http.StatusConflict, NewErrorResp(err).StatusCode)
+	})
+
+	t.Run("inline policy", func(t *testing.T) {
+		pp, err := policy.NewParsedPolicy(model.Policy{
+			PolicyId:       "policy-id",
+			RevisionIdx:    2,
+			CoordinatorIdx: 1,
+			Data:           json.RawMessage(inlinePolicyData),
+		})
+		require.NoError(t, err)
+
+		agent := orig
+		agent.DefaultApiKeyId = "output-key"
+		agent.DefaultApiKey = "output-key:secret"
+		agent.PolicyOutputPermissionsHash = pp.Default.Role.Sha2
+
+		bulker := &enrollBulk{updates: map[string][]byte{}, agents: []model.Agent{agent}}
+		et := newEnroller(t, bulker)
+		et.cfg = &config.Server{Enroll: config.ServerEnroll{IdempotencyWindow: time.Hour, InlinePolicy: true}}
+		et.pm = &latestPolicyMonitor{policies: map[string]*policy.ParsedPolicy{"policy-id": pp}}
+		rb := rollback.New(zerolog.Nop())
+
+		resp, err := et.replayEnrollment(context.Background(), rb, zerolog.Nop(), erec, req, "retry-me")
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Len(t, resp.Item.Actions, 1)
+
+		// The output key of the earlier attempt is handed out again
+		data, err := json.Marshal(resp.Item.Actions[0])
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"api_key":"output-key:secret"`)
+		assert.Equal(t, []string{"old-access-key"}, bulker.invalidated)
+	})
+
+	t.Run("no earlier attempt", func(t *testing.T) {
+		bulker := &enrollBulk{updates: map[string][]byte{}}
+		et := newEnroller(t, bulker)
+		rb := rollback.New(zerolog.Nop())
+
+		resp, err := et.replayEnrollment(context.Background(), rb, zerolog.Nop(), erec, req, "retry-me")
+		require.NoError(t, err)
+		assert.Nil(t, resp)
+		assert.Empty(t, bulker.updates)
+	})
+}
+
+type latestPolicyMonitor struct {
+	policy.Monitor
+	policies map[string]*policy.ParsedPolicy
+}
+
+func (m *latestPolicyMonitor) LatestPolicy(policyId string) (*policy.ParsedPolicy, bool) {
+	pp, ok := m.policies[policyId]
+	return pp, ok
+}
+
+const inlinePolicyData = `{
+	"id": "policy-id",
+	"outputs": {"default": {"type": "elasticsearch", "hosts": ["localhost:9200"]}},
+	"output_permissions": {"default": {"_fallback": {"indices": [{"names": ["logs-*"], "privileges": ["auto_configure"]}]}}}
+}`
+
+func TestPrepareInlinePolicy(t *testing.T) {
+	pp, err := policy.NewParsedPolicy(model.Policy{
+		PolicyId:       "policy-id",
+		RevisionIdx:    2,
+		CoordinatorIdx: 1,
+		Data:           json.RawMessage(inlinePolicyData),
+	})
+	require.NoError(t, err)
+	require.NotNil(t, pp.Default.Role)
+
+	pm := &latestPolicyMonitor{policies: map[string]*policy.ParsedPolicy{"policy-id": pp}}
+
+	t.Run("inline", func(t *testing.T) {
+		bulker := &enrollBulk{}
+		et := &EnrollerT{bulker: bulker, pm: pm}
+		rb := rollback.New(zerolog.Nop())
+
+		agent := model.Agent{PolicyId: "policy-id"}
+		agent.Id = "agent-id"
+
+		action, err := et.prepareInlinePolicy(context.Background(), rb, zerolog.Nop(), &agent)
+		require.NoError(t, err)
+		require.NotNil(t, action)
+
+		assert.Equal(t, TypePolicyChange, action.Type)
+		assert.Equal(t, "agent-id", action.AgentId)
+		assert.Equal(t, "policy:policy-id:2:1", action.Id)
+		assert.Equal(t, "new-access-key", agent.DefaultApiKeyId)
+		assert.Equal(t, "new-access-key:secret", agent.DefaultApiKey)
+		assert.Equal(t, pp.Default.Role.Sha2, agent.PolicyOutputPermissionsHash)
+
+		data, err := json.Marshal(action.Data)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"api_key":"new-access-key:secret"`)
+
+		// The output key is invalidated on rollback
+		require.NoError(t, rb.Rollback(context.Background()))
+		assert.Equal(t, []string{"new-access-key"}, bulker.invalidated)
+	})
+
+	t.Run("policy not loaded", func(t *testing.T) {
+		et := &EnrollerT{bulker: &enrollBulk{}, pm: pm}
+		rb := rollback.New(zerolog.Nop())
+
+		agent := model.Agent{PolicyId: "other-policy"}
+		agent.Id = "agent-id"
+
+		action, err := et.prepareInlinePolicy(context.Background(), rb, zerolog.Nop(), &agent)
+		require.NoError(t, err)
+		assert.Nil(t, action)
+		assert.Empty(t, agent.DefaultApiKeyId)
+	})
+}
+
+func TestCanReuseAgent(t *testing.T) {
+	erec := &model.EnrollmentApiKey{PolicyId: "policy-id"}
+	erec.Id = "enroll-key-id"
+
+	tests := []struct {
+		name  string
+		agent model.Agent
+		reuse bool
+	}{
+		{"inactive", model.Agent{Active: false, EnrollmentApiKeyId: "other-key-id", PolicyId: "other-policy"}, true},
+		{"unenrolled", model.Agent{Active: true, UnenrolledAt: "2021-06-01T00:00:00Z", EnrollmentApiKeyId: "other-key-id", PolicyId: "other-policy"}, true},
+		{"same enrollment key", model.Agent{Active: true, EnrollmentApiKeyId: "enroll-key-id", PolicyId: "other-policy"}, true},
+		{"same policy", model.Agent{Active: true, EnrollmentApiKeyId: "other-key-id", PolicyId: "policy-id"}, true},
+		{"other enrollment", model.Agent{Active: true, EnrollmentApiKeyId: "other-key-id", PolicyId: "other-policy"}, false},
+		{"no enrollment", model.Agent{Active: true}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.reuse, canReuseAgent(&tc.agent, erec, "policy-id"))
+		})
+	}
+}
+
+func TestEnrollSharedIdConflict(t *testing.T) {
+	victim := model.Agent{
+		Active:             true,
+		PolicyId:           "victim-policy",
+		EnrollmentApiKeyId: "victim-key-id",
+		AccessApiKeyId:     "victim-access-key",
+		SharedId:           "victim-shared-id",
+	}
+	victim.Id = "victim-agent-id"
+
+	bulker := &enrollBulk{
+		updates: map[string][]byte{},
+		indexed: map[string][]byte{},
+		agents:  []model.Agent{victim},
+	}
+	et := &EnrollerT{bulker: bulker}
+
+	erec := &model.EnrollmentApiKey{PolicyId: "attacker-policy"}
+	erec.Id = "attacker-key-id"
+
+	req := &EnrollRequest{Type: EnrollPermanent, SharedId: "victim-shared-id"}
+	req.Meta.Local = json.RawMessage(`{}`)
+
+	rb := rollback.New(zerolog.Nop())
+	_, err := et._enroll(context.Background(), rb, zerolog.Nop(), req, erec, "8.0.0", "")
+	require.ErrorIs(t, err, ErrSharedIdConflict)
+	assert.Equal(t, http.StatusConflict, NewErrorResp(err).StatusCode)
+
+	assert.Empty(t, bulker.updates)
+	assert.Empty(t, bulker.indexed)
+	assert.Empty(t, bulker.invalidated)
+}
@@ -0,0 +1,283 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	kStreamEventActions = "actions"
+	kStreamStatus       = "online"
+
+	// Standard header sent by the event source on reconnect
+	kLastEventIdHeader = "Last-Event-ID"
+)
+
+var ErrStreamUnsupported = errors.New("streaming unsupported")
+
+// Stream the actions and policy changes to the agent as server-sent events.
+// This is the alternative to the long poll checkin: the agent holds one
+// authenticated connection and actions are pushed as they are dispatched.
+// Each event carries a CheckinResponse; the id of the event is the ack token
+// so that a reconnecting agent resumes from the last actions it received.
+// Acks are still posted to the acks route.
+func (rt Router) handleStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	start := time.Now()
+
+	id := ps.ByName("id")
+
+	reqId := r.Header.Get(logger.HeaderRequestID)
+
+	zlog := log.With().
+		Str(LogAgentId, id).
+		Str(EcsHttpRequestId, reqId).
+		Logger()
+
+	err := rt.ct.handleStream(&zlog, w, r, id)
+
+	if err != nil {
+		cntStream.IncError(err)
+		resp := NewErrorResp(err)
+
+		zlog.WithLevel(resp.Level).
+			Err(err).
+			Int(EcsHttpResponseCode, resp.StatusCode).
+			Int64(EcsEventDuration, time.Since(start).Nanoseconds()).
+			Msg("fail stream")
+
+		if err := resp.Write(w); err != nil {
+			zlog.Error().Err(err).Msg("fail writing error response")
+		}
+	}
+}
+
+// Returns an error only if the stream could not be started; failures on an
+// established stream are logged and close the stream.
+func (ct *CheckinT) handleStream(zlog *zerolog.Logger, w http.ResponseWriter, r *http.Request, id string) error {
+
+	// A stream holds its slot until it ends
+	limitF, err := ct.streamLimit.Acquire()
+	if err != nil {
+		return err
+	}
+	defer limitF()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return ErrStreamUnsupported
+	}
+
+	agent, err := authAgent(r, &id, ct.bulker, ct.cache)
+	if err != nil {
+		return err
+	}
+
+	zlog.UpdateContext(func(ctx zerolog.Context) zerolog.Context {
+		return ctx.Str(LogAccessApiKeyId, agent.AccessApiKeyId)
+	})
+
+	ver, err := validateUserAgent(*zlog, r, ct.verCon)
+	if err != nil {
+		return err
+	}
+
+	newVer := agent.CheckDifferentVersion(ver)
+
+	dfunc := cntStream.IncStart()
+	defer dfunc()
+
+	// Resume from the last event the agent received, if any
+	ackToken := r.Header.Get(kLastEventIdHeader)
+	if ackToken == "" {
+		ackToken = r.URL.Query().Get("ack_token")
+	}
+
+	sse := &sseSender{w: w, flusher: flusher}
+
+	err = ct.stream(r.Context(), *zlog, agent, newVer, ackToken, sse)
+	if !sse.started {
+		return err
+	}
+
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		zlog.Debug().Msg("stream end")
+	default:
+		cntStream.IncError(err)
+		zlog.Warn().Err(err).Msg("stream closed on error")
+	}
+
+	return nil
+}
+
+// Delivers the events of an agent stream over the transport of the stream.
+type streamSender interface {
+	// Start is called once the stream is set up, before any event is sent.
+	Start() error
+	Send(actions []ActionResp, ackToken string) error
+	KeepAlive() error
+}
+
+// Stream the actions of the authenticated agent until the context is done or the stream expires.
+func (ct *CheckinT) stream(ctx context.Context, zlog zerolog.Logger, agent *model.Agent, ver, ackToken string, sender streamSender) error {
+
+	seqno, err := ct.resolveSeqNo(ctx, zlog, CheckinRequest{AckToken: ackToken}, agent)
+	if err != nil {
+		return err
+	}
+
+	aSub := ct.ad.Subscribe(agent.Id, seqno)
+	defer ct.ad.Unsubscribe(aSub)
+
+	pendingActions, err := ct.fetchAgentPendingActions(ctx, seqno, agent.Id)
+	if err != nil {
+		return err
+	}
+
+	ct.bc.Observe(agent.Id, agent.PolicyId, agent.LastCheckinStatus, agent.PolicyRevisionIdx)
+	ct.bc.CheckIn(agent.Id, kStreamStatus, nil, seqno, ver)
+
+	if err = sender.Start(); err != nil {
+		return err
+	}
+
+	zlog.Debug().Str("seqNo", seqno.String()).Msg("stream start")
+
+	return ct.runStream(ctx, zlog, sender, agent, ver, pendingActions, aSub.Ch())
+}
+
+func (ct *CheckinT) runStream(ctx context.Context, zlog zerolog.Logger, sender streamSender, agent *model.Agent, ver string, pending []model.Action, actCh chan []model.Action) error {
+
+	if len(pending) > 0 {
+		if err := ct.sendActions(ctx, zlog, sender, agent.Id, pending); err != nil {
+			return err
+		}
+	}
+
+	// Policy subscriptions fire once; subscribe again from each delivered revision
+	sub, err := ct.pm.Subscribe(agent.Id, agent.PolicyId, agent.PolicyRevisionIdx, agent.PolicyCoordinatorIdx)
+	if err != nil {
+		return errors.Wrap(err, "subscribe policy monitor")
+	}
+	defer func() {
+		ct.pm.Unsubscribe(sub)
+	}()
+
+	// The write timeout of the server bounds the lifetime of the stream
+	expire := time.NewTimer(ct.cfg.StreamDuration())
+	defer expire.Stop()
+
+	// Heartbeat the checkin and keep the connection alive
+	tick := time.NewTicker(ct.cfg.Timeouts.CheckinTimestamp)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-expire.C:
+			zlog.Trace().Msg("stream expired")
+			return nil
+		case acdocs := <-actCh:
+			if err := ct.sendActions(ctx, zlog, sender, agent.Id, acdocs); err != nil {
+				return err
+			}
+		case pp := <-sub.Output():
+			actionResp, err := processPolicy(ctx, zlog, ct.bulker, agent.Id, pp)
+			if err != nil {
+				return errors.Wrap(err, "processPolicy")
+			}
+			if err := sender.Send([]ActionResp{*actionResp}, ""); err != nil {
+				return err
+			}
+
+			ct.pm.Unsubscribe(sub)
+			sub, err = ct.pm.Subscribe(agent.Id, pp.Policy.PolicyId, pp.Policy.RevisionIdx, pp.Policy.CoordinatorIdx)
+			if err != nil {
+				return errors.Wrap(err, "subscribe policy monitor")
+			}
+		case <-tick.C:
+			ct.bc.CheckIn(agent.Id, kStreamStatus, nil, nil, ver)
+			if err := sender.KeepAlive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send the actions delivered to the agent, nothing is sent if neither the actions nor the ack token changed
+func (ct *CheckinT) sendActions(ctx context.Context, zlog zerolog.Logger, sender streamSender, agentId string, acdocs []model.Action) error {
+	actions, ackToken := ct.deliverActions(ctx, zlog, agentId, acdocs)
+	if len(actions) == 0 && ackToken == "" {
+		return nil
+	}
+	return sender.Send(actions, ackToken)
+}
+
+// Sends the stream as server-sent events
+type sseSender struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (s *sseSender) Start() error {
+	s.w.Header().Set("Content-Type", "text/event-stream")
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.WriteHeader(http.StatusOK)
+	s.flusher.Flush()
+	s.started = true
+	return nil
+}
+
+func (s *sseSender) Send(actions []ActionResp, ackToken string) error {
+	return writeStreamEvent(s.w, s.flusher, actions, ackToken)
+}
+
+func (s *sseSender) KeepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func writeStreamEvent(w http.ResponseWriter, flusher http.Flusher, actions []ActionResp, ackToken string) error {
+	payload, err := json.Marshal(&CheckinResponse{
+		AckToken: ackToken,
+		Action:   "checkin",
+		Actions:  actions,
+	})
+	if err != nil {
+		return errors.Wrap(err, "writeStreamEvent marshal")
+	}
+
+	if ackToken != "" {
+		if _, err = fmt.Fprintf(w, "id: %s\n", ackToken); err != nil {
+			return err
+		}
+	}
+	n, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kStreamEventActions, payload)
+	cntStream.bodyOut.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package fleet
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/action"
+	"github.com/elastic/fleet-server/v7/internal/pkg/checkin"
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/policy"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type streamSub struct {
+	ch chan *policy.ParsedPolicy
+}
+
+func (s *streamSub) Output() <-chan *policy.ParsedPolicy {
+	return s.ch
+}
+
+type streamPolicyMonitor struct {
+	policy.Monitor
+	sub *streamSub
+}
+
+func (m *streamPolicyMonitor) Subscribe(agentId string, policyId string, revisionIdx int64, coordinatorIdx int64) (policy.Subscription, error) {
+	return m.sub, nil
+}
+
+func (m *streamPolicyMonitor) Unsubscribe(sub policy.Subscription) error {
+	return nil
+}
+
+// Parse the data lines of the events in the stream
+func parseStreamEvents(t *testing.T, body string) (ids []string, resps []CheckinResponse) {
+	for _, block := range strings.Split(body, "\n\n") {
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ids = append(ids, strings.TrimPrefix(line, "id: "))
+			case strings.HasPrefix(line, "data: "):
+				var resp CheckinResponse
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &resp))
+				resps = append(resps, resp)
+			}
+		}
+	}
+	return ids, resps
+}
+
+func TestWriteStreamEvent(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	actions, ackToken := convertActions("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-id"}, ActionId: "1234", Type: "UPGRADE"}})
+	require.NoError(t, writeStreamEvent(w, w, actions, ackToken))
+
+	body := w.Body.String()
+	assert.True(t, w.Flushed)
+	assert.True(t, strings.HasPrefix(body, "id: doc-id\nevent: actions\ndata: "))
+	assert.True(t, strings.HasSuffix(body, "\n\n"))
+
+	ids, resps := parseStreamEvents(t, body)
+	assert.Equal(t, []string{"doc-id"}, ids)
+	require.Len(t, resps, 1)
+	assert.Equal(t, "doc-id", resps[0].AckToken)
+	assert.Equal(t, "checkin", resps[0].Action)
+	require.Len(t, resps[0].Actions, 1)
+	assert.Equal(t, "1234", resps[0].Actions[0].Id)
+	assert.Equal(t, "agent-id", resps[0].Actions[0].AgentId)
+}
+
+func TestRunStream(t *testing.T) {
+	var cfg config.Server
+	cfg.InitDefaults()
+	cfg.Stream.MaxDuration = 100 * time.Millisecond
+	cfg.Timeouts.CheckinTimestamp = 10 * time.Millisecond
+
+	bc := checkin.NewBulk(&ftesting.MockBulk{})
+	ct := &CheckinT{
+		cfg: &cfg,
+		bc:  bc,
+		ad:  action.NewDispatcher(nil),
+		pm:  &streamPolicyMonitor{sub: &streamSub{ch: make(chan *policy.ParsedPolicy)}},
+	}
+
+	actCh := make(chan []model.Action, 1)
+	actCh <- []model.Action{{ESDocument: model.ESDocument{Id: "doc-2"}, ActionId: "dispatched"}}
+
+	agent := &model.Agent{ESDocument: model.ESDocument{Id: "agent-id"}, PolicyId: "policy-id"}
+	pending := []model.Action{{ESDocument: model.ESDocument{Id: "doc-1"}, ActionId: "pending"}}
+
+	w := httptest.NewRecorder()
+	err := ct.runStream(context.Background(), zerolog.Nop(), &sseSender{w: w, flusher: w}, agent, "", pending, actCh)
+	require.NoError(t, err)
+
+	body := w.Body.String()
+	assert.Contains(t, body, ": keep-alive\n\n")
+
+	ids, resps := parseStreamEvents(t, body)
+	assert.Equal(t, []string{"doc-1", "doc-2"}, ids)
+	require.Len(t, resps, 2)
+	assert.Equal(t, "pending", resps[0].Actions[0].Id)
+	assert.Equal(t, "dispatched", resps[1].Actions[0].Id)
+}
+
+func TestRunStreamCancel(t *testing.T) {
+	var cfg config.Server
+	cfg.InitDefaults()
+
+	ct := &CheckinT{
+		cfg: &cfg,
+		bc:  checkin.NewBulk(&ftesting.MockBulk{}),
+		pm:  &streamPolicyMonitor{sub: &streamSub{ch: make(chan *policy.ParsedPolicy)}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	err := ct.runStream(ctx, zerolog.Nop(), &sseSender{w: w, flusher: w}, &model.Agent{}, "", nil, make(chan []model.Action))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, w.Body.String())
+}
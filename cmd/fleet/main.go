@@ -21,6 +21,7 @@ import (
 	apmtransport "go.elastic.co/apm/transport"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/action"
+	"github.com/elastic/fleet-server/v7/internal/pkg/admission"
 	"github.com/elastic/fleet-server/v7/internal/pkg/build"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/cache"
@@ -40,6 +41,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
 	"github.com/elastic/fleet-server/v7/internal/pkg/status"
 	"github.com/elastic/fleet-server/v7/internal/pkg/ver"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
 
 	"github.com/elastic/elastic-agent-client/v7/pkg/client"
 	"github.com/elastic/elastic-agent-client/v7/pkg/proto"
@@ -400,10 +402,12 @@ type FleetServer struct {
 	verCon   version.Constraints
 	policyId string
 
-	cfg      *config.Config
-	cfgCh    chan *config.Config
-	cache    cache.Cache
-	reporter status.Reporter
+	cfg       *config.Config
+	cfgCh     chan *config.Config
+	cache     cache.Cache
+	admission *admission.Admission
+	selector  *policy.Selector
+	reporter  status.Reporter
 }
 
 // NewFleetServer creates the actual fleet server service.
@@ -418,13 +422,25 @@ func NewFleetServer(cfg *config.Config, bi build.Info, reporter status.Reporter)
 		return nil, err
 	}
 
+	admit, err := admission.New(&cfg.Inputs[0].Admission)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := policy.NewSelector(&cfg.Inputs[0].PolicySelection)
+	if err != nil {
+		return nil, err
+	}
+
 	return &FleetServer{
-		bi:       bi,
-		verCon:   verCon,
-		cfg:      cfg,
-		cfgCh:    make(chan *config.Config, 1),
-		cache:    cache,
-		reporter: reporter,
+		bi:        bi,
+		verCon:    verCon,
+		cfg:       cfg,
+		cfgCh:     make(chan *config.Config, 1),
+		cache:     cache,
+		admission: admit,
+		selector:  selector,
+		reporter:  reporter,
 	}, nil
 }
 
@@ -493,6 +509,26 @@ LOOP:
 			}
 		}
 
+		// Swap in admission rules
+		if configAdmissionChanged(curCfg, newCfg) {
+			log.Info().Msg("reload admission rules on configuration change")
+			err := f.admission.Reload(ctx, newCfg)
+			log.Info().Err(err).Int("rules", len(newCfg.Inputs[0].Admission.Rules)).Msg("reload admission rules complete")
+			if err != nil {
+				return err
+			}
+		}
+
+		// Swap in policy selection rules
+		if configPolicySelectionChanged(curCfg, newCfg) {
+			log.Info().Msg("reload policy selection rules on configuration change")
+			err := f.selector.Reload(ctx, newCfg)
+			log.Info().Err(err).Int("rules", len(newCfg.Inputs[0].PolicySelection.Rules)).Msg("reload policy selection rules complete")
+			if err != nil {
+				return err
+			}
+		}
+
 		// Start or restart profiler
 		if configChangedProfiler(curCfg, newCfg) {
 			if proCancel != nil {
@@ -646,6 +682,20 @@ func configCacheChanged(curCfg, newCfg *config.Config) bool {
 	return curCfg.Inputs[0].Cache != newCfg.Inputs[0].Cache
 }
 
+func configAdmissionChanged(curCfg, newCfg *config.Config) bool {
+	if curCfg == nil {
+		return false
+	}
+	return !reflect.DeepEqual(curCfg.Inputs[0].Admission, newCfg.Inputs[0].Admission)
+}
+
+func configPolicySelectionChanged(curCfg, newCfg *config.Config) bool {
+	if curCfg == nil {
+		return false
+	}
+	return !reflect.DeepEqual(curCfg.Inputs[0].PolicySelection, newCfg.Inputs[0].PolicySelection)
+}
+
 func safeWait(g *errgroup.Group, to time.Duration) (err error) {
 	waitCh := make(chan error)
 	go func() {
@@ -825,7 +875,24 @@ func (f *FleetServer) runSubsystems(ctx context.Context, cfg *config.Config, g *
 	}
 
 	g.Go(loggedRunFunc(ctx, "Policy index monitor", pim.Run))
-	cord := coordinator.NewMonitor(cfg.Fleet, f.bi.Version, bulker, pim, coordinator.NewCoordinatorZero)
+	// Webhook notifications of the agent lifecycle events
+	var wh *webhook.Dispatcher
+	if whCfg := &cfg.Inputs[0].Server.Webhooks; len(whCfg.Endpoints) > 0 {
+		if wh, err = webhook.New(whCfg); err != nil {
+			return err
+		}
+		g.Go(loggedRunFunc(ctx, "Webhooks", wh.Run))
+	}
+
+	cordOpts := []coordinator.Opt{coordinator.WithNotifier(wh)}
+	if statusCfg := &cfg.Inputs[0].Server.AgentStatus; statusCfg.Enabled {
+		cordOpts = append(cordOpts, coordinator.WithAgentStatus(
+			statusCfg.OfflineTimeout(cfg.Inputs[0].Server.Timeouts),
+			statusCfg.InactiveTimeout,
+			statusCfg.CheckInterval,
+		))
+	}
+	cord := coordinator.NewMonitor(cfg.Fleet, f.bi.Version, bulker, pim, coordinator.NewCoordinatorZero, cordOpts...)
 	g.Go(loggedRunFunc(ctx, "Coordinator policy monitor", cord.Run))
 
 	// Policy monitor
@@ -858,17 +925,40 @@ func (f *FleetServer) runSubsystems(ctx context.Context, cfg *config.Config, g *
 		return err
 	}
 
-	bc := checkin.NewBulk(bulker)
+	// Status history retention; the template is left as is when privileges are missing
+	shCfg := &cfg.Inputs[0].Server.StatusHistory
+	if err := es.EnsureDataStreamTemplate(ctx, esCli, dl.FleetAgentStatusHistory, es.MappingAgentStatusHistory, shCfg.Retention); err != nil {
+		log.Warn().Err(err).Str("index", dl.FleetAgentStatusHistory).Msg("failed to install agent status history template")
+	}
+
+	bc := checkin.NewBulk(bulker, checkin.WithStateTTL(shCfg.StateTTL))
 	g.Go(loggedRunFunc(ctx, "Bulk checkin", bc.Run))
 
-	ct := NewCheckinT(f.verCon, &cfg.Inputs[0].Server, f.cache, bc, pm, am, ad, tr, bulker)
-	et, err := NewEnrollerT(f.verCon, &cfg.Inputs[0].Server, bulker, f.cache)
+	evCfg := &cfg.Inputs[0].Server.Events
+	if evCfg.Enabled {
+		if err := es.EnsureDataStreamTemplate(ctx, esCli, dl.FleetAgentEvents, es.MappingAgentEvent, evCfg.Retention); err != nil {
+			log.Warn().Err(err).Str("index", dl.FleetAgentEvents).Msg("failed to install agent events template")
+		}
+	}
+	ev := checkin.NewEvents(bulker, evCfg.QueueSize, evCfg.FlushInterval)
+	g.Go(loggedRunFunc(ctx, "Agent events", ev.Run))
+
+	// Action status is written by fleet-server only; install its mapping before the first write
+	if err := es.EnsureIndexTemplate(ctx, esCli, dl.FleetActionsStatus, es.MappingActionStatus); err != nil {
+		log.Warn().Err(err).Str("index", dl.FleetActionsStatus).Msg("failed to install action status template")
+	}
+
+	as := action.NewStatusBulk(bulker, 0)
+	g.Go(loggedRunFunc(ctx, "Action status", as.Run))
+
+	ct := NewCheckinT(f.verCon, &cfg.Inputs[0].Server, f.cache, bc, ev, as, pm, am, ad, tr, bulker)
+	et, err := NewEnrollerT(f.verCon, &cfg.Inputs[0].Server, bulker, f.cache, pm, f.admission, f.selector, wh)
 	if err != nil {
 		return err
 	}
 
-	at := NewArtifactT(&cfg.Inputs[0].Server, bulker, f.cache)
-	ack := NewAckT(&cfg.Inputs[0].Server, bulker, f.cache)
+	at := NewArtifactT(&cfg.Inputs[0].Server, bulker, f.cache, pm)
+	ack := NewAckT(&cfg.Inputs[0].Server, bulker, f.cache, wh, as)
 
 	router := NewRouter(ctx, bulker, ct, et, at, ack, sm, tracer)
 
@@ -876,6 +966,13 @@ func (f *FleetServer) runSubsystems(ctx context.Context, cfg *config.Config, g *
 		return runServer(ctx, router, &cfg.Inputs[0].Server)
 	}))
 
+	if cfg.Inputs[0].Server.GRPC.Enabled {
+		srv := NewGRPCServer(ctx, ct, et, at, ack)
+		g.Go(loggedRunFunc(ctx, "gRPC server", func(ctx context.Context) error {
+			return runGRPCServer(ctx, srv, &cfg.Inputs[0].Server)
+		}))
+	}
+
 	return err
 }
 
@@ -6,11 +6,13 @@ package fleet
 
 import (
 	"context"
+	"sync"
 
 	"github.com/elastic/beats/v7/libbeat/api"
 	"github.com/elastic/beats/v7/libbeat/cmd/instance/metrics"
 	"github.com/elastic/beats/v7/libbeat/common"
 	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/fleet-server/v7/internal/pkg/admission"
 	"github.com/elastic/fleet-server/v7/internal/pkg/config"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/limit"
@@ -25,11 +27,18 @@ var (
 	cntHttpNew   *monitoring.Uint
 	cntHttpClose *monitoring.Uint
 
-	cntCheckin   routeStats
-	cntEnroll    routeStats
+	cntCheckin   checkinStats
+	cntEnroll    enrollStats
 	cntAcks      routeStats
 	cntStatus    routeStats
+	cntStream    routeStats
 	cntArtifacts artifactStats
+
+	cntCompressGzip   compressionStats
+	cntCompressZstd   compressionStats
+	cntCompressBrotli compressionStats
+
+	cntPolicyApplyFailed policyStats
 )
 
 func (f *FleetServer) initMetrics(ctx context.Context, cfg *config.Config) (*api.Server, error) {
@@ -70,6 +79,9 @@ type routeStats struct {
 	drop      *monitoring.Uint
 	bodyIn    *monitoring.Uint
 	bodyOut   *monitoring.Uint
+
+	// Request bodies once decoded; equal to bodyIn for unencoded bodies
+	bodyInDecoded *monitoring.Uint
 }
 
 func (rt *routeStats) Register(registry *monitoring.Registry) {
@@ -81,6 +93,7 @@ func (rt *routeStats) Register(registry *monitoring.Registry) {
 	rt.drop = monitoring.NewUint(registry, "drop")
 	rt.bodyIn = monitoring.NewUint(registry, "body_in")
 	rt.bodyOut = monitoring.NewUint(registry, "body_out")
+	rt.bodyInDecoded = monitoring.NewUint(registry, "body_in_decoded")
 }
 
 func init() {
@@ -96,6 +109,15 @@ func init() {
 	cntArtifacts.Register(routesRegistry.NewRegistry("artifacts"))
 	cntAcks.Register(routesRegistry.NewRegistry("acks"))
 	cntStatus.Register(routesRegistry.NewRegistry("status"))
+	cntStream.Register(routesRegistry.NewRegistry("stream"))
+
+	compressionRegistry := registry.NewRegistry("compression")
+
+	cntCompressGzip.Register(compressionRegistry.NewRegistry(kEncodingGzip))
+	cntCompressZstd.Register(compressionRegistry.NewRegistry(kEncodingZstd))
+	cntCompressBrotli.Register(compressionRegistry.NewRegistry(kEncodingBrotli))
+
+	cntPolicyApplyFailed.Register(registry, "policy_apply_failed")
 }
 
 func (rt *routeStats) IncError(err error) {
@@ -120,14 +142,16 @@ func (rt *routeStats) IncStart() func() {
 
 type artifactStats struct {
 	routeStats
-	notFound *monitoring.Uint
-	throttle *monitoring.Uint
+	notFound  *monitoring.Uint
+	throttle  *monitoring.Uint
+	forbidden *monitoring.Uint
 }
 
 func (rt *artifactStats) Register(registry *monitoring.Registry) {
 	rt.routeStats.Register(registry)
 	rt.notFound = monitoring.NewUint(registry, "not_found")
 	rt.throttle = monitoring.NewUint(registry, "throttle")
+	rt.forbidden = monitoring.NewUint(registry, "forbidden")
 }
 
 func (rt *artifactStats) IncError(err error) {
@@ -136,7 +160,110 @@ func (rt *artifactStats) IncError(err error) {
 		rt.notFound.Inc()
 	case errors.Is(err, ErrorThrottle):
 		rt.throttle.Inc()
+	case errors.Is(err, ErrorForbidden):
+		rt.forbidden.Inc()
 	default:
 		rt.routeStats.IncError(err)
 	}
 }
+
+type checkinStats struct {
+	routeStats
+	eventsIn       *monitoring.Uint
+	eventsDropped  *monitoring.Uint
+	eventsOversize *monitoring.Uint
+}
+
+func (rt *checkinStats) Register(registry *monitoring.Registry) {
+	rt.routeStats.Register(registry)
+	rt.eventsIn = monitoring.NewUint(registry, "events_in")
+	rt.eventsDropped = monitoring.NewUint(registry, "events_dropped")
+	rt.eventsOversize = monitoring.NewUint(registry, "events_oversize")
+}
+
+type enrollStats struct {
+	routeStats
+	denied *monitoring.Uint
+}
+
+func (rt *enrollStats) Register(registry *monitoring.Registry) {
+	rt.routeStats.Register(registry)
+	rt.denied = monitoring.NewUint(registry, "denied")
+}
+
+func (rt *enrollStats) IncError(err error) {
+	switch {
+	case errors.Is(err, admission.ErrDenied):
+		rt.denied.Inc()
+	default:
+		rt.routeStats.IncError(err)
+	}
+}
+
+type compressionStats struct {
+	srcBytes *monitoring.Uint
+	dstBytes *monitoring.Uint
+	ratio    *monitoring.Float
+}
+
+func (cs *compressionStats) Register(registry *monitoring.Registry) {
+	cs.srcBytes = monitoring.NewUint(registry, "src_bytes")
+	cs.dstBytes = monitoring.NewUint(registry, "dst_bytes")
+	cs.ratio = monitoring.NewFloat(registry, "ratio")
+}
+
+// Observe an encoded payload; the ratio is computed over all the payloads encoded by the codec.
+func (cs *compressionStats) Observe(srcSz, dstSz uint64) {
+	cs.srcBytes.Add(srcSz)
+	cs.dstBytes.Add(dstSz)
+
+	if dst := cs.dstBytes.Get(); dst > 0 {
+		cs.ratio.Set(float64(cs.srcBytes.Get()) / float64(dst))
+	}
+}
+
+// Count the request body read on the wire and once decoded
+func (rt *routeStats) AddBodyIn(body *requestBody) {
+	wire, decoded := body.Count()
+	rt.bodyIn.Add(wire)
+	rt.bodyInDecoded.Add(decoded)
+}
+
+// Counters keyed by policy id. Policy ids are not valid registry names,
+// so the counters are reported as one object.
+type policyStats struct {
+	mut    sync.Mutex
+	counts map[string]int64
+}
+
+func (ps *policyStats) Register(registry *monitoring.Registry, name string) {
+	monitoring.NewFunc(registry, name, ps.report, monitoring.Report)
+}
+
+func (ps *policyStats) Inc(policyId string) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	if ps.counts == nil {
+		ps.counts = make(map[string]int64)
+	}
+	ps.counts[policyId]++
+}
+
+func (ps *policyStats) Get(policyId string) int64 {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+	return ps.counts[policyId]
+}
+
+func (ps *policyStats) report(_ monitoring.Mode, v monitoring.Visitor) {
+	ps.mut.Lock()
+	defer ps.mut.Unlock()
+
+	v.OnRegistryStart()
+	defer v.OnRegistryFinished()
+
+	for policyId, n := range ps.counts {
+		monitoring.ReportInt(v, policyId, n)
+	}
+}
@@ -22,6 +22,7 @@ const (
 	ROUTE_ENROLL    = "/api/fleet/agents/:id"
 	ROUTE_CHECKIN   = "/api/fleet/agents/:id/checkin"
 	ROUTE_ACKS      = "/api/fleet/agents/:id/acks"
+	ROUTE_STREAM    = "/api/fleet/agents/:id/stream"
 	ROUTE_ARTIFACTS = "/api/fleet/artifacts/:id/:sha2"
 )
 
@@ -48,11 +49,13 @@ func NewRouter(ctx context.Context, bulker bulk.Bulk, ct *CheckinT, et *Enroller
 		ack:    ack,
 	}
 
-	routes := []struct {
+	type route struct {
 		method  string
 		path    string
 		handler httprouter.Handle
-	}{
+	}
+
+	routes := []route{
 		{
 			http.MethodGet,
 			ROUTE_STATUS,
@@ -80,6 +83,15 @@ func NewRouter(ctx context.Context, bulker bulk.Bulk, ct *CheckinT, et *Enroller
 		},
 	}
 
+	// Opt-in streaming alternative to the long poll checkin
+	if ct != nil && ct.cfg.Stream.Enabled {
+		routes = append(routes, route{
+			http.MethodGet,
+			ROUTE_STREAM,
+			r.handleStream,
+		})
+	}
+
 	router := httprouter.New()
 
 	// Install routes
@@ -48,6 +48,7 @@ type EnrollRequest struct {
 	Meta     struct {
 		User  json.RawMessage `json:"user_provided"`
 		Local json.RawMessage `json:"local"`
+		Tags  []string        `json:"tags"`
 	} `json:"metadata"`
 }
 
@@ -59,6 +60,7 @@ type EnrollResponseItem struct {
 	EnrolledAt     string          `json:"enrolled_at"`
 	UserMeta       json.RawMessage `json:"user_provided_metadata"`
 	LocalMeta      json.RawMessage `json:"local_metadata"`
+	Tags           []string        `json:"tags,omitempty"`
 	Actions        []interface{}   `json:"actions"`
 	AccessApiKeyId string          `json:"access_api_key_id"`
 	AccessAPIKey   string          `json:"access_api_key"`
@@ -89,6 +91,15 @@ type AckRequest struct {
 
 type AckResponse struct {
 	Action string `json:"action"`
+	// Set if the ack of any event failed
+	Errors bool `json:"errors,omitempty"`
+	// Result of the ack of each event, in the order of the events of the request
+	Items []AckResponseItem `json:"items,omitempty"`
+}
+
+type AckResponseItem struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
 }
 
 type ActionResp struct {
@@ -119,6 +130,13 @@ type Event struct {
 	Error          string          `json:"error,omitempty"`
 }
 
+// EventDoc is an agent event enriched for the agent events data stream.
+type EventDoc struct {
+	Event
+	Timestamp         string `json:"@timestamp"`
+	PolicyRevisionIdx int64  `json:"policy_revision_idx"`
+}
+
 type StatusResponse struct {
 	Name   string `json:"name"`
 	Status string `json:"status"`
@@ -42,8 +42,8 @@ func TestRunServer(t *testing.T) {
 	pim := mock.NewMockIndexMonitor()
 	pm := policy.NewMonitor(bulker, pim, 5*time.Millisecond)
 	bc := checkin.NewBulk(nil)
-	ct := NewCheckinT(verCon, cfg, c, bc, pm, nil, nil, nil, nil)
-	et, err := NewEnrollerT(verCon, cfg, nil, c)
+	ct := NewCheckinT(verCon, cfg, c, bc, nil, nil, pm, nil, nil, nil, nil)
+	et, err := NewEnrollerT(verCon, cfg, nil, c, nil, nil, nil, nil)
 	require.NoError(t, err)
 
 	router := NewRouter(ctx, bulker, ct, et, nil, nil, nil, nil)
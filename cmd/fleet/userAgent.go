@@ -59,8 +59,11 @@ func maximizePatch(ver *version.Version) string {
 // validateUserAgent validates that the User-Agent of the connecting Elastic Agent is valid and that the version is
 // supported for this Fleet Server.
 func validateUserAgent(zlog zerolog.Logger, r *http.Request, verConst version.Constraints) (string, error) {
-	userAgent := r.Header.Get("User-Agent")
+	return checkUserAgent(zlog, r.Header.Get("User-Agent"), verConst)
+}
 
+// checkUserAgent validates the User-Agent value independently of the transport it was received on.
+func checkUserAgent(zlog zerolog.Logger, userAgent string, verConst version.Constraints) (string, error) {
 	zlog = zlog.With().Str("userAgent", userAgent).Logger()
 
 	if userAgent == "" {
@@ -6,7 +6,9 @@ package action
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/es"
 	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
@@ -27,17 +29,52 @@ func (s Sub) Ch() chan []model.Action {
 	return s.ch
 }
 
+// Grace period past the rollout slot of the held actions, for the agent to fetch them
+const kSentGrace = 5 * time.Minute
+
+// Actions of a subscribed agent held until their rollout slot, in sequence order
+type heldT struct {
+	actions []model.Action
+	at      time.Time
+	timer   *time.Timer
+}
+
+// Actions sent to an agent past its held actions, kept until the held actions are due
+type sentT struct {
+	ids   map[string]struct{}
+	token string
+	seqNo int64
+	until time.Time
+}
+
+func (s *sentT) contains(id string) bool {
+	_, ok := s.ids[id]
+	return ok
+}
+
+func (s *sentT) add(action model.Action) {
+	s.ids[action.Id] = struct{}{}
+	if action.SeqNo >= s.seqNo {
+		s.token = action.Id
+		s.seqNo = action.SeqNo
+	}
+}
+
 type Dispatcher struct {
 	am monitor.SimpleMonitor
 
-	mx   sync.RWMutex
+	mx   sync.Mutex
 	subs map[string]Sub
+	held map[string]*heldT
+	sent map[string]*sentT
 }
 
 func NewDispatcher(am monitor.SimpleMonitor) *Dispatcher {
 	return &Dispatcher{
 		am:   am,
 		subs: make(map[string]Sub),
+		held: make(map[string]*heldT),
+		sent: make(map[string]*sentT),
 	}
 }
 
@@ -63,6 +100,7 @@ func (d *Dispatcher) Subscribe(agentId string, seqNo sqn.SeqNo) *Sub {
 
 	d.mx.Lock()
 	d.subs[agentId] = sub
+	d.dropHeld(agentId)
 	sz := len(d.subs)
 	d.mx.Unlock()
 
@@ -78,6 +116,7 @@ func (d *Dispatcher) Unsubscribe(sub *Sub) {
 
 	d.mx.Lock()
 	delete(d.subs, sub.agentId)
+	d.dropHeld(sub.agentId)
 	sz := len(d.subs)
 	d.mx.Unlock()
 
@@ -88,6 +127,8 @@ func (d *Dispatcher) process(ctx context.Context, hits []es.HitT) {
 	// Parse hits into map of agent -> actions
 	// Actions are ordered by sequence
 
+	// Expired actions are dispatched too; the subscribers record them as expired
+	// for the agent instead of sending them.
 	agentActions := make(map[string][]model.Action)
 	for _, hit := range hits {
 		var action model.Action
@@ -110,19 +151,105 @@ func (d *Dispatcher) process(ctx context.Context, hits []es.HitT) {
 	}
 }
 
-func (d *Dispatcher) getSub(agentId string) (Sub, bool) {
-	d.mx.RLock()
-	sub, ok := d.subs[agentId]
-	d.mx.RUnlock()
-	return sub, ok
+// Hold the actions of the subscribed agent until their rollout slot.
+// The actions are dispatched to the agent subscription once due.
+func (d *Dispatcher) Hold(agentId string, actions []model.Action) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.dispatchLocked(agentId, actions)
 }
 
 func (d *Dispatcher) dispatch(ctx context.Context, agentId string, acdocs []model.Action) {
-	sub, ok := d.getSub(agentId)
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	d.dispatchLocked(agentId, acdocs)
+}
+
+// Deliver returns the actions to send to the agent and its ack token.
+// The ack token never moves past an action held for the agent, so that the agent fetches it
+// again. The actions sent past it are remembered and not sent again until the token moves past them.
+func (d *Dispatcher) Deliver(agentId string, actions []model.Action) ([]model.Action, string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	now := time.Now()
+	d.pruneSent(now)
+
+	s := d.sent[agentId]
+
+	send := make([]model.Action, 0, len(actions))
+	for _, action := range actions {
+		if s != nil && s.contains(action.Id) {
+			continue
+		}
+		send = append(send, action)
+	}
+
+	h, ok := d.held[agentId]
+	if !ok {
+		delete(d.sent, agentId)
+
+		token := lastToken(actions)
+		if s != nil && (len(actions) == 0 || s.seqNo > actions[len(actions)-1].SeqNo) {
+			token = s.token
+		}
+		return send, token
+	}
+
+	var token string
+	heldSeqNo := h.actions[0].SeqNo
+	for _, action := range actions {
+		if action.SeqNo < heldSeqNo {
+			token = action.Id
+			continue
+		}
+		if s == nil {
+			s = &sentT{ids: make(map[string]struct{})}
+			d.sent[agentId] = s
+		}
+		s.add(action)
+	}
+
+	if s != nil {
+		s.until = now.Add(kSentGrace)
+		for _, action := range h.actions {
+			if at, ok := DeliveryTime(action, agentId); ok && at.Add(kSentGrace).After(s.until) {
+				s.until = at.Add(kSentGrace)
+			}
+		}
+	}
+
+	return send, token
+}
+
+// Dispatch the actions due to the agent subscription and hold the others.
+// Actions not scheduled are dispatched even if held actions precede them.
+func (d *Dispatcher) dispatchLocked(agentId string, acdocs []model.Action) {
+
+	// WARNING: Expects mutex locked.
+	sub, ok := d.subs[agentId]
 	if !ok {
 		log.Debug().Str(logger.AgentId, agentId).Msg("Agent is not currently connected. Not dispatching actions.")
 		return
 	}
+
+	acdocs, held, at := SplitHeld(agentId, acdocs, time.Now())
+	if len(held) > 0 {
+		log.Debug().
+			Str(logger.AgentId, agentId).
+			Int("cnt", len(held)).
+			Time("until", at).
+			Msg("Holding actions until rollout slot")
+
+		d.holdLocked(agentId, held, at)
+	}
+
+	if len(acdocs) == 0 {
+		return
+	}
+
 	select {
 	case sub.Ch() <- acdocs:
 	default:
@@ -132,3 +259,79 @@ func (d *Dispatcher) dispatch(ctx context.Context, agentId string, acdocs []mode
 		// It is safe to drop them since the agent already has actions and will come around on the next check-in to pick up these new actions.
 	}
 }
+
+func (d *Dispatcher) holdLocked(agentId string, actions []model.Action, at time.Time) {
+
+	// WARNING: Expects mutex locked.
+	h, ok := d.held[agentId]
+	if !ok {
+		d.held[agentId] = &heldT{
+			actions: actions,
+			at:      at,
+			timer:   time.AfterFunc(time.Until(at), func() { d.release(agentId) }),
+		}
+		return
+	}
+
+	for _, action := range actions {
+		if !containsAction(h.actions, action.Id) {
+			h.actions = append(h.actions, action)
+		}
+	}
+	sort.Slice(h.actions, func(i, j int) bool { return h.actions[i].SeqNo < h.actions[j].SeqNo })
+
+	if at.Before(h.at) {
+		h.at = at
+		h.timer.Reset(time.Until(at))
+	}
+}
+
+// Dispatch the held actions of the agent once the first is due; the others are held again.
+func (d *Dispatcher) release(agentId string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	h, ok := d.held[agentId]
+	if !ok {
+		return
+	}
+	delete(d.held, agentId)
+
+	d.dispatchLocked(agentId, h.actions)
+}
+
+// Forget the actions sent past the held actions of agents no longer seen
+func (d *Dispatcher) pruneSent(now time.Time) {
+
+	// WARNING: Expects mutex locked.
+	for agentId, s := range d.sent {
+		if now.After(s.until) {
+			delete(d.sent, agentId)
+		}
+	}
+}
+
+func lastToken(actions []model.Action) string {
+	if sz := len(actions); sz > 0 {
+		return actions[sz-1].Id
+	}
+	return ""
+}
+
+func containsAction(actions []model.Action, id string) bool {
+	for _, action := range actions {
+		if action.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dispatcher) dropHeld(agentId string) {
+
+	// WARNING: Expects mutex locked.
+	if h, ok := d.held[agentId]; ok {
+		h.timer.Stop()
+		delete(d.held, agentId)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func actionHit(t *testing.T, action model.Action) es.HitT {
+	t.Helper()
+
+	body, err := json.Marshal(action)
+	require.NoError(t, err)
+	return es.HitT{Id: action.ActionId, SeqNo: action.SeqNo, Source: body}
+}
+
+func TestDispatcherDispatchesExpired(t *testing.T) {
+	d := NewDispatcher(nil)
+	sub := d.Subscribe("agent-id", nil)
+	defer d.Unsubscribe(sub)
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// Expired actions are left to the subscriber to record as expired
+	d.process(context.Background(), []es.HitT{
+		actionHit(t, model.Action{ActionId: "expired", Agents: []string{"agent-id"}, Expiration: past}),
+		actionHit(t, model.Action{ActionId: "live", Agents: []string{"agent-id"}, Expiration: future}),
+	})
+
+	select {
+	case actions := <-sub.Ch():
+		require.Len(t, actions, 2)
+		assert.Equal(t, "expired", actions[0].ActionId)
+		assert.Equal(t, "live", actions[1].ActionId)
+	default:
+		t.Fatal("actions not dispatched")
+	}
+}
+
+func TestDispatcherHoldsScheduled(t *testing.T) {
+	d := NewDispatcher(nil)
+	sub := d.Subscribe("agent-id", nil)
+	defer d.Unsubscribe(sub)
+
+	startTime := time.Now().Add(200 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+
+	d.process(context.Background(), []es.HitT{
+		actionHit(t, model.Action{ESDocument: model.ESDocument{SeqNo: 1}, ActionId: "scheduled", Agents: []string{"agent-id"}, StartTime: startTime}),
+	})
+
+	assert.Equal(t, []int64{1}, heldSeqNos(d, "agent-id"))
+
+	// Not queued behind the held action
+	d.process(context.Background(), []es.HitT{
+		actionHit(t, model.Action{ESDocument: model.ESDocument{SeqNo: 2}, ActionId: "unscheduled", Agents: []string{"agent-id"}}),
+	})
+
+	select {
+	case actions := <-sub.Ch():
+		require.Len(t, actions, 1)
+		assert.Equal(t, "unscheduled", actions[0].ActionId)
+	default:
+		t.Fatal("unscheduled action not dispatched")
+	}
+
+	select {
+	case actions := <-sub.Ch():
+		require.Len(t, actions, 1)
+		assert.Equal(t, "scheduled", actions[0].ActionId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("held action not dispatched")
+	}
+
+	assert.Empty(t, heldSeqNos(d, "agent-id"))
+}
+
+func TestDispatcherHoldsEach(t *testing.T) {
+	d := NewDispatcher(nil)
+	sub := d.Subscribe("agent-id", nil)
+	defer d.Unsubscribe(sub)
+
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	sooner := time.Now().Add(200 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+
+	d.Hold("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-1", SeqNo: 1}, ActionId: "later", StartTime: later}})
+	d.Hold("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-2", SeqNo: 2}, ActionId: "sooner", StartTime: sooner}})
+
+	// Released once the sooner slot is due, the later action is held again
+	select {
+	case actions := <-sub.Ch():
+		require.Len(t, actions, 1)
+		assert.Equal(t, "sooner", actions[0].ActionId)
+	case <-time.After(5 * time.Second):
+		t.Fatal("held action not dispatched")
+	}
+
+	assert.Equal(t, []int64{1}, heldSeqNos(d, "agent-id"))
+}
+
+func TestDispatcherDeliver(t *testing.T) {
+	d := NewDispatcher(nil)
+	sub := d.Subscribe("agent-id", nil)
+	defer d.Unsubscribe(sub)
+
+	// Nothing held, the token moves past all the actions
+	send, token := d.Deliver("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-1", SeqNo: 1}}})
+	assert.Len(t, send, 1)
+	assert.Equal(t, "doc-1", token)
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	d.Hold("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-3", SeqNo: 3}, StartTime: future}})
+
+	// Sent around the held action, the token stays below it
+	actions := []model.Action{
+		{ESDocument: model.ESDocument{Id: "doc-2", SeqNo: 2}},
+		{ESDocument: model.ESDocument{Id: "doc-4", SeqNo: 4}},
+	}
+	send, token = d.Deliver("agent-id", actions)
+	assert.Equal(t, actions, send)
+	assert.Equal(t, "doc-2", token)
+
+	// Fetched again past the token, the action is not sent again
+	send, token = d.Deliver("agent-id", actions[1:])
+	assert.Empty(t, send)
+	assert.Equal(t, "", token)
+
+	// Kept across subscriptions
+	d.Unsubscribe(sub)
+	sub = d.Subscribe("agent-id", nil)
+	d.Hold("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-3", SeqNo: 3}, StartTime: future}})
+
+	send, _ = d.Deliver("agent-id", actions[1:])
+	assert.Empty(t, send)
+
+	// Once the held action is due, the token moves past the actions sent before it
+	d.mx.Lock()
+	d.dropHeld("agent-id")
+	d.mx.Unlock()
+
+	send, token = d.Deliver("agent-id", []model.Action{{ESDocument: model.ESDocument{Id: "doc-3", SeqNo: 3}}, actions[1]})
+	require.Len(t, send, 1)
+	assert.Equal(t, "doc-3", send[0].Id)
+	assert.Equal(t, "doc-4", token)
+
+	d.mx.Lock()
+	assert.Empty(t, d.sent)
+	d.mx.Unlock()
+}
+
+func heldSeqNos(d *Dispatcher, agentId string) []int64 {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	var seqNos []int64
+	if h, ok := d.held[agentId]; ok {
+		for _, action := range h.actions {
+			seqNos = append(seqNos, action.SeqNo)
+		}
+	}
+	return seqNos
+}
+
+func TestDispatcherUnsubscribeDropsHeld(t *testing.T) {
+	d := NewDispatcher(nil)
+	sub := d.Subscribe("agent-id", nil)
+
+	startTime := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	d.Hold("agent-id", []model.Action{{ActionId: "scheduled", StartTime: startTime}})
+
+	d.mx.Lock()
+	assert.Len(t, d.held, 1)
+	d.mx.Unlock()
+
+	d.Unsubscribe(sub)
+
+	d.mx.Lock()
+	assert.Empty(t, d.held)
+	d.mx.Unlock()
+}
@@ -0,0 +1,26 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package action
+
+import (
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// Expired returns true if the expiration of the action is past.
+// Actions without a valid expiration do not expire.
+func Expired(action model.Action, now time.Time) bool {
+	if action.Expiration == "" {
+		return false
+	}
+
+	exp, err := time.Parse(time.RFC3339, action.Expiration)
+	if err != nil {
+		return false
+	}
+
+	return !now.Before(exp)
+}
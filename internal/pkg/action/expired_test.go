@@ -0,0 +1,39 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package action
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expiration string
+		expired    bool
+	}{
+		{"", false},
+		{"bogus", false},
+		{"2021-09-01T09:59:59Z", true},
+		{"2021-09-01T10:00:00Z", true},
+		{"2021-09-01T10:00:01Z", false},
+		{"2021-09-01T12:00:00+02:00", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.expiration, func(t *testing.T) {
+			assert.Equal(t, tc.expired, Expired(model.Action{Expiration: tc.expiration}, now))
+		})
+	}
+}
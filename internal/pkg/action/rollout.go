@@ -0,0 +1,63 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package action
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+// DeliveryTime returns the time the action is delivered to the agent. The delivery starts at
+// the start time of the action, the creation time if not set, and is spread over the rollout
+// duration; the slot of each agent is derived from a hash of the agent id.
+// Returns false if the delivery of the action is not scheduled.
+func DeliveryTime(action model.Action, agentId string) (time.Time, bool) {
+	if action.StartTime == "" && action.RolloutDuration <= 0 {
+		return time.Time{}, false
+	}
+
+	start := action.StartTime
+	if start == "" {
+		start = action.Timestamp
+	}
+
+	t, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if action.RolloutDuration > 0 {
+		window := time.Duration(action.RolloutDuration) * time.Second
+
+		h := fnv.New64a()
+		h.Write([]byte(agentId))
+		t = t.Add(time.Duration(h.Sum64() % uint64(window)))
+	}
+
+	return t, true
+}
+
+// SplitHeld splits the actions of the agent not yet due for delivery from the others.
+// Only the scheduled actions are held, the actions after them are delivered in sequence.
+// Returns the time the first held action is due.
+func SplitHeld(agentId string, actions []model.Action, now time.Time) (ready, held []model.Action, at time.Time) {
+	for _, action := range actions {
+		// Expired actions are delivered as expired; they are not held until their slot
+		if !Expired(action, now) {
+			if t, ok := DeliveryTime(action, agentId); ok && now.Before(t) {
+				held = append(held, action)
+				if at.IsZero() || t.Before(at) {
+					at = t
+				}
+				continue
+			}
+		}
+		ready = append(ready, action)
+	}
+
+	return ready, held, at
+}
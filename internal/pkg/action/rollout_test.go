@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package action
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+func TestDeliveryTime(t *testing.T) {
+	start := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	_, ok := DeliveryTime(model.Action{Timestamp: start.Format(time.RFC3339)}, "agent-id")
+	assert.False(t, ok, "not scheduled")
+
+	_, ok = DeliveryTime(model.Action{StartTime: "bogus"}, "agent-id")
+	assert.False(t, ok, "invalid start time")
+
+	at, ok := DeliveryTime(model.Action{StartTime: start.Format(time.RFC3339)}, "agent-id")
+	require.True(t, ok)
+	assert.Equal(t, start, at)
+
+	// Slots are deterministic and spread across the window
+	action := model.Action{StartTime: start.Format(time.RFC3339), RolloutDuration: 3600}
+	window := time.Hour
+
+	var first, last time.Time
+	for i := 0; i < 1000; i++ {
+		agentId := "agent-" + strconv.Itoa(i)
+
+		at, ok := DeliveryTime(action, agentId)
+		require.True(t, ok)
+		assert.False(t, at.Before(start))
+		assert.True(t, at.Before(start.Add(window)))
+
+		again, _ := DeliveryTime(action, agentId)
+		assert.Equal(t, at, again)
+
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	assert.Less(t, first.Sub(start), window/10)
+	assert.Greater(t, last.Sub(start), window*9/10)
+
+	// Rollout from the creation time without a start time
+	action = model.Action{Timestamp: start.Format(time.RFC3339), RolloutDuration: 60}
+	at, ok = DeliveryTime(action, "agent-id")
+	require.True(t, ok)
+	assert.False(t, at.Before(start))
+	assert.True(t, at.Before(start.Add(time.Minute)))
+}
+
+func TestSplitHeld(t *testing.T) {
+	now := time.Date(2021, 9, 1, 10, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour).Format(time.RFC3339)
+	past := now.Add(-time.Hour).Format(time.RFC3339)
+
+	actions := []model.Action{
+		{ActionId: "started", StartTime: past},
+		{ActionId: "expired", StartTime: future, Expiration: past},
+		{ActionId: "later", StartTime: now.Add(2 * time.Hour).Format(time.RFC3339)},
+		{ActionId: "scheduled", StartTime: future},
+		{ActionId: "unscheduled"},
+	}
+
+	// Only the scheduled actions are held, not the ones after them
+	ready, held, at := SplitHeld("agent-id", actions, now)
+	assert.Equal(t, []model.Action{actions[0], actions[1], actions[4]}, ready)
+	assert.Equal(t, actions[2:4], held)
+	assert.Equal(t, now.Add(time.Hour), at)
+
+	ready, held, _ = SplitHeld("agent-id", actions, now.Add(3*time.Hour))
+	assert.Equal(t, actions, ready)
+	assert.Empty(t, held)
+}
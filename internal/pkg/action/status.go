@@ -0,0 +1,183 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultStatusFlushInterval = 10 * time.Second
+
+// Increment the counters of the action status document, creating it on first update.
+// The expiration is copied from the action so that the document is cleaned up with it.
+const kUpdateStatusScript = `ctx._source.action_id = params.id;` +
+	`if (params.expiration != null) {ctx._source.expiration = params.expiration;}` +
+	`ctx._source.delivered = (ctx._source.delivered ?: 0) + params.delivered;` +
+	`ctx._source.acked = (ctx._source.acked ?: 0) + params.acked;` +
+	`ctx._source.failed = (ctx._source.failed ?: 0) + params.failed;` +
+	`ctx._source.updated_at = params.ts;`
+
+type statusT struct {
+	expiration string
+	delivered  int64
+	acked      int64
+	failed     int64
+}
+
+// StatusBulk counts the deliveries and acks of the actions and coalesces
+// them into periodic bulk updates of the action status documents.
+type StatusBulk struct {
+	bulker        bulk.Bulk
+	flushInterval time.Duration
+
+	mut     sync.Mutex
+	pending map[string]*statusT
+}
+
+func NewStatusBulk(bulker bulk.Bulk, flushInterval time.Duration) *StatusBulk {
+	if flushInterval <= 0 {
+		flushInterval = defaultStatusFlushInterval
+	}
+
+	return &StatusBulk{
+		bulker:        bulker,
+		flushInterval: flushInterval,
+		pending:       make(map[string]*statusT),
+	}
+}
+
+// Delivered counts the actions sent to an agent.
+func (sb *StatusBulk) Delivered(actions ...model.Action) {
+	sb.add(actions, func(st *statusT) { st.delivered++ })
+}
+
+// Acked counts an action completed by an agent.
+func (sb *StatusBulk) Acked(action model.Action) {
+	sb.add([]model.Action{action}, func(st *statusT) { st.acked++ })
+}
+
+// Failed counts an action an agent reported as failed.
+func (sb *StatusBulk) Failed(action model.Action) {
+	sb.add([]model.Action{action}, func(st *statusT) { st.failed++ })
+}
+
+func (sb *StatusBulk) add(actions []model.Action, incF func(st *statusT)) {
+	if sb == nil || len(actions) == 0 {
+		return
+	}
+
+	sb.mut.Lock()
+	defer sb.mut.Unlock()
+
+	for _, action := range actions {
+		st, ok := sb.pending[action.ActionId]
+		if !ok {
+			st = &statusT{}
+			sb.pending[action.ActionId] = st
+		}
+		if action.Expiration != "" {
+			st.expiration = action.Expiration
+		}
+		incF(st)
+	}
+}
+
+func (sb *StatusBulk) Run(ctx context.Context) error {
+	tick := time.NewTicker(sb.flushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := sb.flush(ctx); err != nil {
+				log.Error().Err(err).Msg("Eat bulk action status error; Keep on truckin'")
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (sb *StatusBulk) flush(ctx context.Context) error {
+	start := time.Now()
+
+	sb.mut.Lock()
+	pending := sb.pending
+	sb.pending = make(map[string]*statusT, len(pending))
+	sb.mut.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ts := start.UTC().Format(time.RFC3339)
+
+	updates := make([]bulk.MultiOp, 0, len(pending))
+	for actionId, st := range pending {
+		body, err := makeUpdateStatusBody(actionId, st, ts)
+		if err != nil {
+			return err
+		}
+
+		updates = append(updates, bulk.MultiOp{
+			Id:    actionId,
+			Body:  body,
+			Index: dl.FleetActionsStatus,
+		})
+	}
+
+	items, err := sb.bulker.MUpdate(ctx, updates, bulk.WithRetryOnConflict(3))
+
+	var failed int
+	for _, item := range items {
+		if item.Error != nil {
+			failed++
+		}
+	}
+
+	log.Trace().
+		Err(err).
+		Dur("rtt", time.Since(start)).
+		Int("cnt", len(updates)).
+		Int("failed", failed).
+		Msg("Flush action status")
+
+	return err
+}
+
+func makeUpdateStatusBody(actionId string, st *statusT, ts string) ([]byte, error) {
+	params := map[string]interface{}{
+		"id":         actionId,
+		"expiration": nil,
+		"delivered":  st.delivered,
+		"acked":      st.acked,
+		"failed":     st.failed,
+		"ts":         ts,
+	}
+	if st.expiration != "" {
+		params["expiration"] = st.expiration
+	}
+
+	doc := map[string]interface{}{
+		"scripted_upsert": true,
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": kUpdateStatusScript,
+			"params": params,
+		},
+		"upsert": map[string]interface{}{},
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,98 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package action
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+type statusBulk struct {
+	ftesting.MockBulk
+	updates [][]bulk.MultiOp
+}
+
+func (m *statusBulk) MUpdate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.updates = append(m.updates, ops)
+	return nil, nil
+}
+
+type statusUpdate struct {
+	ScriptedUpsert bool `json:"scripted_upsert"`
+	Script         struct {
+		Params struct {
+			Id         string  `json:"id"`
+			Expiration *string `json:"expiration"`
+			Delivered  int64   `json:"delivered"`
+			Acked      int64   `json:"acked"`
+			Failed     int64   `json:"failed"`
+		} `json:"params"`
+	} `json:"script"`
+}
+
+func TestStatusBulkFlush(t *testing.T) {
+	bulker := &statusBulk{}
+	sb := NewStatusBulk(bulker, 0)
+
+	upgrade := model.Action{ActionId: "upgrade-id", Expiration: "2021-10-01T00:00:00Z"}
+	unenroll := model.Action{ActionId: "unenroll-id"}
+
+	sb.Delivered(upgrade, unenroll)
+	sb.Delivered(upgrade)
+	sb.Acked(upgrade)
+	sb.Failed(upgrade)
+	sb.Acked(unenroll)
+
+	require.NoError(t, sb.flush(context.Background()))
+	require.Len(t, bulker.updates, 1)
+
+	got := make(map[string]statusUpdate)
+	for _, op := range bulker.updates[0] {
+		assert.Equal(t, dl.FleetActionsStatus, op.Index)
+
+		var upd statusUpdate
+		require.NoError(t, json.Unmarshal(op.Body, &upd))
+		assert.True(t, upd.ScriptedUpsert)
+		assert.Equal(t, op.Id, upd.Script.Params.Id)
+		got[op.Id] = upd
+	}
+	require.Len(t, got, 2)
+
+	params := got["upgrade-id"].Script.Params
+	require.NotNil(t, params.Expiration)
+	assert.Equal(t, upgrade.Expiration, *params.Expiration)
+	assert.Equal(t, int64(2), params.Delivered)
+	assert.Equal(t, int64(1), params.Acked)
+	assert.Equal(t, int64(1), params.Failed)
+
+	params = got["unenroll-id"].Script.Params
+	assert.Nil(t, params.Expiration)
+	assert.Equal(t, int64(1), params.Delivered)
+	assert.Equal(t, int64(1), params.Acked)
+	assert.Equal(t, int64(0), params.Failed)
+
+	// Counters are reset once flushed
+	require.NoError(t, sb.flush(context.Background()))
+	assert.Len(t, bulker.updates, 1)
+}
+
+func TestStatusBulkNil(t *testing.T) {
+	var sb *StatusBulk
+	sb.Delivered(model.Action{ActionId: "action-id"})
+	sb.Acked(model.Action{ActionId: "action-id"})
+	sb.Failed(model.Action{ActionId: "action-id"})
+}
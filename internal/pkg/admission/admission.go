@@ -0,0 +1,196 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/glob"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+)
+
+var ErrDenied = errors.New("enrollment denied")
+
+// Request holds the attributes of an enrollment request that rules match against.
+type Request struct {
+	RemoteAddr string
+	KeyName    string
+	Version    string
+	LocalMeta  json.RawMessage
+}
+
+// Decision is the outcome of the admission evaluation.
+type Decision struct {
+	Allow  bool
+	Rule   string
+	Reason string
+}
+
+type ruleT struct {
+	name     string
+	allow    bool
+	nets     []*net.IPNet
+	fields   []config.MetadataField
+	versions version.Constraints
+	keys     []string
+}
+
+type Admission struct {
+	mut          sync.RWMutex
+	rules        []ruleT
+	defaultAllow bool
+}
+
+// New creates the admission control from configuration.
+func New(cfg *config.Admission) (*Admission, error) {
+	a := &Admission{}
+	if err := a.configure(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload swaps in the admission rules from the updated configuration.
+func (a *Admission) Reload(_ context.Context, cfg *config.Config) error {
+	return a.configure(&cfg.Inputs[0].Admission)
+}
+
+func (a *Admission) configure(cfg *config.Admission) error {
+	rules := make([]ruleT, 0, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+		r, err := compileRule(rc)
+		if err != nil {
+			return fmt.Errorf("admission rule %d %q: %w", i, rc.Name, err)
+		}
+		rules = append(rules, r)
+	}
+
+	a.mut.Lock()
+	a.rules = rules
+	a.defaultAllow = cfg.Default != config.AdmissionDeny
+	a.mut.Unlock()
+	return nil
+}
+
+func compileRule(rc config.AdmissionRule) (r ruleT, err error) {
+	r.name = rc.Name
+	r.fields = rc.LocalMetadata
+	r.keys = rc.EnrollmentKeys
+
+	// The action is required, as in the configuration validation
+	switch rc.Action {
+	case config.AdmissionAllow:
+		r.allow = true
+	case config.AdmissionDeny:
+	default:
+		return r, fmt.Errorf("admission action must be %s or %s, got %q", config.AdmissionAllow, config.AdmissionDeny, rc.Action)
+	}
+
+	for _, cidr := range rc.SourceCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return r, err
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+
+	if rc.Versions != "" {
+		if r.versions, err = version.NewConstraint(rc.Versions); err != nil {
+			return r, err
+		}
+	}
+
+	// Validate the glob patterns up front
+	if err = glob.ValidateFields(r.fields); err != nil {
+		return r, err
+	}
+	if err = glob.Validate(r.keys); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// Evaluate returns the decision of the first rule that matches the request.
+func (a *Admission) Evaluate(req Request) Decision {
+	a.mut.RLock()
+	defer a.mut.RUnlock()
+
+	// Local metadata is parsed on demand, only once.
+	var meta smap.Map
+	var metaParsed bool
+	localMeta := func() smap.Map {
+		if !metaParsed {
+			meta, _ = smap.Parse(req.LocalMeta)
+			metaParsed = true
+		}
+		return meta
+	}
+
+	for _, r := range a.rules {
+		if r.match(req, localMeta) {
+			return Decision{
+				Allow:  r.allow,
+				Rule:   r.name,
+				Reason: fmt.Sprintf("matched admission rule %q", r.name),
+			}
+		}
+	}
+
+	return Decision{
+		Allow:  a.defaultAllow,
+		Reason: "no admission rule matched",
+	}
+}
+
+func (r *ruleT) match(req Request, localMeta func() smap.Map) bool {
+	if len(r.nets) > 0 && !matchSource(r.nets, req.RemoteAddr) {
+		return false
+	}
+
+	if r.versions != nil {
+		v, err := version.NewVersion(req.Version)
+		if err != nil || !r.versions.Check(v) {
+			return false
+		}
+	}
+
+	if len(r.keys) > 0 && !glob.MatchAny(r.keys, req.KeyName) {
+		return false
+	}
+
+	if len(r.fields) > 0 && !glob.MatchFields(r.fields, localMeta()) {
+		return false
+	}
+
+	return true
+}
+
+func matchSource(nets []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package admission
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+const linuxMeta = `{
+	"elastic": {"agent": {"id": "1b9c327a", "version": "7.15.0"}},
+	"host": {"hostname": "web-01.corp", "id": "abcd"},
+	"os": {"family": "debian", "platform": "ubuntu"}
+}`
+
+const darwinMeta = `{
+	"host": {"hostname": "laptop-42"},
+	"os": {"family": "darwin"}
+}`
+
+func TestEvaluate(t *testing.T) {
+	cfg := &config.Admission{
+		Rules: []config.AdmissionRule{
+			{
+				Name:        "block-guest-net",
+				Action:      config.AdmissionDeny,
+				SourceCIDRs: []string{"10.99.0.0/16"},
+			},
+			{
+				Name:           "contractor-web",
+				Action:         config.AdmissionAllow,
+				EnrollmentKeys: []string{"contractor-*"},
+				LocalMetadata: []config.MetadataField{
+					{Field: "host.hostname", Pattern: "web-*"},
+					{Field: "os.family", Pattern: "debian"},
+				},
+				Versions: ">= 7.15.0",
+			},
+			{
+				Name:           "contractor-other",
+				Action:         config.AdmissionDeny,
+				EnrollmentKeys: []string{"contractor-*"},
+			},
+		},
+	}
+
+	a, err := New(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		req   Request
+		allow bool
+		rule  string
+	}{
+		{
+			name:  "source cidr denied",
+			req:   Request{RemoteAddr: "10.99.1.2:54321", KeyName: "default", LocalMeta: []byte(linuxMeta)},
+			allow: false,
+			rule:  "block-guest-net",
+		},
+		{
+			name:  "contractor matches all conditions",
+			req:   Request{RemoteAddr: "192.168.1.2:54321", KeyName: "contractor-acme", Version: "7.15.1", LocalMeta: []byte(linuxMeta)},
+			allow: true,
+			rule:  "contractor-web",
+		},
+		{
+			name:  "contractor version too old",
+			req:   Request{RemoteAddr: "192.168.1.2:54321", KeyName: "contractor-acme", Version: "7.14.0", LocalMeta: []byte(linuxMeta)},
+			allow: false,
+			rule:  "contractor-other",
+		},
+		{
+			name:  "contractor metadata mismatch",
+			req:   Request{RemoteAddr: "192.168.1.2:54321", KeyName: "contractor-acme", Version: "7.15.1", LocalMeta: []byte(darwinMeta)},
+			allow: false,
+			rule:  "contractor-other",
+		},
+		{
+			name:  "contractor no metadata",
+			req:   Request{RemoteAddr: "192.168.1.2:54321", KeyName: "contractor-acme", Version: "7.15.1"},
+			allow: false,
+			rule:  "contractor-other",
+		},
+		{
+			name:  "no rule matched",
+			req:   Request{RemoteAddr: "[::1]:54321", KeyName: "default", Version: "7.15.1", LocalMeta: []byte(darwinMeta)},
+			allow: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := a.Evaluate(tc.req)
+			assert.Equal(t, tc.allow, d.Allow)
+			assert.Equal(t, tc.rule, d.Rule)
+			assert.NotEmpty(t, d.Reason)
+		})
+	}
+}
+
+func TestEvaluateDefaultDeny(t *testing.T) {
+	a, err := New(&config.Admission{
+		Default: config.AdmissionDeny,
+		Rules: []config.AdmissionRule{
+			{
+				Name:        "office",
+				Action:      config.AdmissionAllow,
+				SourceCIDRs: []string{"192.168.0.0/16", "fd00::/8"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, a.Evaluate(Request{RemoteAddr: "192.168.4.4:1234"}).Allow)
+	assert.True(t, a.Evaluate(Request{RemoteAddr: "[fd00::1]:1234"}).Allow)
+	assert.False(t, a.Evaluate(Request{RemoteAddr: "8.8.8.8:1234"}).Allow)
+	assert.False(t, a.Evaluate(Request{RemoteAddr: "bogus"}).Allow)
+}
+
+func TestReload(t *testing.T) {
+	a, err := New(&config.Admission{})
+	require.NoError(t, err)
+
+	req := Request{RemoteAddr: "10.0.0.1:1234"}
+	assert.True(t, a.Evaluate(req).Allow)
+
+	cfg := &config.Config{
+		Inputs: []config.Input{{
+			Admission: config.Admission{
+				Rules: []config.AdmissionRule{
+					{Name: "deny-all", Action: config.AdmissionDeny},
+				},
+			},
+		}},
+	}
+	require.NoError(t, a.Reload(context.Background(), cfg))
+	d := a.Evaluate(req)
+	assert.False(t, d.Allow)
+	assert.Equal(t, "deny-all", d.Rule)
+
+	// A bad configuration leaves the current rules in place
+	cfg.Inputs[0].Admission.Rules = []config.AdmissionRule{
+		{Name: "bad", Action: config.AdmissionAllow, SourceCIDRs: []string{"not-a-cidr"}},
+	}
+	assert.Error(t, a.Reload(context.Background(), cfg))
+	assert.False(t, a.Evaluate(req).Allow)
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := map[string]config.AdmissionRule{
+		"cidr":      {Action: config.AdmissionAllow, SourceCIDRs: []string{"10.0.0.0/99"}},
+		"version":   {Action: config.AdmissionAllow, Versions: "bogus"},
+		"pattern":   {Action: config.AdmissionAllow, LocalMetadata: []config.MetadataField{{Field: "host.hostname", Pattern: "[a-"}}},
+		"field":     {Action: config.AdmissionAllow, LocalMetadata: []config.MetadataField{{Pattern: "*"}}},
+		"key":       {Action: config.AdmissionAllow, EnrollmentKeys: []string{"[a-"}},
+		"no action": {SourceCIDRs: []string{"10.0.0.0/8"}},
+		"action":    {Action: "permit"},
+	}
+
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(&config.Admission{Rules: []config.AdmissionRule{rule}})
+			assert.Error(t, err)
+		})
+	}
+}
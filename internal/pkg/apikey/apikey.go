@@ -64,8 +64,12 @@ func (k ApiKey) Agent() string {
 }
 
 func ExtractAPIKey(r *http.Request) (*ApiKey, error) {
-	s, ok := r.Header[AuthKey]
-	if !ok {
+	return ExtractAPIKeyFromHeader(r.Header[AuthKey])
+}
+
+// ExtractAPIKeyFromHeader parses the API key from the values of the authorization header.
+func ExtractAPIKeyFromHeader(s []string) (*ApiKey, error) {
+	if len(s) == 0 {
 		return nil, ErrNoAuthHeader
 	}
 	if len(s) != 1 || !strings.HasPrefix(s[0], authPrefix) {
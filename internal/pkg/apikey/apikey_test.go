@@ -22,3 +22,20 @@ func TestMonitorLeadership(t *testing.T) {
 	assert.Equal(t, *apiKey, ApiKey{" foo", "bar"})
 	assert.Equal(t, token, apiKey.Token())
 }
+
+func TestExtractAPIKeyFromHeader(t *testing.T) {
+	token := ApiKey{"foo", "bar"}.Token()
+
+	apiKey, err := ExtractAPIKeyFromHeader([]string{"ApiKey " + token})
+	assert.NoError(t, err)
+	assert.Equal(t, ApiKey{"foo", "bar"}, *apiKey)
+
+	_, err = ExtractAPIKeyFromHeader(nil)
+	assert.ErrorIs(t, err, ErrNoAuthHeader)
+
+	_, err = ExtractAPIKeyFromHeader([]string{"Bearer " + token})
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+
+	_, err = ExtractAPIKeyFromHeader([]string{"ApiKey " + token, "ApiKey " + token})
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+}
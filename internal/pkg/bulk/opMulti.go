@@ -11,19 +11,19 @@ import (
 )
 
 func (b *Bulker) MCreate(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionCreate, ops)
+	return b.multiWaitBulkOp(ctx, ActionCreate, ops, opts...)
 }
 
 func (b *Bulker) MIndex(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionIndex, ops)
+	return b.multiWaitBulkOp(ctx, ActionIndex, ops, opts...)
 }
 
 func (b *Bulker) MUpdate(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionUpdate, ops)
+	return b.multiWaitBulkOp(ctx, ActionUpdate, ops, opts...)
 }
 
 func (b *Bulker) MDelete(ctx context.Context, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
-	return b.multiWaitBulkOp(ctx, ActionDelete, ops)
+	return b.multiWaitBulkOp(ctx, ActionDelete, ops, opts...)
 }
 
 func (b *Bulker) multiWaitBulkOp(ctx context.Context, action actionT, ops []MultiOp, opts ...Opt) ([]BulkIndexerResponseItem, error) {
@@ -366,6 +366,10 @@ func easyjsonCef4e921EncodeGithubComElasticFleetServerV7InternalPkgEs(out *jwrit
 func easyjsonCef4e921Decode(in *jlexer.Lexer, out *struct {
 	Type   string `json:"type"`
 	Reason string `json:"reason"`
+	Cause  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"caused_by"`
 }) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -389,6 +393,8 @@ func easyjsonCef4e921Decode(in *jlexer.Lexer, out *struct {
 			out.Type = string(in.String())
 		case "reason":
 			out.Reason = string(in.String())
+		case "caused_by":
+			easyjsonCef4e921Decode3(in, &out.Cause)
 		default:
 			in.SkipRecursive()
 		}
@@ -402,6 +408,70 @@ func easyjsonCef4e921Decode(in *jlexer.Lexer, out *struct {
 func easyjsonCef4e921Encode(out *jwriter.Writer, in struct {
 	Type   string `json:"type"`
 	Reason string `json:"reason"`
+	Cause  struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"caused_by"`
+}) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	{
+		const prefix string = ",\"type\":"
+		out.RawString(prefix[1:])
+		out.String(string(in.Type))
+	}
+	{
+		const prefix string = ",\"reason\":"
+		out.RawString(prefix)
+		out.String(string(in.Reason))
+	}
+	{
+		const prefix string = ",\"caused_by\":"
+		out.RawString(prefix)
+		easyjsonCef4e921Encode3(out, in.Cause)
+	}
+	out.RawByte('}')
+}
+func easyjsonCef4e921Decode3(in *jlexer.Lexer, out *struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeFieldName(false)
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "type":
+			out.Type = string(in.String())
+		case "reason":
+			out.Reason = string(in.String())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonCef4e921Encode3(out *jwriter.Writer, in struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
 }) {
 	out.RawByte('{')
 	first := true
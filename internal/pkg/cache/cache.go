@@ -31,6 +31,12 @@ type Cache interface {
 
 	SetArtifact(artifact model.Artifact)
 	GetArtifact(ident, sha2 string) (model.Artifact, bool)
+
+	SetEncodedArtifact(ident, sha2, encoding string, body []byte)
+	GetEncodedArtifact(ident, sha2, encoding string) ([]byte, bool)
+
+	SetEnrollment(enrollmentApiKeyId, idempotencyKey string, agent model.Agent, ttl time.Duration)
+	GetEnrollment(enrollmentApiKeyId, idempotencyKey string) (model.Agent, bool)
 }
 
 type ApiKey = apikey.ApiKey
@@ -232,12 +238,32 @@ func (c *CacheT) GetEnrollmentApiKey(id string) (model.EnrollmentApiKey, bool) {
 }
 
 // SetEnrollmentApiKey adds the enrollment API key into the cache.
+//
+// The TTL is capped at the remaining lifetime of keys that carry an expiration.
 func (c *CacheT) SetEnrollmentApiKey(id string, key model.EnrollmentApiKey, cost int64) {
 	c.mut.RLock()
 	defer c.mut.RUnlock()
 
 	scopedKey := "record:" + id
 	ttl := c.cfg.EnrollKeyTTL
+
+	// Do not cache the key beyond its expiration.
+	if key.ExpireAt != "" {
+		expireAt, err := time.Parse(time.RFC3339, key.ExpireAt)
+		if err != nil {
+			log.Debug().Err(err).Str("id", id).Msg("EnrollmentApiKey cache SET skipped on malformed expiration")
+			return
+		}
+		remaining := time.Until(expireAt)
+		if remaining <= 0 {
+			log.Trace().Str("id", id).Msg("EnrollmentApiKey cache SET skipped on expired key")
+			return
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+
 	ok := c.cache.SetWithTTL(scopedKey, key, cost, ttl)
 	log.Trace().
 		Bool("ok", ok).
@@ -288,3 +314,91 @@ func (c *CacheT) SetArtifact(artifact model.Artifact) {
 		Dur("ttl", ttl).
 		Msg("Artifact cache SET")
 }
+
+func makeEncodedArtifactKey(ident, sha2, encoding string) string {
+	return fmt.Sprintf("artifact:%s:%s:%s", ident, sha2, encoding)
+}
+
+// GetEncodedArtifact returns the artifact body encoded with the content encoding.
+func (c *CacheT) GetEncodedArtifact(ident, sha2, encoding string) ([]byte, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := makeEncodedArtifactKey(ident, sha2, encoding)
+	if v, ok := c.cache.Get(scopedKey); ok {
+		log.Trace().Str("key", scopedKey).Msg("Encoded artifact cache HIT")
+		body, ok := v.([]byte)
+
+		if !ok {
+			log.Error().Str("key", scopedKey).Msg("Encoded artifact cache cast fail")
+			return nil, false
+		}
+		return body, ok
+	}
+
+	log.Trace().Str("key", scopedKey).Msg("Encoded artifact cache MISS")
+	return nil, false
+}
+
+// SetEncodedArtifact caches the artifact body encoded with the content encoding.
+// Artifacts are immutable, so each is compressed once per encoding.
+func (c *CacheT) SetEncodedArtifact(ident, sha2, encoding string, body []byte) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := makeEncodedArtifactKey(ident, sha2, encoding)
+	cost := int64(len(body))
+	ttl := c.cfg.ArtifactTTL
+
+	ok := c.cache.SetWithTTL(scopedKey, body, cost, ttl)
+	log.Trace().
+		Bool("ok", ok).
+		Str("key", scopedKey).
+		Int64("cost", cost).
+		Dur("ttl", ttl).
+		Msg("Encoded artifact cache SET")
+}
+
+func makeEnrollmentKey(enrollmentApiKeyId, idempotencyKey string) string {
+	return fmt.Sprintf("enrollment:%s:%s", enrollmentApiKeyId, idempotencyKey)
+}
+
+// GetEnrollment returns the agent enrolled with the enrollment API key and idempotency key.
+func (c *CacheT) GetEnrollment(enrollmentApiKeyId, idempotencyKey string) (model.Agent, bool) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := makeEnrollmentKey(enrollmentApiKeyId, idempotencyKey)
+	if v, ok := c.cache.Get(scopedKey); ok {
+		log.Trace().Str("key", scopedKey).Msg("Enrollment cache HIT")
+		agent, ok := v.(model.Agent)
+
+		if !ok {
+			log.Error().Str("key", scopedKey).Msg("Enrollment cache cast fail")
+			return model.Agent{}, false
+		}
+		return agent, ok
+	}
+
+	log.Trace().Str("key", scopedKey).Msg("Enrollment cache MISS")
+	return model.Agent{}, false
+}
+
+// SetEnrollment adds the agent enrolled with the enrollment API key and idempotency key.
+//
+// The TTL is provided by the caller as it is bound to the idempotency window of the enrollment.
+func (c *CacheT) SetEnrollment(enrollmentApiKeyId, idempotencyKey string, agent model.Agent, ttl time.Duration) {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	scopedKey := makeEnrollmentKey(enrollmentApiKeyId, idempotencyKey)
+	cost := int64(len(scopedKey) + len(agent.LocalMetadata) + len(agent.UserProvidedMetadata))
+
+	ok := c.cache.SetWithTTL(scopedKey, agent, cost, ttl)
+	log.Trace().
+		Bool("ok", ok).
+		Str("key", scopedKey).
+		Int64("cost", cost).
+		Dur("ttl", ttl).
+		Msg("Enrollment cache SET")
+}
@@ -12,15 +12,20 @@ import (
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 
 	"github.com/rs/zerolog/log"
 )
 
-const defaultFlushInterval = 10 * time.Second
+const (
+	defaultFlushInterval = 10 * time.Second
+	defaultStateTTL      = time.Hour
+)
 
 type optionsT struct {
 	flushInterval time.Duration
+	stateTTL      time.Duration
 }
 
 type Opt func(*optionsT)
@@ -31,6 +36,14 @@ func WithFlushInterval(d time.Duration) Opt {
 	}
 }
 
+// WithStateTTL sets how long the last status of an agent is kept without checkin.
+// An evicted agent is baselined again from its document on its next checkin.
+func WithStateTTL(d time.Duration) Opt {
+	return func(opt *optionsT) {
+		opt.stateTTL = d
+	}
+}
+
 type extraT struct {
 	meta  []byte
 	seqNo sqn.SeqNo
@@ -46,11 +59,21 @@ type pendingT struct {
 	extra  *extraT
 }
 
+// Last status seen for an agent; baseline for detecting status transitions.
+type agentStateT struct {
+	status    string
+	policyId  string
+	policyRev int64
+	seen      int64
+}
+
 type Bulk struct {
 	opts    optionsT
 	bulker  bulk.Bulk
 	mut     sync.Mutex
 	pending map[string]pendingT
+	states  map[string]agentStateT
+	history [][]byte
 
 	ts   string
 	unix int64
@@ -63,6 +86,7 @@ func NewBulk(bulker bulk.Bulk, opts ...Opt) *Bulk {
 		opts:    parsedOpts,
 		bulker:  bulker,
 		pending: make(map[string]pendingT),
+		states:  make(map[string]agentStateT),
 	}
 }
 
@@ -70,6 +94,7 @@ func parseOpts(opts ...Opt) optionsT {
 
 	outOpts := optionsT{
 		flushInterval: defaultFlushInterval,
+		stateTTL:      defaultStateTTL,
 	}
 
 	for _, f := range opts {
@@ -93,6 +118,23 @@ func (bc *Bulk) timestamp() string {
 	return bc.ts
 }
 
+// Observe records the agent state from the agent document.  The status
+// is used as the baseline for transitions only if the agent has not
+// checked in yet since this server started; the policy is always updated.
+func (bc *Bulk) Observe(id, policyId, status string, policyRev int64) {
+	bc.mut.Lock()
+	defer bc.mut.Unlock()
+
+	state, ok := bc.states[id]
+	if !ok {
+		state.status = status
+	}
+	state.policyId = policyId
+	state.policyRev = policyRev
+	state.seen = time.Now().Unix()
+	bc.states[id] = state
+}
+
 // WARNING: Bulk will take ownership of fields,
 // so do not use after passing in.
 func (bc *Bulk) CheckIn(id string, status string, meta []byte, seqno sqn.SeqNo, newVer string) error {
@@ -117,10 +159,55 @@ func (bc *Bulk) CheckIn(id string, status string, meta []byte, seqno sqn.SeqNo,
 		extra:  extra,
 	}
 
+	bc.transition(id, status)
+
 	bc.mut.Unlock()
 	return nil
 }
 
+// Queue a status history document if the status differs from the last
+// status seen for the agent.  No transition is recorded without a baseline.
+func (bc *Bulk) transition(id, status string) {
+
+	// WARNING: Expects mutex locked.
+	state, ok := bc.states[id]
+	if ok && state.status != status {
+		doc := model.AgentStatusHistory{
+			Timestamp:         time.Now().UTC().Format(time.RFC3339Nano),
+			AgentId:           id,
+			PolicyId:          state.policyId,
+			PolicyRevisionIdx: state.policyRev,
+			FromStatus:        state.status,
+			ToStatus:          status,
+		}
+		if body, err := json.Marshal(doc); err != nil {
+			log.Debug().Err(err).Str("agentId", id).Msg("fail marshal agent status history")
+		} else {
+			bc.history = append(bc.history, body)
+		}
+	}
+
+	state.status = status
+	state.seen = bc.unix
+	bc.states[id] = state
+}
+
+// Forget the agents that have not checked in since the cutoff,
+// otherwise the states grow with every agent ever seen.
+func (bc *Bulk) evictStates(cutoff int64) int {
+
+	// WARNING: Expects mutex locked.
+	var n int
+	for id, state := range bc.states {
+		if state.seen < cutoff {
+			delete(bc.states, id)
+			n++
+		}
+	}
+
+	return n
+}
+
 func (bc *Bulk) Run(ctx context.Context) error {
 
 	tick := time.NewTicker(bc.opts.flushInterval)
@@ -151,8 +238,22 @@ func (bc *Bulk) flush(ctx context.Context) error {
 	bc.mut.Lock()
 	pending := bc.pending
 	bc.pending = make(map[string]pendingT, len(pending))
+	history := bc.history
+	bc.history = nil
+	var evicted int
+	if bc.opts.stateTTL > 0 {
+		evicted = bc.evictStates(start.Add(-bc.opts.stateTTL).Unix())
+	}
 	bc.mut.Unlock()
 
+	if evicted > 0 {
+		log.Trace().Int("cnt", evicted).Msg("Evicted agent states")
+	}
+
+	if len(history) > 0 {
+		bc.flushHistory(ctx, history)
+	}
+
 	if len(pending) == 0 {
 		return nil
 	}
@@ -246,3 +347,39 @@ func (bc *Bulk) flush(ctx context.Context) error {
 
 	return err
 }
+
+// Write the status transitions to the status history data stream.
+// Failures are logged and dropped, history is not retried.
+func (bc *Bulk) flushHistory(ctx context.Context, history [][]byte) {
+	start := time.Now()
+
+	ops := make([]bulk.MultiOp, len(history))
+	for i, doc := range history {
+		ops[i] = bulk.MultiOp{
+			Index: dl.FleetAgentStatusHistory,
+			Body:  doc,
+		}
+	}
+
+	items, err := bc.bulker.MCreate(ctx, ops)
+
+	var failed int
+	for _, item := range items {
+		if item.Error != nil {
+			failed++
+		}
+	}
+
+	zlog := log.With().
+		Dur("rtt", time.Since(start)).
+		Int("cnt", len(ops)).
+		Int("failed", failed).
+		Logger()
+
+	if err != nil || failed > 0 {
+		zlog.Warn().Err(err).Msg("Eat agent status history write error; Keep on truckin'")
+		return
+	}
+
+	zlog.Trace().Msg("Flush agent status history")
+}
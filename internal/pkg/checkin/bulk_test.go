@@ -13,6 +13,7 @@ import (
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 	"github.com/google/go-cmp/cmp"
 
@@ -24,7 +25,8 @@ import (
 type CustomBulk struct {
 	tst.MockBulk
 
-	ops []bulk.MultiOp
+	ops     []bulk.MultiOp
+	creates []bulk.MultiOp
 }
 
 func (m *CustomBulk) MUpdate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
@@ -32,6 +34,11 @@ func (m *CustomBulk) MUpdate(ctx context.Context, ops []bulk.MultiOp, opts ...bu
 	return nil, nil
 }
 
+func (m *CustomBulk) MCreate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.creates = append(m.creates, ops...)
+	return nil, nil
+}
+
 // Test simple,
 // Test with fields
 // Test with seq no
@@ -185,6 +192,116 @@ func TestBulkSimple(t *testing.T) {
 	}
 }
 
+func TestBulkStatusHistory(t *testing.T) {
+	var mockBulk CustomBulk
+
+	bc := NewBulk(&mockBulk)
+
+	// No baseline, no transition
+	if err := bc.CheckIn("unknownId", "online", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	bc.Observe("agentId", "policyId", "online", 3)
+	for _, status := range []string{"online", "degraded", "degraded", "error", "online"} {
+		if err := bc.CheckIn("agentId", status, nil, nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The status seen on checkin takes precedence over a stale agent document
+	bc.Observe("agentId", "policyId", "error", 4)
+	if err := bc.CheckIn("agentId", "online", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.CheckIn("agentId", "degraded", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bc.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []model.AgentStatusHistory{
+		{AgentId: "agentId", PolicyId: "policyId", PolicyRevisionIdx: 3, FromStatus: "online", ToStatus: "degraded"},
+		{AgentId: "agentId", PolicyId: "policyId", PolicyRevisionIdx: 3, FromStatus: "degraded", ToStatus: "error"},
+		{AgentId: "agentId", PolicyId: "policyId", PolicyRevisionIdx: 3, FromStatus: "error", ToStatus: "online"},
+		{AgentId: "agentId", PolicyId: "policyId", PolicyRevisionIdx: 4, FromStatus: "online", ToStatus: "degraded"},
+	}
+
+	if len(mockBulk.creates) != len(expected) {
+		t.Fatalf("expected %d transitions, got %d", len(expected), len(mockBulk.creates))
+	}
+
+	for i, op := range mockBulk.creates {
+		if op.Index != dl.FleetAgentStatusHistory {
+			t.Error("Wrong index")
+		}
+
+		var doc model.AgentStatusHistory
+		if err := json.Unmarshal(op.Body, &doc); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, doc.Timestamp); err != nil {
+			t.Error("expected rfc3339 timestamp")
+		}
+		doc.Timestamp = ""
+
+		if cdiff := cmp.Diff(expected[i], doc); cdiff != "" {
+			t.Error(cdiff)
+		}
+	}
+
+	// History is written once
+	mockBulk.creates = nil
+	if err := bc.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(mockBulk.creates) != 0 {
+		t.Error("expected no transitions")
+	}
+}
+
+func TestBulkEvictStates(t *testing.T) {
+	var mockBulk CustomBulk
+
+	bc := NewBulk(&mockBulk, WithStateTTL(time.Minute))
+
+	bc.Observe("staleId", "policyId", "online", 1)
+	bc.Observe("activeId", "policyId", "online", 1)
+	if err := bc.CheckIn("activeId", "online", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the stale agent past the TTL
+	state := bc.states["staleId"]
+	state.seen = time.Now().Add(-2 * time.Minute).Unix()
+	bc.states["staleId"] = state
+
+	if err := bc.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bc.states["staleId"]; ok {
+		t.Error("expected stale agent state to be evicted")
+	}
+	if _, ok := bc.states["activeId"]; !ok {
+		t.Error("expected active agent state to be kept")
+	}
+
+	// An evicted agent is baselined again from its document
+	bc.Observe("staleId", "policyId", "error", 2)
+	if err := bc.CheckIn("staleId", "online", nil, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(mockBulk.creates) != 1 {
+		t.Fatalf("expected 1 transition, got %d", len(mockBulk.creates))
+	}
+}
+
 func validateTimestamp(t *testing.T, start time.Time, ts string) {
 
 	if t1, err := time.Parse(time.RFC3339, ts); err != nil {
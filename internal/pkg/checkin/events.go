@@ -0,0 +1,139 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package checkin
+
+import (
+	"context"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxEventsBatch     = 512
+	eventsFlushTimeout = 10 * time.Second
+)
+
+// Events queues the events reported by agents on checkin and writes
+// them in bulk to the agent events data stream, out of band of the
+// checkin request.
+type Events struct {
+	bulker        bulk.Bulk
+	index         string
+	flushInterval time.Duration
+	ch            chan []byte
+}
+
+func NewEvents(bulker bulk.Bulk, queueSize int, flushInterval time.Duration) *Events {
+	return &Events{
+		bulker:        bulker,
+		index:         dl.FleetAgentEvents,
+		flushInterval: flushInterval,
+		ch:            make(chan []byte, queueSize),
+	}
+}
+
+// Add queues the event documents for writing without blocking.
+// Returns the number of documents queued; the remainder is dropped
+// when the queue is full.
+func (ev *Events) Add(docs ...[]byte) int {
+	for i, doc := range docs {
+		select {
+		case ev.ch <- doc:
+		default:
+			return i
+		}
+	}
+	return len(docs)
+}
+
+func (ev *Events) Run(ctx context.Context) error {
+	tick := time.NewTicker(ev.flushInterval)
+	defer tick.Stop()
+
+	batch := make([][]byte, 0, maxEventsBatch)
+
+	for {
+		select {
+		case doc := <-ev.ch:
+			batch = append(batch, doc)
+			if len(batch) < maxEventsBatch {
+				continue
+			}
+		case <-tick.C:
+		case <-ctx.Done():
+			ev.drain(batch)
+			return ctx.Err()
+		}
+
+		if len(batch) > 0 {
+			ev.flush(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// Flush the pending events on shutdown. The context of Run is cancelled by then,
+// the bulker outlives it.
+func (ev *Events) drain(batch [][]byte) {
+LOOP:
+	for {
+		select {
+		case doc := <-ev.ch:
+			batch = append(batch, doc)
+		default:
+			break LOOP
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventsFlushTimeout)
+	defer cancel()
+
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > maxEventsBatch {
+			n = maxEventsBatch
+		}
+		ev.flush(ctx, batch[:n])
+		batch = batch[n:]
+	}
+}
+
+func (ev *Events) flush(ctx context.Context, batch [][]byte) {
+	start := time.Now()
+
+	ops := make([]bulk.MultiOp, len(batch))
+	for i, doc := range batch {
+		ops[i] = bulk.MultiOp{
+			Index: ev.index,
+			Body:  doc,
+		}
+	}
+
+	items, err := ev.bulker.MCreate(ctx, ops)
+
+	var failed int
+	for _, item := range items {
+		if item.Error != nil {
+			failed++
+		}
+	}
+
+	zlog := log.With().
+		Dur("rtt", time.Since(start)).
+		Int("cnt", len(ops)).
+		Int("failed", failed).
+		Logger()
+
+	if err != nil || failed > 0 {
+		zlog.Warn().Err(err).Msg("Eat agent events write error; Keep on truckin'")
+		return
+	}
+
+	zlog.Trace().Msg("Flush agent events")
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package checkin
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+
+	tst "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+type createBulk struct {
+	tst.MockBulk
+
+	mut sync.Mutex
+	ops []bulk.MultiOp
+}
+
+func (m *createBulk) MCreate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.ops = append(m.ops, ops...)
+	return make([]bulk.BulkIndexerResponseItem, len(ops)), nil
+}
+
+func (m *createBulk) count() int {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return len(m.ops)
+}
+
+func TestEventsAddQueueFull(t *testing.T) {
+	ev := NewEvents(&createBulk{}, 2, time.Second)
+
+	if n := ev.Add([]byte(`{"a":1}`), []byte(`{"a":2}`), []byte(`{"a":3}`)); n != 2 {
+		t.Fatalf("expected 2 events queued, got %d", n)
+	}
+	if n := ev.Add([]byte(`{"a":4}`)); n != 0 {
+		t.Fatalf("expected no events queued, got %d", n)
+	}
+}
+
+func TestEventsRun(t *testing.T) {
+	mockBulk := &createBulk{}
+	ev := NewEvents(mockBulk, 16, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ev.Run(ctx)
+	}()
+
+	if n := ev.Add([]byte(`{"a":1}`), []byte(`{"a":2}`)); n != 2 {
+		t.Fatalf("expected 2 events queued, got %d", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mockBulk.count() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("events not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	for _, op := range mockBulk.ops {
+		if op.Index != dl.FleetAgentEvents {
+			t.Errorf("expected index %s, got %s", dl.FleetAgentEvents, op.Index)
+		}
+		if op.Id != "" {
+			t.Errorf("expected generated id, got %s", op.Id)
+		}
+	}
+}
+
+func TestEventsRunFlushOnCancel(t *testing.T) {
+	mockBulk := &createBulk{}
+	ev := NewEvents(mockBulk, 16, time.Hour)
+
+	if n := ev.Add([]byte(`{"a":1}`), []byte(`{"a":2}`)); n != 2 {
+		t.Fatalf("expected 2 events queued, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := ev.Run(ctx); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if n := mockBulk.count(); n != 2 {
+		t.Fatalf("expected 2 events flushed on cancel, got %d", n)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "fmt"
+
+const (
+	AdmissionAllow = "allow"
+	AdmissionDeny  = "deny"
+)
+
+// MetadataField matches a field in the agent metadata against a glob pattern.
+type MetadataField struct {
+	Field   string `config:"field"`
+	Pattern string `config:"pattern"`
+}
+
+// AdmissionRule is an enrollment admission rule.  All the conditions set on a rule
+// must match the enrollment request for the rule to apply.
+type AdmissionRule struct {
+	Name           string          `config:"name"`
+	Action         string          `config:"action"`
+	SourceCIDRs    []string        `config:"source_cidrs"`
+	LocalMetadata  []MetadataField `config:"local_metadata"`
+	Versions       string          `config:"versions"`
+	EnrollmentKeys []string        `config:"enrollment_keys"`
+}
+
+// Validate ensures that the configuration is valid.
+func (r *AdmissionRule) Validate() error {
+	if err := validateAdmissionAction(r.Action); err != nil {
+		return fmt.Errorf("admission rule %q: %w", r.Name, err)
+	}
+	return nil
+}
+
+// Admission is the configuration for the enrollment admission control.
+// Rules are evaluated in order; the first rule that matches decides.
+// Enrollment is allowed when no rule matches, unless the default is deny.
+type Admission struct {
+	Default string          `config:"default"`
+	Rules   []AdmissionRule `config:"rules"`
+}
+
+// Validate ensures that the configuration is valid.
+func (a *Admission) Validate() error {
+	if a.Default == "" {
+		return nil
+	}
+	return validateAdmissionAction(a.Default)
+}
+
+func validateAdmissionAction(action string) error {
+	switch action {
+	case AdmissionAllow, AdmissionDeny:
+		return nil
+	}
+	return fmt.Errorf("admission action must be %s or %s, got %q", AdmissionAllow, AdmissionDeny, action)
+}
@@ -0,0 +1,37 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "time"
+
+const (
+	defaultAgentStatusGrace           = time.Minute
+	defaultAgentStatusInactiveTimeout = 14 * 24 * time.Hour
+	defaultAgentStatusCheckInterval   = time.Minute
+)
+
+// AgentStatus is the configuration for the server-side derivation of the agents status.
+// An agent is offline when it has not checked in for longer than the checkin long poll
+// plus the grace period, and inactive when it has not checked in for the inactive timeout.
+// Disabled by default; the status history data stream must be writable before enabling it.
+type AgentStatus struct {
+	Enabled         bool          `config:"enabled"`
+	Grace           time.Duration `config:"grace"`
+	InactiveTimeout time.Duration `config:"inactive_timeout"`
+	CheckInterval   time.Duration `config:"check_interval"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *AgentStatus) InitDefaults() {
+	c.Enabled = false
+	c.Grace = defaultAgentStatusGrace
+	c.InactiveTimeout = defaultAgentStatusInactiveTimeout
+	c.CheckInterval = defaultAgentStatusCheckInterval
+}
+
+// OfflineTimeout returns the duration without checkin after which an agent is offline.
+func (c *AgentStatus) OfflineTimeout(timeouts ServerTimeouts) time.Duration {
+	return timeouts.CheckinLongPoll + c.Grace
+}
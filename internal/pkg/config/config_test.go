@@ -119,11 +119,20 @@ func TestConfig(t *testing.T) {
 								Enabled: false,
 								Bind:    "localhost:6060",
 							},
-							CompressionLevel:  1,
-							CompressionThresh: 1024,
-							Limits:            defaultServerLimits(),
-							Bulk:              defaultServerBulk(),
-							GC:                defaultServerGC(),
+							CompressionLevel:       1,
+							CompressionThresh:      1024,
+							CompressionLevelZstd:   3,
+							CompressionLevelBrotli: 4,
+							Limits:                 defaultServerLimits(),
+							Bulk:                   defaultServerBulk(),
+							GC:                     defaultServerGC(),
+							Enroll:                 defaultServerEnroll(),
+							Events:                 defaultEvents(),
+							AgentStatus:            defaultAgentStatus(),
+							StatusHistory:          defaultStatusHistory(),
+							Webhooks:               defaultWebhooks(),
+							Stream:                 defaultServerStream(),
+							GRPC:                   defaultServerGRPC(),
 						},
 						Cache: defaultCache(),
 						Monitor: Monitor{
@@ -191,6 +200,11 @@ func defaultServerTimeouts() ServerTimeouts {
 func defaultServerLimits() ServerLimits {
 	var d ServerLimits
 	d.InitDefaults()
+
+	// The decoded body limits are derived on validation
+	for _, l := range []*Limit{&d.CheckinLimit, &d.StreamLimit, &d.ArtifactLimit, &d.EnrollLimit, &d.AckLimit} {
+		_ = l.Validate()
+	}
 	return d
 }
 
@@ -206,6 +220,48 @@ func defaultServerGC() GC {
 	return d
 }
 
+func defaultServerEnroll() ServerEnroll {
+	var d ServerEnroll
+	d.InitDefaults()
+	return d
+}
+
+func defaultEvents() Events {
+	var d Events
+	d.InitDefaults()
+	return d
+}
+
+func defaultAgentStatus() AgentStatus {
+	var d AgentStatus
+	d.InitDefaults()
+	return d
+}
+
+func defaultStatusHistory() StatusHistory {
+	var d StatusHistory
+	d.InitDefaults()
+	return d
+}
+
+func defaultServerStream() ServerStream {
+	var d ServerStream
+	d.InitDefaults()
+	return d
+}
+
+func defaultServerGRPC() ServerGRPC {
+	var d ServerGRPC
+	d.InitDefaults()
+	return d
+}
+
+func defaultWebhooks() Webhooks {
+	var d Webhooks
+	d.InitDefaults()
+	return d
+}
+
 func defaultLogging() Logging {
 	var d Logging
 	d.InitDefaults()
@@ -242,5 +298,6 @@ func defaultElastic() Elasticsearch {
 func defaultServer() Server {
 	var d Server
 	d.InitDefaults()
+	d.Limits = defaultServerLimits()
 	return d
 }
@@ -0,0 +1,36 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "time"
+
+const (
+	defaultEventsMaxPerCheckin = 100
+	defaultEventsMaxSize       = 16 * 1024
+	defaultEventsQueueSize     = 4096
+	defaultEventsFlushInterval = time.Second
+	defaultEventsRetention     = 7 * 24 * time.Hour
+)
+
+// Events is the configuration for persisting the events reported by agents on checkin.
+// Disabled by default. Events are deleted after the retention, and kept forever if it is zero.
+type Events struct {
+	Enabled       bool          `config:"enabled"`
+	MaxPerCheckin int           `config:"max_per_checkin"`
+	MaxSize       int           `config:"max_size"`
+	QueueSize     int           `config:"queue_size"`
+	FlushInterval time.Duration `config:"flush_interval"`
+	Retention     time.Duration `config:"retention"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *Events) InitDefaults() {
+	c.Enabled = false
+	c.MaxPerCheckin = defaultEventsMaxPerCheckin
+	c.MaxSize = defaultEventsMaxSize
+	c.QueueSize = defaultEventsQueueSize
+	c.FlushInterval = defaultEventsFlushInterval
+	c.Retention = defaultEventsRetention
+}
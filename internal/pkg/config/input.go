@@ -17,6 +17,7 @@ const kDefaultHost = "0.0.0.0"
 const kDefaultPort = 8220
 const kDefaultInternalHost = "localhost"
 const kDefaultInternalPort = 8221
+const kDefaultGRPCPort = 8222
 
 // Policy is the configuration policy to use.
 type Policy struct {
@@ -55,21 +56,87 @@ func (c *ServerBulk) InitDefaults() {
 	c.FlushMaxPending = 8
 }
 
+// ServerEnroll is the configuration for agent enrollment.
+type ServerEnroll struct {
+	// Retire the active agents enrolled in the same policy from the same host
+	ReplaceDuplicateHosts bool `config:"replace_duplicate_hosts"`
+
+	// Window during which a retried enrollment with the same idempotency key
+	// returns the original agent
+	IdempotencyWindow time.Duration `config:"idempotency_window"`
+
+	// Deliver the current policy in the enroll response
+	InlinePolicy bool `config:"inline_policy"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *ServerEnroll) InitDefaults() {
+	c.IdempotencyWindow = time.Hour
+}
+
+// Time left between the end of a stream and the server write timeout
+const kStreamWriteMargin = 30 * time.Second
+
+// ServerStream is the configuration for the agent stream, the server-sent events
+// alternative to the long poll checkin.  A stream is closed after the max duration,
+// or earlier to end before the server write timeout, and the agent reconnects.
+// Each stream holds a slot of the stream limit for its whole lifetime.
+type ServerStream struct {
+	Enabled     bool          `config:"enabled"`
+	MaxDuration time.Duration `config:"max_duration"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *ServerStream) InitDefaults() {
+	c.MaxDuration = time.Hour
+}
+
+// Validate ensures that the configuration is valid.
+func (c *ServerStream) Validate() error {
+	if c.MaxDuration <= 0 {
+		return fmt.Errorf("stream max_duration must be positive, got %s", c.MaxDuration)
+	}
+	return nil
+}
+
+// ServerGRPC is the configuration for the gRPC control plane API.  It is served on
+// the server host, with the server TLS configuration, on its own port.
+type ServerGRPC struct {
+	Enabled        bool   `config:"enabled"`
+	Port           uint16 `config:"port"`
+	MaxMessageSize int    `config:"max_message_size"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *ServerGRPC) InitDefaults() {
+	c.Port = kDefaultGRPCPort
+	c.MaxMessageSize = 4 * 1024 * 1024
+}
+
 // Server is the configuration for the server
 type Server struct {
-	Host              string                  `config:"host"`
-	Port              uint16                  `config:"port"`
-	InternalPort      uint16                  `config:"internal_port"`
-	TLS               *tlscommon.ServerConfig `config:"ssl"`
-	Timeouts          ServerTimeouts          `config:"timeouts"`
-	Profiler          ServerProfiler          `config:"profiler"`
-	CompressionLevel  int                     `config:"compression_level"`
-	CompressionThresh int                     `config:"compression_threshold"`
-	Limits            ServerLimits            `config:"limits"`
-	Runtime           Runtime                 `config:"runtime"`
-	Bulk              ServerBulk              `config:"bulk"`
-	GC                GC                      `config:"gc"`
-	Instrumentation   Instrumentation         `config:"instrumentation"`
+	Host                   string                  `config:"host"`
+	Port                   uint16                  `config:"port"`
+	InternalPort           uint16                  `config:"internal_port"`
+	TLS                    *tlscommon.ServerConfig `config:"ssl"`
+	Timeouts               ServerTimeouts          `config:"timeouts"`
+	Profiler               ServerProfiler          `config:"profiler"`
+	CompressionLevel       int                     `config:"compression_level"`
+	CompressionThresh      int                     `config:"compression_threshold"`
+	CompressionLevelZstd   int                     `config:"compression_level_zstd"`
+	CompressionLevelBrotli int                     `config:"compression_level_brotli"`
+	Limits                 ServerLimits            `config:"limits"`
+	Runtime                Runtime                 `config:"runtime"`
+	Bulk                   ServerBulk              `config:"bulk"`
+	GC                     GC                      `config:"gc"`
+	Instrumentation        Instrumentation         `config:"instrumentation"`
+	Enroll                 ServerEnroll            `config:"enroll"`
+	Events                 Events                  `config:"events"`
+	AgentStatus            AgentStatus             `config:"agent_status"`
+	StatusHistory          StatusHistory           `config:"status_history"`
+	Webhooks               Webhooks                `config:"webhooks"`
+	Stream                 ServerStream            `config:"stream"`
+	GRPC                   ServerGRPC              `config:"grpc"`
 }
 
 // InitDefaults initializes the defaults for the configuration.
@@ -80,11 +147,40 @@ func (c *Server) InitDefaults() {
 	c.Timeouts.InitDefaults()
 	c.CompressionLevel = flate.BestSpeed
 	c.CompressionThresh = 1024
+	c.CompressionLevelZstd = 3
+	c.CompressionLevelBrotli = 4
 	c.Profiler.InitDefaults()
 	c.Limits.InitDefaults()
 	c.Runtime.InitDefaults()
 	c.Bulk.InitDefaults()
 	c.GC.InitDefaults()
+	c.Enroll.InitDefaults()
+	c.Events.InitDefaults()
+	c.AgentStatus.InitDefaults()
+	c.StatusHistory.InitDefaults()
+	c.Webhooks.InitDefaults()
+	c.Stream.InitDefaults()
+	c.GRPC.InitDefaults()
+}
+
+// Validate ensures that the configuration is valid.
+func (c *Server) Validate() error {
+	if c.Stream.Enabled && c.Timeouts.Write > 0 && c.Timeouts.Write <= kStreamWriteMargin {
+		return fmt.Errorf("write timeout must be longer than %s to enable the stream, got %s", kStreamWriteMargin, c.Timeouts.Write)
+	}
+	return nil
+}
+
+// StreamDuration returns the lifetime of a stream.  The stream ends a margin
+// before the server write timeout, if any, so that it is closed cleanly.
+func (c *Server) StreamDuration() time.Duration {
+	d := c.Stream.MaxDuration
+	if c.Timeouts.Write > 0 {
+		if limit := c.Timeouts.Write - kStreamWriteMargin; limit < d {
+			d = limit
+		}
+	}
+	return d
 }
 
 // BindEndpoints returns the binding address for the all HTTP server listeners.
@@ -114,6 +210,11 @@ func (c *Server) BindInternalAddress() string {
 	return bindAddress(kDefaultInternalHost, c.InternalPort)
 }
 
+// BindGRPCAddress returns the binding address for the gRPC server.
+func (c *Server) BindGRPCAddress() string {
+	return bindAddress(c.Host, c.GRPC.Port)
+}
+
 func bindAddress(host string, port uint16) string {
 	if strings.Count(host, ":") > 1 && strings.Count(host, "]") == 0 {
 		host = "[" + host + "]"
@@ -123,11 +224,13 @@ func bindAddress(host string, port uint16) string {
 
 // Input is the input defined by Agent to run Fleet Server.
 type Input struct {
-	Type    string  `config:"type"`
-	Policy  Policy  `config:"policy"`
-	Server  Server  `config:"server"`
-	Cache   Cache   `config:"cache"`
-	Monitor Monitor `config:"monitor"`
+	Type            string          `config:"type"`
+	Policy          Policy          `config:"policy"`
+	Server          Server          `config:"server"`
+	Cache           Cache           `config:"cache"`
+	Monitor         Monitor         `config:"monitor"`
+	Admission       Admission       `config:"admission"`
+	PolicySelection PolicySelection `config:"policy_selection"`
 }
 
 // InitDefaults initializes the defaults for the configuration.
@@ -8,10 +8,14 @@
 package config
 
 import (
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/elastic/go-ucfg"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBindAddress(t *testing.T) {
@@ -47,3 +51,106 @@ func TestBindAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadAdmission(t *testing.T) {
+	cfg, err := LoadFile(filepath.Join("testdata", "input-admission.yml"))
+	require.NoError(t, err)
+
+	expected := Admission{
+		Default: AdmissionDeny,
+		Rules: []AdmissionRule{
+			{
+				Name:           "office",
+				Action:         AdmissionAllow,
+				SourceCIDRs:    []string{"192.168.0.0/16"},
+				Versions:       ">= 7.15.0",
+				EnrollmentKeys: []string{"office-*"},
+				LocalMetadata: []MetadataField{
+					{Field: "host.hostname", Pattern: "web-*"},
+				},
+			},
+		},
+	}
+	assert.Equal(t, expected, cfg.Inputs[0].Admission)
+
+	_, err = LoadFile(filepath.Join("testdata", "bad-input-admission.yml"))
+	assert.Error(t, err)
+}
+
+func TestLoadPolicySelection(t *testing.T) {
+	cfg, err := LoadFile(filepath.Join("testdata", "input-policy-selection.yml"))
+	require.NoError(t, err)
+
+	expected := PolicySelection{
+		Rules: []PolicySelectionRule{
+			{
+				Name:           "linux-servers",
+				PolicyID:       "linux-server-policy",
+				EnrollmentKeys: []string{"site-a-*"},
+				LocalMetadata: []MetadataField{
+					{Field: "os.family", Pattern: "debian"},
+				},
+				UserMetadata: []MetadataField{
+					{Field: "role", Pattern: "server"},
+				},
+			},
+		},
+	}
+	assert.Equal(t, expected, cfg.Inputs[0].PolicySelection)
+
+	_, err = LoadFile(filepath.Join("testdata", "bad-input-policy-selection.yml"))
+	assert.Error(t, err)
+}
+
+func TestStreamDuration(t *testing.T) {
+	var cfg Server
+	cfg.InitDefaults()
+
+	// Ends a margin before the default write timeout
+	assert.Equal(t, cfg.Timeouts.Write-kStreamWriteMargin, cfg.StreamDuration())
+
+	cfg.Stream.MaxDuration = time.Minute
+	assert.Equal(t, time.Minute, cfg.StreamDuration())
+
+	// No write timeout, no bound
+	cfg.Stream.MaxDuration = 2 * time.Hour
+	cfg.Timeouts.Write = 0
+	assert.Equal(t, 2*time.Hour, cfg.StreamDuration())
+}
+
+func TestValidateStream(t *testing.T) {
+	var cfg Server
+	cfg.InitDefaults()
+	cfg.Stream.Enabled = true
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Timeouts.Write = kStreamWriteMargin
+	assert.Error(t, cfg.Validate())
+
+	cfg.Stream.MaxDuration = 0
+	assert.Error(t, cfg.Stream.Validate())
+}
+
+func TestLimitDecodedBody(t *testing.T) {
+	// Derived from the body limit once overridden
+	c := ucfg.MustNewFrom(map[string]interface{}{"max_body_byte_size": 2048})
+	var lim Limit
+	require.NoError(t, c.Unpack(&lim))
+	assert.Equal(t, int64(2048*kDecodedBodyRatio), lim.MaxBodyDecoded)
+
+	// Set explicitly
+	c = ucfg.MustNewFrom(map[string]interface{}{"max_body_byte_size": 2048, "max_body_decoded_byte_size": 4096})
+	lim = Limit{}
+	require.NoError(t, c.Unpack(&lim))
+	assert.Equal(t, int64(4096), lim.MaxBodyDecoded)
+
+	// Never unlimited
+	c = ucfg.MustNewFrom(map[string]interface{}{"max_body_byte_size": 0})
+	lim = Limit{}
+	require.NoError(t, c.Unpack(&lim))
+	assert.Equal(t, int64(kDefaultMaxBodyDecoded), lim.MaxBodyDecoded)
+	assert.Equal(t, int64(kDefaultMaxBodyDecoded), (&Limit{}).DecodedBodyLimit())
+
+	c = ucfg.MustNewFrom(map[string]interface{}{"max_body_byte_size": -1})
+	assert.Error(t, c.Unpack(&Limit{}))
+}
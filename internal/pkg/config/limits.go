@@ -5,14 +5,46 @@
 package config
 
 import (
+	"fmt"
 	"time"
 )
 
+const (
+	// Request bodies sent with a Content-Encoding may decode up to this multiple of the body limit
+	kDecodedBodyRatio = 10
+
+	// Decoded size limit of the request bodies sent with a Content-Encoding when the body size is unlimited
+	kDefaultMaxBodyDecoded = 100 * 1024 * 1024
+)
+
 type Limit struct {
-	Interval time.Duration `config:"interval"`
-	Burst    int           `config:"burst"`
-	Max      int64         `config:"max"`
-	MaxBody  int64         `config:"max_body_byte_size"`
+	Interval       time.Duration `config:"interval"`
+	Burst          int           `config:"burst"`
+	Max            int64         `config:"max"`
+	MaxBody        int64         `config:"max_body_byte_size"`
+	MaxBodyDecoded int64         `config:"max_body_decoded_byte_size"`
+}
+
+// Validate ensures that the configuration is valid.  The decoded body limit is derived
+// from the body limit, once overridden, unless it is set explicitly.
+func (l *Limit) Validate() error {
+	if l.MaxBody < 0 || l.MaxBodyDecoded < 0 {
+		return fmt.Errorf("body size limits must not be negative")
+	}
+	l.MaxBodyDecoded = l.DecodedBodyLimit()
+	return nil
+}
+
+// DecodedBodyLimit returns the maximum size of a request body once decoded.  It is never
+// unlimited, otherwise a small compressed body could inflate without bound.
+func (l *Limit) DecodedBodyLimit() int64 {
+	switch {
+	case l.MaxBodyDecoded > 0:
+		return l.MaxBodyDecoded
+	case l.MaxBody > 0:
+		return l.MaxBody * kDecodedBodyRatio
+	}
+	return kDefaultMaxBodyDecoded
 }
 
 type ServerLimits struct {
@@ -21,6 +53,7 @@ type ServerLimits struct {
 	MaxConnections    int           `config:"max_connections"`
 
 	CheckinLimit  Limit `config:"checkin_limit"`
+	StreamLimit   Limit `config:"stream_limit"`
 	ArtifactLimit Limit `config:"artifact_limit"`
 	EnrollLimit   Limit `config:"enroll_limit"`
 	AckLimit      Limit `config:"ack_limit"`
@@ -40,6 +73,8 @@ func (c *ServerLimits) InitDefaults() {
 		Max:      l.CheckinLimit.Max,
 		MaxBody:  l.CheckinLimit.MaxBody,
 	}
+	// Streams are held as long as long polls; same limits, separate slots
+	c.StreamLimit = c.CheckinLimit
 	c.ArtifactLimit = Limit{
 		Interval: l.ArtifactLimit.Interval,
 		Burst:    l.ArtifactLimit.Burst,
@@ -0,0 +1,32 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "fmt"
+
+// PolicySelectionRule assigns enrolling agents to a policy.  All the conditions set
+// on a rule must match the enrollment request for the rule to apply.
+type PolicySelectionRule struct {
+	Name           string          `config:"name"`
+	PolicyID       string          `config:"policy_id"`
+	EnrollmentKeys []string        `config:"enrollment_keys"`
+	LocalMetadata  []MetadataField `config:"local_metadata"`
+	UserMetadata   []MetadataField `config:"user_metadata"`
+}
+
+// Validate ensures that the configuration is valid.
+func (r *PolicySelectionRule) Validate() error {
+	if r.PolicyID == "" {
+		return fmt.Errorf("policy selection rule %q: policy_id must be set", r.Name)
+	}
+	return nil
+}
+
+// PolicySelection is the configuration for the policy selection at enrollment.
+// Rules are evaluated in order; the first rule that matches picks the policy.
+// The policy of the enrollment key is used when no rule matches.
+type PolicySelection struct {
+	Rules []PolicySelectionRule `config:"rules"`
+}
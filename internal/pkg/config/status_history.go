@@ -0,0 +1,26 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import "time"
+
+const (
+	defaultStatusHistoryRetention = 30 * 24 * time.Hour
+	defaultStatusHistoryStateTTL  = time.Hour
+)
+
+// StatusHistory is the configuration for the agent status history data stream.
+// Transitions are deleted after the retention, and kept forever if it is zero.
+// The last status seen for an agent is forgotten after the state TTL without checkin.
+type StatusHistory struct {
+	Retention time.Duration `config:"retention"`
+	StateTTL  time.Duration `config:"state_ttl"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *StatusHistory) InitDefaults() {
+	c.Retention = defaultStatusHistoryRetention
+	c.StateTTL = defaultStatusHistoryStateTTL
+}
@@ -0,0 +1,64 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultWebhooksQueueSize      = 1000
+	defaultWebhooksWorkers        = 4
+	defaultWebhooksMaxRetries     = 5
+	defaultWebhooksInitialBackoff = time.Second
+	defaultWebhooksMaxBackoff     = time.Minute
+	defaultWebhooksTimeout        = 10 * time.Second
+)
+
+// WebhookEndpoint is an endpoint notified of the agent lifecycle events.
+// The endpoint is notified of all events when no events are listed.
+// Payloads are signed with HMAC-SHA256 when a secret is set.
+type WebhookEndpoint struct {
+	Name   string   `config:"name"`
+	URL    string   `config:"url"`
+	Secret string   `config:"secret"`
+	Events []string `config:"events"`
+}
+
+// Validate ensures that the configuration is valid.
+func (e *WebhookEndpoint) Validate() error {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return fmt.Errorf("webhook %q: %w", e.Name, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("webhook %q: url must be an absolute http or https url, got %q", e.Name, e.URL)
+	}
+	return nil
+}
+
+// Webhooks is the configuration for the outbound webhook notifications.
+// Each endpoint has its own queue of queue_size deliveries and its own workers.
+type Webhooks struct {
+	Endpoints      []WebhookEndpoint `config:"endpoints"`
+	QueueSize      int               `config:"queue_size"`
+	Workers        int               `config:"workers"`
+	MaxRetries     int               `config:"max_retries"`
+	InitialBackoff time.Duration     `config:"initial_backoff"`
+	MaxBackoff     time.Duration     `config:"max_backoff"`
+	Timeout        time.Duration     `config:"timeout"`
+}
+
+// InitDefaults initializes the defaults for the configuration.
+func (c *Webhooks) InitDefaults() {
+	c.QueueSize = defaultWebhooksQueueSize
+	c.Workers = defaultWebhooksWorkers
+	c.MaxRetries = defaultWebhooksMaxRetries
+	c.InitialBackoff = defaultWebhooksInitialBackoff
+	c.MaxBackoff = defaultWebhooksMaxBackoff
+	c.Timeout = defaultWebhooksTimeout
+}
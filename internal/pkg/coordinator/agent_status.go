@@ -0,0 +1,213 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/logger"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
+)
+
+const (
+	AgentStatusOnline   = "online"
+	AgentStatusOffline  = "offline"
+	AgentStatusInactive = "inactive"
+)
+
+// WithAgentStatus enables the derivation of the status of the agents of the
+// policies this monitor is the leader of.  Agents that have not checked in for
+// the offline timeout are offline, and inactive after the inactive timeout.
+// The inactive status is disabled when the inactive timeout is zero.
+func WithAgentStatus(offlineTimeout, inactiveTimeout, checkInterval time.Duration) Opt {
+	return func(m *monitorT) {
+		m.offlineTimeout = offlineTimeout
+		m.inactiveTimeout = inactiveTimeout
+		m.statusCheckInterval = checkInterval
+	}
+}
+
+// statusRangeT selects the agents that must transition to status based on their last checkin,
+// or their enrollment if they never checked in.
+type statusRangeT struct {
+	status string
+	after  time.Time
+	before time.Time
+}
+
+func (m *monitorT) runAgentStatus(ctx context.Context, policyId string, l zerolog.Logger) {
+	sched, err := scheduler.New([]scheduler.Schedule{
+		{
+			Name:     fmt.Sprintf("agent status %s", policyId),
+			Interval: m.statusCheckInterval,
+			WorkFn: func(ctx context.Context) error {
+				return runAgentStatusWork(ctx, m.bulker, m.wh, policyId, m.offlineTimeout, m.inactiveTimeout, l, m.agentsIndex, m.statusHistoryIndex)
+			},
+		},
+	})
+	if err != nil {
+		l.Err(err).Msg("failed to create agent status scheduler")
+		return
+	}
+
+	l.Info().
+		Dur("checkInterval", m.statusCheckInterval).
+		Dur("offlineTimeout", m.offlineTimeout).
+		Dur("inactiveTimeout", m.inactiveTimeout).
+		Msg("agent status monitor start")
+	defer l.Info().Msg("Agent status monitor exit")
+
+	if err := sched.Run(ctx); err != nil {
+		l.Err(err).Msg("agent status scheduler failed")
+	}
+}
+
+func runAgentStatusWork(ctx context.Context, bulker bulk.Bulk, wh *webhook.Dispatcher, policyId string, offlineTimeout, inactiveTimeout time.Duration, zlog zerolog.Logger, agentsIndex, historyIndex string) error {
+	now := time.Now().UTC()
+	offlineAt := now.Add(-offlineTimeout)
+
+	// Agents that checked in since going offline are back online; the upper
+	// bound leaves room for clock skew between the Fleet Servers.
+	ranges := []statusRangeT{
+		{status: AgentStatusOnline, after: offlineAt, before: now.Add(offlineTimeout)},
+	}
+	if inactiveTimeout > 0 {
+		inactiveAt := now.Add(-inactiveTimeout)
+		ranges = append(ranges,
+			statusRangeT{status: AgentStatusOffline, after: inactiveAt, before: offlineAt},
+			statusRangeT{status: AgentStatusInactive, after: time.Unix(0, 0), before: inactiveAt},
+		)
+	} else {
+		ranges = append(ranges,
+			statusRangeT{status: AgentStatusOffline, after: time.Unix(0, 0), before: offlineAt},
+		)
+	}
+
+	for _, r := range ranges {
+		for _, findF := range []findAgentsFunc{dl.FindAgentsByCheckinRange, dl.FindAgentsByEnrollRange} {
+			if err := transitionAgents(ctx, bulker, wh, findF, policyId, r, zlog, agentsIndex, historyIndex); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type findAgentsFunc func(ctx context.Context, bulker bulk.Bulk, policyId, status string, after, before time.Time, searchAfter []json.RawMessage, opt ...dl.Option) ([]model.Agent, []json.RawMessage, error)
+
+func transitionAgents(ctx context.Context, bulker bulk.Bulk, wh *webhook.Dispatcher, findF findAgentsFunc, policyId string, r statusRangeT, zlog zerolog.Logger, agentsIndex, historyIndex string) error {
+	// Page through all the agents to transition.  The updated agents drop out
+	// of the search once refreshed, which does not move the pages after the cursor.
+	var searchAfter []json.RawMessage
+	for {
+		agents, next, err := findF(ctx, bulker, policyId, r.status, r.after, r.before, searchAfter, dl.WithIndexName(agentsIndex))
+		if err != nil {
+			return err
+		}
+		if len(agents) > 0 {
+			if err = updateAgentStatus(ctx, zlog, bulker, wh, agents, r.status, agentsIndex, historyIndex); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		searchAfter = next
+	}
+}
+
+func updateAgentStatus(ctx context.Context, zlog zerolog.Logger, bulker bulk.Bulk, wh *webhook.Dispatcher, agents []model.Agent, status, agentsIndex, historyIndex string) error {
+	now := time.Now().UTC()
+	fields := bulk.UpdateFields{
+		dl.FieldStatus:    status,
+		dl.FieldUpdatedAt: now.Format(time.RFC3339),
+	}
+	body, err := fields.Marshal()
+	if err != nil {
+		return err
+	}
+
+	updates := make([]bulk.MultiOp, len(agents))
+	history := make([]bulk.MultiOp, 0, len(agents))
+	var notify []webhook.Event
+	for i, agent := range agents {
+		updates[i] = bulk.MultiOp{
+			Id:    agent.Id,
+			Index: agentsIndex,
+			Body:  body,
+		}
+
+		// An agent without a status yet was online until now
+		from := agent.Status
+		if from == "" {
+			from = AgentStatusOnline
+		}
+		if from == status {
+			continue
+		}
+
+		doc, err := json.Marshal(model.AgentStatusHistory{
+			Timestamp:         now.Format(time.RFC3339Nano),
+			AgentId:           agent.Id,
+			PolicyId:          agent.PolicyId,
+			PolicyRevisionIdx: agent.PolicyRevisionIdx,
+			FromStatus:        from,
+			ToStatus:          status,
+		})
+		if err != nil {
+			return err
+		}
+		history = append(history, bulk.MultiOp{
+			Index: historyIndex,
+			Body:  doc,
+		})
+
+		if status == AgentStatusOffline {
+			notify = append(notify, webhook.Event{
+				Type:     webhook.EventAgentOffline,
+				AgentId:  agent.Id,
+				PolicyId: agent.PolicyId,
+			})
+		}
+	}
+
+	zlog = zlog.With().Str(dl.FieldStatus, status).Int("count", len(agents)).Logger()
+
+	items, err := bulker.MUpdate(ctx, updates)
+	if err != nil {
+		zlog.Error().Err(err).Msg("Fail agent status update")
+		return err
+	}
+	for _, item := range items {
+		if err = es.TranslateError(item.Status, item.Error); err != nil {
+			zlog.Error().Err(err).Str(logger.AgentId, item.DocumentID).Msg("Fail agent status update")
+			return err
+		}
+	}
+
+	if len(history) > 0 {
+		if _, err = bulker.MCreate(ctx, history); err != nil {
+			zlog.Warn().Err(err).Msg("Fail agent status history write")
+		}
+	}
+
+	for _, ev := range notify {
+		wh.Notify(ev)
+	}
+
+	zlog.Info().Msg("updated agent status")
+	return nil
+}
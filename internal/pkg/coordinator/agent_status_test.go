@@ -0,0 +1,187 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/es"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+	ftesting "github.com/elastic/fleet-server/v7/internal/pkg/testing"
+)
+
+type statusBulk struct {
+	ftesting.MockBulk
+
+	// agents returned by the search for the agents to transition to the status
+	agents map[string][]model.Agent
+	// agents that never checked in, returned by the search by enrollment time
+	enrolled map[string][]model.Agent
+	searches int
+	updates  []bulk.MultiOp
+	creates  []bulk.MultiOp
+}
+
+func (m *statusBulk) Search(ctx context.Context, index string, body []byte, opts ...bulk.Opt) (*es.ResultT, error) {
+	var q struct {
+		Query struct {
+			Bool struct {
+				MustNot []struct {
+					Term map[string]string `json:"term"`
+				} `json:"must_not"`
+			} `json:"bool"`
+		} `json:"query"`
+		Sort        []string `json:"sort"`
+		SearchAfter []int    `json:"search_after"`
+	}
+	if err := json.Unmarshal(body, &q); err != nil {
+		return nil, err
+	}
+
+	status := q.Query.Bool.MustNot[0].Term[dl.FieldStatus]
+	agents := m.agents[status]
+	if q.Sort[0] == dl.FieldEnrolledAt {
+		agents = m.enrolled[status]
+	}
+
+	// The position of the agent in the list is its sort value
+	start := 0
+	if len(q.SearchAfter) > 0 {
+		start = q.SearchAfter[0] + 1
+	}
+	m.searches++
+
+	var hits []es.HitT
+	for i := start; i < len(agents) && len(hits) < dl.MaxAgentsByCheckinRange; i++ {
+		src, err := json.Marshal(agents[i])
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, es.HitT{Id: agents[i].Id, Source: src, Sort: []json.RawMessage{json.RawMessage(strconv.Itoa(i))}})
+	}
+	return &es.ResultT{HitsT: es.HitsT{Hits: hits}}, nil
+}
+
+func (m *statusBulk) MUpdate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.updates = append(m.updates, ops...)
+	items := make([]bulk.BulkIndexerResponseItem, len(ops))
+	for i, op := range ops {
+		items[i] = bulk.BulkIndexerResponseItem{DocumentID: op.Id, Status: 200}
+	}
+	return items, nil
+}
+
+func (m *statusBulk) MCreate(ctx context.Context, ops []bulk.MultiOp, opts ...bulk.Opt) ([]bulk.BulkIndexerResponseItem, error) {
+	m.creates = append(m.creates, ops...)
+	return nil, nil
+}
+
+func TestRunAgentStatusWork(t *testing.T) {
+	mockBulk := &statusBulk{
+		agents: map[string][]model.Agent{
+			AgentStatusOnline: {
+				{ESDocument: model.ESDocument{Id: "back-online"}, PolicyId: "policy-id", PolicyRevisionIdx: 2, Status: AgentStatusOffline},
+				{ESDocument: model.ESDocument{Id: "no-status"}, PolicyId: "policy-id", PolicyRevisionIdx: 2},
+			},
+			AgentStatusOffline: {
+				{ESDocument: model.ESDocument{Id: "gone-offline"}, PolicyId: "policy-id", PolicyRevisionIdx: 3, Status: AgentStatusOnline},
+			},
+			AgentStatusInactive: {
+				{ESDocument: model.ESDocument{Id: "gone-inactive"}, PolicyId: "policy-id", PolicyRevisionIdx: 1},
+			},
+		},
+		enrolled: map[string][]model.Agent{
+			AgentStatusOffline: {
+				{ESDocument: model.ESDocument{Id: "never-checked-in"}, PolicyId: "policy-id", PolicyRevisionIdx: 1},
+			},
+		},
+	}
+
+	err := runAgentStatusWork(context.Background(), mockBulk, nil, "policy-id", 6*time.Minute, 24*time.Hour, log.Logger, dl.FleetAgents, dl.FleetAgentStatusHistory)
+	require.NoError(t, err)
+
+	statuses := make(map[string]string)
+	for _, op := range mockBulk.updates {
+		assert.Equal(t, dl.FleetAgents, op.Index)
+
+		var m map[string]map[string]interface{}
+		require.NoError(t, json.Unmarshal(op.Body, &m))
+		statuses[op.Id] = m["doc"][dl.FieldStatus].(string)
+	}
+	assert.Equal(t, map[string]string{
+		"back-online":      AgentStatusOnline,
+		"no-status":        AgentStatusOnline,
+		"gone-offline":     AgentStatusOffline,
+		"gone-inactive":    AgentStatusInactive,
+		"never-checked-in": AgentStatusOffline,
+	}, statuses)
+
+	// No history for the agent without a previous status becoming online
+	var history []model.AgentStatusHistory
+	for _, op := range mockBulk.creates {
+		assert.Equal(t, dl.FleetAgentStatusHistory, op.Index)
+
+		var doc model.AgentStatusHistory
+		require.NoError(t, json.Unmarshal(op.Body, &doc))
+		assert.NotEmpty(t, doc.Timestamp)
+		doc.Timestamp = ""
+		history = append(history, doc)
+	}
+	assert.Equal(t, []model.AgentStatusHistory{
+		{AgentId: "back-online", PolicyId: "policy-id", PolicyRevisionIdx: 2, FromStatus: AgentStatusOffline, ToStatus: AgentStatusOnline},
+		{AgentId: "gone-offline", PolicyId: "policy-id", PolicyRevisionIdx: 3, FromStatus: AgentStatusOnline, ToStatus: AgentStatusOffline},
+		{AgentId: "never-checked-in", PolicyId: "policy-id", PolicyRevisionIdx: 1, FromStatus: AgentStatusOnline, ToStatus: AgentStatusOffline},
+		{AgentId: "gone-inactive", PolicyId: "policy-id", PolicyRevisionIdx: 1, FromStatus: AgentStatusOnline, ToStatus: AgentStatusInactive},
+	}, history)
+}
+
+func TestRunAgentStatusWorkNoInactive(t *testing.T) {
+	mockBulk := &statusBulk{
+		agents: map[string][]model.Agent{
+			AgentStatusInactive: {
+				{ESDocument: model.ESDocument{Id: "never-inactive"}, PolicyId: "policy-id"},
+			},
+		},
+	}
+
+	err := runAgentStatusWork(context.Background(), mockBulk, nil, "policy-id", 6*time.Minute, 0, log.Logger, dl.FleetAgents, dl.FleetAgentStatusHistory)
+	require.NoError(t, err)
+	assert.Empty(t, mockBulk.updates)
+	assert.Empty(t, mockBulk.creates)
+}
+
+func TestRunAgentStatusWorkPages(t *testing.T) {
+	const count = 2*dl.MaxAgentsByCheckinRange + 10
+
+	agents := make([]model.Agent, count)
+	for i := range agents {
+		agents[i] = model.Agent{ESDocument: model.ESDocument{Id: fmt.Sprintf("agent-%d", i)}, PolicyId: "policy-id", Status: AgentStatusOnline}
+	}
+	mockBulk := &statusBulk{
+		agents: map[string][]model.Agent{AgentStatusOffline: agents},
+	}
+
+	err := runAgentStatusWork(context.Background(), mockBulk, nil, "policy-id", 6*time.Minute, 0, log.Logger, dl.FleetAgents, dl.FleetAgentStatusHistory)
+	require.NoError(t, err)
+
+	// One search for online, three pages for offline, and one of each for the agents that never checked in
+	assert.Equal(t, 6, mockBulk.searches)
+	assert.Len(t, mockBulk.updates, count)
+	assert.Len(t, mockBulk.creates, count)
+}
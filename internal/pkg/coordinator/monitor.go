@@ -24,6 +24,7 @@ import (
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"github.com/elastic/fleet-server/v7/internal/pkg/monitor"
 	"github.com/elastic/fleet-server/v7/internal/pkg/sleep"
+	"github.com/elastic/fleet-server/v7/internal/pkg/webhook"
 )
 
 const (
@@ -68,17 +69,35 @@ type monitorT struct {
 	coordRestartDelay     time.Duration
 	unenrollCheckInterval time.Duration
 
-	serversIndex  string
-	policiesIndex string
-	leadersIndex  string
-	agentsIndex   string
+	offlineTimeout      time.Duration
+	inactiveTimeout     time.Duration
+	statusCheckInterval time.Duration
+
+	serversIndex       string
+	policiesIndex      string
+	leadersIndex       string
+	agentsIndex        string
+	statusHistoryIndex string
+
+	wh *webhook.Dispatcher
 
 	policies map[string]policyT
 }
 
+// Opt is an option for the coordinator policy monitor.
+type Opt func(*monitorT)
+
+// WithNotifier notifies the webhook dispatcher of the agents unenrolled
+// on timeout and of the agents going offline.
+func WithNotifier(wh *webhook.Dispatcher) Opt {
+	return func(m *monitorT) {
+		m.wh = wh
+	}
+}
+
 // NewMonitor creates a new coordinator policy monitor.
-func NewMonitor(fleet config.Fleet, version string, bulker bulk.Bulk, monitor monitor.Monitor, factory Factory) Monitor {
-	return &monitorT{
+func NewMonitor(fleet config.Fleet, version string, bulker bulk.Bulk, monitor monitor.Monitor, factory Factory, opts ...Opt) Monitor {
+	m := &monitorT{
 		log:                   log.With().Str("ctx", "policy leader manager").Logger(),
 		version:               version,
 		fleet:                 fleet,
@@ -94,8 +113,15 @@ func NewMonitor(fleet config.Fleet, version string, bulker bulk.Bulk, monitor mo
 		policiesIndex:         dl.FleetPolicies,
 		leadersIndex:          dl.FleetPoliciesLeader,
 		agentsIndex:           dl.FleetAgents,
+		statusHistoryIndex:    dl.FleetAgentStatusHistory,
 		policies:              make(map[string]policyT),
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
 // Run runs the monitor.
@@ -276,6 +302,9 @@ func (m *monitorT) ensureLeadership(ctx context.Context) error {
 				cordCtx, canceller := context.WithCancel(ctx)
 				go runCoordinator(cordCtx, cord, l, m.coordRestartDelay)
 				go runCoordinatorOutput(cordCtx, cord, m.bulker, l, m.policiesIndex)
+				if m.offlineTimeout > 0 {
+					go m.runAgentStatus(cordCtx, pt.id, l)
+				}
 				pt.cord = cord
 				pt.cordCanceller = canceller
 			} else {
@@ -388,7 +417,7 @@ func (m *monitorT) rescheduleUnenroller(ctx context.Context, pt *policyT, p *mod
 		if unenrollTimeout > 0 {
 			// start worker for unenrolling agents based timeout
 			unenrollCtx, canceller := context.WithCancel(ctx)
-			go runUnenroller(unenrollCtx, m.bulker, pt.id, unenrollTimeout, l, m.unenrollCheckInterval, m.agentsIndex)
+			go runUnenroller(unenrollCtx, m.bulker, m.wh, pt.id, unenrollTimeout, l, m.unenrollCheckInterval, m.agentsIndex)
 			pt.unenrollCanceller = canceller
 		}
 		pt.unenrollTimeout = unenrollTimeout
@@ -429,7 +458,7 @@ func runCoordinatorOutput(ctx context.Context, cord Coordinator, bulker bulk.Bul
 	}
 }
 
-func runUnenroller(ctx context.Context, bulker bulk.Bulk, policyId string, unenrollTimeout time.Duration, l zerolog.Logger, checkInterval time.Duration, agentsIndex string) {
+func runUnenroller(ctx context.Context, bulker bulk.Bulk, wh *webhook.Dispatcher, policyId string, unenrollTimeout time.Duration, l zerolog.Logger, checkInterval time.Duration, agentsIndex string) {
 	l.Info().
 		Dur("checkInterval", checkInterval).
 		Dur("unenrollTimeout", unenrollTimeout).
@@ -442,7 +471,7 @@ func runUnenroller(ctx context.Context, bulker bulk.Bulk, policyId string, unenr
 	for {
 		select {
 		case <-t.C:
-			if err := runUnenrollerWork(ctx, bulker, policyId, unenrollTimeout, l, agentsIndex); err != nil {
+			if err := runUnenrollerWork(ctx, bulker, wh, policyId, unenrollTimeout, l, agentsIndex); err != nil {
 				l.Err(err).Dur("unenroll_timeout", unenrollTimeout).Msg("failed to unenroll offline agents")
 			}
 			t.Reset(checkInterval)
@@ -452,7 +481,7 @@ func runUnenroller(ctx context.Context, bulker bulk.Bulk, policyId string, unenr
 	}
 }
 
-func runUnenrollerWork(ctx context.Context, bulker bulk.Bulk, policyId string, unenrollTimeout time.Duration, zlog zerolog.Logger, agentsIndex string) error {
+func runUnenrollerWork(ctx context.Context, bulker bulk.Bulk, wh *webhook.Dispatcher, policyId string, unenrollTimeout time.Duration, zlog zerolog.Logger, agentsIndex string) error {
 	agents, err := dl.FindOfflineAgents(ctx, bulker, policyId, unenrollTimeout, dl.WithIndexName(agentsIndex))
 	if err != nil || len(agents) == 0 {
 		return err
@@ -468,6 +497,13 @@ func runUnenrollerWork(ctx context.Context, bulker bulk.Bulk, policyId string, u
 			return err
 		}
 		agentIds[i] = agent.Id
+
+		wh.Notify(webhook.Event{
+			Type:     webhook.EventAgentUnenrolled,
+			AgentId:  agent.Id,
+			PolicyId: agent.PolicyId,
+			Reason:   unenrolledReasonTimeout,
+		})
 	}
 
 	zlog.Info().
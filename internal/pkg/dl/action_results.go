@@ -6,12 +6,32 @@ package dl
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
 	"github.com/elastic/fleet-server/v7/internal/pkg/model"
 	"time"
 )
 
+// ActionResultId returns the document id of the result of an action for an agent.
+// Results are created with this id; the create of a retried ack fails with a version conflict
+// instead of duplicating the result.
+func ActionResultId(actionId, agentId string) string {
+	h := sha256.New()
+	h.Write([]byte(actionId))
+	h.Write([]byte{0})
+	h.Write([]byte(agentId))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ExpiredActionResultId returns the document id of the expired result of an action for an agent.
+// It is distinct from the id of the acked result so that an ack of an action the agent received
+// before it expired is still recorded, along with its side effects.
+func ExpiredActionResultId(actionId, agentId string) string {
+	return ActionResultId("expired:"+actionId, agentId)
+}
+
 func CreateActionResult(ctx context.Context, bulker bulk.Bulk, acr model.ActionResult) (string, error) {
 	return createActionResult(ctx, bulker, FleetActionsResults, acr)
 }
@@ -20,6 +40,9 @@ func createActionResult(ctx context.Context, bulker bulk.Bulk, index string, acr
 	if acr.Timestamp == "" {
 		acr.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	}
+	if acr.Id == "" {
+		acr.Id = ActionResultId(acr.ActionId, acr.AgentId)
+	}
 	body, err := json.Marshal(acr)
 	if err != nil {
 		return "", nil
@@ -27,3 +50,36 @@ func createActionResult(ctx context.Context, bulker bulk.Bulk, index string, acr
 
 	return bulker.Create(ctx, index, acr.Id, body, bulk.WithRefresh())
 }
+
+// CreateActionResults writes the action results in one bulk request.
+// The response items are in the order of the results; an item fails with a
+// version conflict if the result of the action for the agent already exists.
+func CreateActionResults(ctx context.Context, bulker bulk.Bulk, acrs []model.ActionResult) ([]bulk.BulkIndexerResponseItem, error) {
+	return createActionResults(ctx, bulker, FleetActionsResults, acrs)
+}
+
+func createActionResults(ctx context.Context, bulker bulk.Bulk, index string, acrs []model.ActionResult) ([]bulk.BulkIndexerResponseItem, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	ops := make([]bulk.MultiOp, len(acrs))
+	for i, acr := range acrs {
+		if acr.Timestamp == "" {
+			acr.Timestamp = now
+		}
+		if acr.Id == "" {
+			acr.Id = ActionResultId(acr.ActionId, acr.AgentId)
+		}
+		body, err := json.Marshal(acr)
+		if err != nil {
+			return nil, err
+		}
+
+		ops[i] = bulk.MultiOp{
+			Id:    acr.Id,
+			Index: index,
+			Body:  body,
+		}
+	}
+
+	return bulker.MCreate(ctx, ops, bulk.WithRefresh())
+}
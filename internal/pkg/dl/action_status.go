@@ -0,0 +1,57 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package dl
+
+import (
+	"context"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dsl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/model"
+)
+
+var (
+	// Query for the GC of the status of actions without expiration
+	QueryFindActionStatusWithoutExpiration = prepareFindActionStatusWithoutExpiration()
+)
+
+// Pages through the status documents in action id order, starting after the bound action id.
+func prepareFindActionStatusWithoutExpiration() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	query := root.Query().Bool()
+	query.MustNot().Exists(FieldExpiration)
+	query.Filter().Range(FieldActionId, dsl.WithRangeGT(tmpl.Bind(FieldActionId)))
+	root.Source().Includes(FieldActionId)
+	root.Sort().SortOrder(FieldActionId, dsl.SortAscend)
+	root.WithSize(tmpl.Bind(FieldSize))
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// FindActionStatusWithoutExpiration returns the status documents of the actions that never
+// expire, in action id order after the given action id.
+func FindActionStatusWithoutExpiration(ctx context.Context, bulker bulk.Bulk, after string, size int, opts ...Option) ([]model.ActionStatus, error) {
+	o := newOption(FleetActionsStatus, opts...)
+	params := map[string]interface{}{
+		FieldActionId: after,
+		FieldSize:     size,
+	}
+
+	res, err := findActionsHits(ctx, bulker, QueryFindActionStatusWithoutExpiration, o.indexName, params, nil)
+	if err != nil || res == nil {
+		return nil, err
+	}
+
+	statuses := make([]model.ActionStatus, 0, len(res.Hits))
+	for _, hit := range res.Hits {
+		var status model.ActionStatus
+		if err := hit.Unmarshal(&status); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -29,6 +29,7 @@ const (
 
 var (
 	QueryAction          = prepareFindAction()
+	QueryActions         = prepareFindActions()
 	QueryAllAgentActions = prepareFindAllAgentsActions()
 	QueryAgentActions    = prepareFindAgentActions()
 
@@ -53,6 +54,19 @@ func prepareFindAction() *dsl.Tmpl {
 	return tmpl
 }
 
+// One document per action id; the documents of an action dispatched to many agents share the action id.
+func prepareFindActions() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+	root := dsl.NewRoot()
+	filter := root.Query().Bool().Filter()
+	filter.Terms(FieldActionId, tmpl.Bind(FieldActionId), nil)
+	root.Param("collapse", map[string]interface{}{"field": FieldActionId})
+	root.Source().Excludes(FieldAgents)
+	root.WithSize(tmpl.Bind(FieldSize))
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
 func prepareDeleteExpiredAction() *dsl.Tmpl {
 	tmpl := dsl.NewTmpl()
 	root := dsl.NewRoot()
@@ -109,6 +123,15 @@ func FindAction(ctx context.Context, bulker bulk.Bulk, id string, opts ...Option
 	}, nil)
 }
 
+// FindActions returns the actions matching any of the action ids in one search.
+func FindActions(ctx context.Context, bulker bulk.Bulk, ids []string, opts ...Option) ([]model.Action, error) {
+	o := newOption(FleetActions, opts...)
+	return findActions(ctx, bulker, QueryActions, o.indexName, map[string]interface{}{
+		FieldActionId: ids,
+		FieldSize:     len(ids),
+	}, nil)
+}
+
 func FindAgentActions(ctx context.Context, bulker bulk.Bulk, minSeqNo, maxSeqNo sqn.SeqNo, agentId string) ([]model.Action, error) {
 	const index = FleetActions
 	params := map[string]interface{}{
@@ -42,4 +42,18 @@ func TestSearchActionsQuery(t *testing.T) {
 		}
 	})
 
+	t.Run("actions by ids", func(t *testing.T) {
+		ids := []string{actions[0].ActionId, actions[3].ActionId, "unknown-action-id"}
+
+		foundActions, err := FindActions(ctx, bulker, ids, WithIndexName(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff := cmp.Diff(2, len(foundActions))
+		if diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
 }
@@ -6,6 +6,7 @@ package dl
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
@@ -15,12 +16,29 @@ import (
 
 const (
 	FieldAccessAPIKeyID = "access_api_key_id"
+
+	maxAgentsByHostID = 100
+
+	// MaxAgentsByCheckinRange is the maximum number of agents returned by FindAgentsByCheckinRange.
+	MaxAgentsByCheckinRange = 1000
+
+	fieldAgentId     = "agent.id"
+	fieldTimeAfter   = "time_after"
+	fieldTimeBefore  = "time_before"
+	fieldSearchAfter = "search_after"
 )
 
 var (
-	QueryAgentByAssessAPIKeyID   = prepareAgentFindByAccessAPIKeyID()
-	QueryAgentByID               = prepareAgentFindByID()
-	QueryOfflineAgentsByPolicyID = prepareOfflineAgentsByPolicyID()
+	QueryAgentByAssessAPIKeyID     = prepareAgentFindByAccessAPIKeyID()
+	QueryAgentByID                 = prepareAgentFindByID()
+	QueryAgentBySharedID           = prepareAgentFindBySharedID()
+	QueryOfflineAgentsByPolicyID   = prepareOfflineAgentsByPolicyID()
+	QueryActiveAgentsByHostID      = prepareActiveAgentsByHostID()
+	QueryAgentByIdempotencyKey     = prepareAgentFindByIdempotencyKey()
+	QueryAgentsByCheckinRange      = prepareAgentsByTimeRange(FieldLastCheckin, false)
+	QueryAgentsByCheckinRangeAfter = prepareAgentsByTimeRange(FieldLastCheckin, true)
+	QueryAgentsByEnrollRange       = prepareAgentsByTimeRange(FieldEnrolledAt, false)
+	QueryAgentsByEnrollRangeAfter  = prepareAgentsByTimeRange(FieldEnrolledAt, true)
 )
 
 func prepareAgentFindByID() *dsl.Tmpl {
@@ -31,6 +49,10 @@ func prepareAgentFindByAccessAPIKeyID() *dsl.Tmpl {
 	return prepareAgentFindByField(FieldAccessAPIKeyID)
 }
 
+func prepareAgentFindBySharedID() *dsl.Tmpl {
+	return prepareAgentFindByField(FieldSharedId)
+}
+
 func prepareAgentFindByField(field string) *dsl.Tmpl {
 	return prepareFindByField(field, map[string]interface{}{"version": true})
 }
@@ -48,6 +70,67 @@ func prepareOfflineAgentsByPolicyID() *dsl.Tmpl {
 	return tmpl
 }
 
+func prepareActiveAgentsByHostID() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+
+	root := dsl.NewRoot()
+	root.Size(maxAgentsByHostID)
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldActive, true, nil)
+	filter.Term(FieldHostId, tmpl.Bind(FieldHostId), nil)
+	filter.Term(FieldPolicyId, tmpl.Bind(FieldPolicyId), nil)
+	root.Sort().SortOrder(FieldEnrolledAt, dsl.SortDescend)
+
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+func prepareAgentFindByIdempotencyKey() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+
+	root := dsl.NewRoot()
+	root.Size(1)
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldIdempotencyKey, tmpl.Bind(FieldIdempotencyKey), nil)
+	filter.Term(FieldEnrollmentApiKeyId, tmpl.Bind(FieldEnrollmentApiKeyId), nil)
+	filter.Range(FieldEnrolledAt, dsl.WithRangeGT(tmpl.Bind(FieldEnrolledAt)))
+	root.Sort().SortOrder(FieldEnrolledAt, dsl.SortDescend)
+
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
+// Agents in a range of the time field.  Agents that never checked in are selected
+// by their enrollment time instead.
+func prepareAgentsByTimeRange(field string, searchAfter bool) *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+
+	root := dsl.NewRoot()
+	root.Size(MaxAgentsByCheckinRange)
+	sort := root.Sort()
+	sort.SortOrder(field, dsl.SortAscend)
+	sort.SortOrder(fieldAgentId, dsl.SortAscend)
+	if searchAfter {
+		root.Param(fieldSearchAfter, tmpl.Bind(fieldSearchAfter))
+	}
+	query := root.Query().Bool()
+	filter := query.Filter()
+	filter.Term(FieldActive, true, nil)
+	filter.Term(FieldPolicyId, tmpl.Bind(FieldPolicyId), nil)
+	filter.Range(field,
+		dsl.WithRangeGT(tmpl.Bind(fieldTimeAfter)),
+		dsl.WithRangeLTE(tmpl.Bind(fieldTimeBefore)),
+	)
+	mustNot := query.MustNot()
+	mustNot.Term(FieldStatus, tmpl.Bind(FieldStatus), nil)
+	if field != FieldLastCheckin {
+		mustNot.Exists(FieldLastCheckin)
+	}
+
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
 func FindAgent(ctx context.Context, bulker bulk.Bulk, tmpl *dsl.Tmpl, name string, v interface{}, opt ...Option) (agent model.Agent, err error) {
 	o := newOption(FleetAgents, opt...)
 	res, err := SearchWithOneParam(ctx, bulker, tmpl, o.indexName, name, v)
@@ -86,3 +169,108 @@ func FindOfflineAgents(ctx context.Context, bulker bulk.Bulk, policyId string, u
 	}
 	return agents, nil
 }
+
+// FindActiveAgentsByHostID returns the active agents enrolled in the policy from
+// the host with the given id, most recently enrolled first.
+func FindActiveAgentsByHostID(ctx context.Context, bulker bulk.Bulk, hostId, policyId string, opt ...Option) ([]model.Agent, error) {
+	o := newOption(FleetAgents, opt...)
+	res, err := Search(ctx, bulker, QueryActiveAgentsByHostID, o.indexName, map[string]interface{}{
+		FieldHostId:   hostId,
+		FieldPolicyId: policyId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Hits) == 0 {
+		return nil, nil
+	}
+
+	agents := make([]model.Agent, len(res.Hits))
+	for i, hit := range res.Hits {
+		if err := hit.Unmarshal(&agents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return agents, nil
+}
+
+// FindAgentByIdempotencyKey returns the agent enrolled after since with the
+// enrollment api key and the idempotency key of the enrollment request.
+func FindAgentByIdempotencyKey(ctx context.Context, bulker bulk.Bulk, enrollmentApiKeyId, idempotencyKey string, since time.Time, opt ...Option) (agent model.Agent, err error) {
+	o := newOption(FleetAgents, opt...)
+	res, err := Search(ctx, bulker, QueryAgentByIdempotencyKey, o.indexName, map[string]interface{}{
+		FieldIdempotencyKey:     idempotencyKey,
+		FieldEnrollmentApiKeyId: enrollmentApiKeyId,
+		FieldEnrolledAt:         since.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+
+	if len(res.Hits) == 0 {
+		return agent, ErrNotFound
+	}
+
+	err = res.Hits[0].Unmarshal(&agent)
+	return agent, err
+}
+
+// FindAgentsByCheckinRange returns a page of the active agents enrolled in the policy
+// that last checked in after the after time and no later than the before time, and
+// whose status is not the given status.  The agents are sorted by last checkin; the
+// returned cursor is passed back as searchAfter to fetch the next page, and is nil
+// once the last page was returned.
+func FindAgentsByCheckinRange(ctx context.Context, bulker bulk.Bulk, policyId, status string, after, before time.Time, searchAfter []json.RawMessage, opt ...Option) ([]model.Agent, []json.RawMessage, error) {
+	tmpl := QueryAgentsByCheckinRange
+	if searchAfter != nil {
+		tmpl = QueryAgentsByCheckinRangeAfter
+	}
+	return findAgentsByTimeRange(ctx, bulker, tmpl, policyId, status, after, before, searchAfter, opt...)
+}
+
+// FindAgentsByEnrollRange is FindAgentsByCheckinRange for the agents that enrolled but
+// never checked in, by their enrollment time.
+func FindAgentsByEnrollRange(ctx context.Context, bulker bulk.Bulk, policyId, status string, after, before time.Time, searchAfter []json.RawMessage, opt ...Option) ([]model.Agent, []json.RawMessage, error) {
+	tmpl := QueryAgentsByEnrollRange
+	if searchAfter != nil {
+		tmpl = QueryAgentsByEnrollRangeAfter
+	}
+	return findAgentsByTimeRange(ctx, bulker, tmpl, policyId, status, after, before, searchAfter, opt...)
+}
+
+func findAgentsByTimeRange(ctx context.Context, bulker bulk.Bulk, tmpl *dsl.Tmpl, policyId, status string, after, before time.Time, searchAfter []json.RawMessage, opt ...Option) ([]model.Agent, []json.RawMessage, error) {
+	o := newOption(FleetAgents, opt...)
+
+	params := map[string]interface{}{
+		FieldPolicyId:   policyId,
+		FieldStatus:     status,
+		fieldTimeAfter:  after.UTC().Format(time.RFC3339),
+		fieldTimeBefore: before.UTC().Format(time.RFC3339),
+	}
+	if searchAfter != nil {
+		params[fieldSearchAfter] = searchAfter
+	}
+
+	res, err := Search(ctx, bulker, tmpl, o.indexName, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(res.Hits) == 0 {
+		return nil, nil, nil
+	}
+
+	agents := make([]model.Agent, len(res.Hits))
+	for i, hit := range res.Hits {
+		if err := hit.Unmarshal(&agents[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var next []json.RawMessage
+	if len(res.Hits) == MaxAgentsByCheckinRange {
+		next = res.Hits[len(res.Hits)-1].Sort
+	}
+	return agents, next, nil
+}
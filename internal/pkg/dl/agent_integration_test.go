@@ -109,3 +109,113 @@ func TestFindOfflineAgents(t *testing.T) {
 	require.Len(t, agents, 2)
 	assert.EqualValues(t, []string{twoDayOldID, threeDayOldID}, []string{agents[0].Id, agents[1].Id})
 }
+
+func TestFindAgentByIdempotencyKey(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+
+	index, bulker := ftesting.SetupIndexWithBulk(ctx, t, es.MappingAgent)
+
+	now := time.Now().UTC()
+	enrollKeyID := uuid.Must(uuid.NewV4()).String()
+
+	agents := map[string]model.Agent{
+		"recent": {
+			Active:             true,
+			EnrolledAt:         now.Format(time.RFC3339),
+			EnrollmentApiKeyId: enrollKeyID,
+			IdempotencyKey:     "recent",
+		},
+		"stale": {
+			Active:             true,
+			EnrolledAt:         now.Add(-2 * time.Hour).Format(time.RFC3339),
+			EnrollmentApiKeyId: enrollKeyID,
+			IdempotencyKey:     "stale",
+		},
+	}
+	ids := make(map[string]string, len(agents))
+	for name, agent := range agents {
+		body, err := json.Marshal(agent)
+		require.NoError(t, err)
+		ids[name] = uuid.Must(uuid.NewV4()).String()
+		_, err = bulker.Create(ctx, index, ids[name], body, bulk.WithRefresh())
+		require.NoError(t, err)
+	}
+
+	since := now.Add(-time.Hour)
+
+	agent, err := FindAgentByIdempotencyKey(ctx, bulker, enrollKeyID, "recent", since, WithIndexName(index))
+	require.NoError(t, err)
+	assert.Equal(t, ids["recent"], agent.Id)
+
+	_, err = FindAgentByIdempotencyKey(ctx, bulker, enrollKeyID, "stale", since, WithIndexName(index))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = FindAgentByIdempotencyKey(ctx, bulker, "other-key", "recent", since, WithIndexName(index))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFindActiveAgentsByHostID(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+
+	index, bulker := ftesting.SetupIndexWithBulk(ctx, t, es.MappingAgent)
+
+	now := time.Now().UTC()
+	policyID := uuid.Must(uuid.NewV4()).String()
+	localMeta := json.RawMessage(`{"host": {"id": "host-1"}}`)
+
+	agents := map[string]model.Agent{
+		"older": {
+			Active:        true,
+			PolicyId:      policyID,
+			HostId:        "host-1",
+			LocalMetadata: localMeta,
+			EnrolledAt:    now.Add(-2 * time.Hour).Format(time.RFC3339),
+		},
+		"newer": {
+			Active:        true,
+			PolicyId:      policyID,
+			HostId:        "host-1",
+			LocalMetadata: localMeta,
+			EnrolledAt:    now.Add(-time.Hour).Format(time.RFC3339),
+		},
+		"inactive": {
+			Active:        false,
+			PolicyId:      policyID,
+			HostId:        "host-1",
+			LocalMetadata: localMeta,
+			EnrolledAt:    now.Format(time.RFC3339),
+		},
+		"other host": {
+			Active:     true,
+			PolicyId:   policyID,
+			HostId:     "host-2",
+			EnrolledAt: now.Format(time.RFC3339),
+		},
+		"other policy": {
+			Active:     true,
+			PolicyId:   uuid.Must(uuid.NewV4()).String(),
+			HostId:     "host-1",
+			EnrolledAt: now.Format(time.RFC3339),
+		},
+	}
+	ids := make(map[string]string, len(agents))
+	for name, agent := range agents {
+		body, err := json.Marshal(agent)
+		require.NoError(t, err)
+		ids[name] = uuid.Must(uuid.NewV4()).String()
+		_, err = bulker.Create(ctx, index, ids[name], body, bulk.WithRefresh())
+		require.NoError(t, err)
+	}
+
+	found, err := FindActiveAgentsByHostID(ctx, bulker, "host-1", policyID, WithIndexName(index))
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	assert.Equal(t, ids["newer"], found[0].Id)
+	assert.Equal(t, ids["older"], found[1].Id)
+
+	found, err = FindActiveAgentsByHostID(ctx, bulker, "host-3", policyID, WithIndexName(index))
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
@@ -8,14 +8,17 @@ import "github.com/elastic/fleet-server/v7/internal/pkg/sqn"
 
 // Indices names
 const (
-	FleetActions           = ".fleet-actions"
-	FleetActionsResults    = ".fleet-actions-results"
-	FleetAgents            = ".fleet-agents"
-	FleetArtifacts         = ".fleet-artifacts"
-	FleetEnrollmentAPIKeys = ".fleet-enrollment-api-keys"
-	FleetPolicies          = ".fleet-policies"
-	FleetPoliciesLeader    = ".fleet-policies-leader"
-	FleetServers           = ".fleet-servers"
+	FleetActions            = ".fleet-actions"
+	FleetActionsResults     = ".fleet-actions-results"
+	FleetActionsStatus      = ".fleet-actions-status"
+	FleetAgents             = ".fleet-agents"
+	FleetAgentEvents        = ".fleet-agent-events"
+	FleetAgentStatusHistory = ".fleet-agent-status-history"
+	FleetArtifacts          = ".fleet-artifacts"
+	FleetEnrollmentAPIKeys  = ".fleet-enrollment-api-keys"
+	FleetPolicies           = ".fleet-policies"
+	FleetPoliciesLeader     = ".fleet-policies-leader"
+	FleetServers            = ".fleet-servers"
 )
 
 // Query fields
@@ -33,6 +36,7 @@ const (
 	FieldCoordinatorIdx              = "coordinator_idx"
 	FieldLastCheckin                 = "last_checkin"
 	FieldLastCheckinStatus           = "last_checkin_status"
+	FieldLastPolicyApplyError        = "last_policy_apply_error"
 	FieldLocalMetadata               = "local_metadata"
 	FieldPolicyRevisionIdx           = "policy_revision_idx"
 	FieldPolicyCoordinatorIdx        = "policy_coordinator_idx"
@@ -43,10 +47,22 @@ const (
 	FieldUnenrolledReason            = "unenrolled_reason"
 	FieldAgentVersion                = "version"
 	FieldAgent                       = "agent"
+	FieldSharedId                    = "shared_id"
+	FieldType                        = "type"
+	FieldEnrolledAt                  = "enrolled_at"
+	FieldUserProvidedMetadata        = "user_provided_metadata"
+	FieldTags                        = "tags"
+	FieldReplacedAgentId             = "replaced_agent_id"
+	FieldHostId                      = "host_id"
+	FieldEnrollmentApiKeyId          = "enrollment_api_key_id"
+	FieldIdempotencyKey              = "idempotency_key"
+	FieldIdempotencyFingerprint      = "idempotency_fingerprint"
+	FieldStatus                      = "status"
 
 	FieldActive           = "active"
 	FieldUpdatedAt        = "updated_at"
 	FieldUnenrolledAt     = "unenrolled_at"
+	FieldUnenrollStartAt  = "unenrollment_started_at"
 	FieldUpgradedAt       = "upgraded_at"
 	FieldUpgradeStartedAt = "upgrade_started_at"
 
@@ -17,6 +17,7 @@ import (
 
 var (
 	tmplQueryLatestPolicies = prepareQueryLatestPolicies()
+	QueryLatestPolicyByID   = prepareQueryLatestPolicyByID()
 	ErrMissingAggregations  = errors.New("missing expected aggregation result")
 )
 
@@ -33,6 +34,22 @@ func prepareQueryLatestPolicies() []byte {
 	return root.MustMarshalJSON()
 }
 
+func prepareQueryLatestPolicyByID() *dsl.Tmpl {
+	tmpl := dsl.NewTmpl()
+
+	root := dsl.NewRoot()
+	root.Size(1)
+	filter := root.Query().Bool().Filter()
+	filter.Term(FieldPolicyId, tmpl.Bind(FieldPolicyId), nil)
+	filter.Range(FieldCoordinatorIdx, dsl.WithRangeGT(0))
+	rSort := root.Sort()
+	rSort.SortOrder(FieldRevisionIdx, dsl.SortDescend)
+	rSort.SortOrder(FieldCoordinatorIdx, dsl.SortDescend)
+
+	tmpl.MustResolve(root)
+	return tmpl
+}
+
 // QueryLatestPolices gets the latest revision for a policy
 func QueryLatestPolicies(ctx context.Context, bulker bulk.Bulk, opt ...Option) ([]model.Policy, error) {
 	o := newOption(FleetPolicies, opt...)
@@ -72,3 +89,19 @@ func CreatePolicy(ctx context.Context, bulker bulk.Bulk, policy model.Policy, op
 	}
 	return bulker.Create(ctx, o.indexName, "", data, bulk.WithRefresh())
 }
+
+// FindLatestPolicy gets the latest coordinated revision of a single policy
+func FindLatestPolicy(ctx context.Context, bulker bulk.Bulk, policyId string, opt ...Option) (policy model.Policy, err error) {
+	o := newOption(FleetPolicies, opt...)
+	res, err := SearchWithOneParam(ctx, bulker, QueryLatestPolicyByID, o.indexName, FieldPolicyId, policyId)
+	if err != nil {
+		return
+	}
+
+	if len(res.Hits) == 0 {
+		return policy, ErrNotFound
+	}
+
+	err = res.Hits[0].Unmarshal(&policy)
+	return policy, err
+}
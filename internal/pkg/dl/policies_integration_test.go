@@ -92,3 +92,40 @@ func TestCreatePolicy(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestFindLatestPolicy(t *testing.T) {
+	ctx, cn := context.WithCancel(context.Background())
+	defer cn()
+
+	index, bulker := ftesting.SetupIndexWithBulk(ctx, t, es.MappingPolicy)
+
+	id := uuid.Must(uuid.NewV4()).String()
+	var rec model.Policy
+	for i := 1; i < 4; i++ {
+		rec = createRandomPolicy(id, i)
+		rec.CoordinatorIdx = 1
+		if _, err := CreatePolicy(ctx, bulker, rec, WithIndexName(index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Revision that has not passed through the coordinator is ignored
+	uncoordinated := createRandomPolicy(id, 4)
+	if _, err := CreatePolicy(ctx, bulker, uncoordinated, WithIndexName(index)); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := FindLatestPolicy(ctx, bulker, id, WithIndexName(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.PolicyId != rec.PolicyId || policy.RevisionIdx != rec.RevisionIdx || policy.CoordinatorIdx != rec.CoordinatorIdx {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+
+	_, err = FindLatestPolicy(ctx, bulker, uuid.Must(uuid.NewV4()).String(), WithIndexName(index))
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+}
@@ -19,6 +19,10 @@ type ErrElastic struct {
 	Cause  struct {
 		Type   string
 		Reason string
+		Cause  struct {
+			Type   string
+			Reason string
+		}
 	}
 }
 
@@ -75,18 +79,16 @@ func TranslateError(status int, e *ErrorT) error {
 	case "version_conflict_engine_exception":
 		err = ErrElasticVersionConflict
 	default:
-		err = &ErrElastic{
+		esErr := &ErrElastic{
 			Status: status,
 			Type:   e.Type,
 			Reason: e.Reason,
-			Cause: struct {
-				Type   string
-				Reason string
-			}{
-				e.Cause.Type,
-				e.Cause.Reason,
-			},
 		}
+		esErr.Cause.Type = e.Cause.Type
+		esErr.Cause.Reason = e.Cause.Reason
+		esErr.Cause.Cause.Type = e.Cause.Cause.Type
+		esErr.Cause.Cause.Reason = e.Cause.Cause.Reason
+		err = esErr
 	}
 
 	return err
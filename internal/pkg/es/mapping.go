@@ -27,6 +27,12 @@ const (
 		"input_type": {
 			"type": "keyword"
 		},
+		"rollout_duration": {
+			"type": "integer"
+		},
+		"start_time": {
+			"type": "date"
+		},
 		"timeout": {
 			"type": "integer"
 		},
@@ -92,6 +98,30 @@ const (
 	}
 }`
 
+	// ActionStatus The delivery and completion counters of an Elastic Agent action
+	MappingActionStatus = `{
+	"properties": {
+		"acked": {
+			"type": "integer"
+		},
+		"action_id": {
+			"type": "keyword"
+		},
+		"delivered": {
+			"type": "integer"
+		},
+		"expiration": {
+			"type": "date"
+		},
+		"failed": {
+			"type": "integer"
+		},
+		"updated_at": {
+			"type": "date"
+		}		
+	}
+}`
+
 	// Agent An Elastic Agent that has enrolled into Fleet
 	MappingAgent = `{
 	"properties": {
@@ -133,12 +163,43 @@ const (
 		"enrolled_at": {
 			"type": "date"
 		},
+		"enrollment_api_key_id": {
+			"type": "keyword"
+		},
+		"host_id": {
+			"type": "keyword"
+		},
+		"idempotency_fingerprint": {
+			"type": "keyword"
+		},
+		"idempotency_key": {
+			"type": "keyword"
+		},
 		"last_checkin": {
 			"type": "date"
 		},
 		"last_checkin_status": {
 			"type": "keyword"
 		},
+		"last_policy_apply_error": {
+			"properties": {
+				"coordinator_idx": {
+					"type": "integer"
+				},
+				"error": {
+					"type": "text"
+				},
+				"policy_id": {
+					"type": "keyword"
+				},
+				"revision_idx": {
+					"type": "integer"
+				},
+				"timestamp": {
+					"type": "date"
+				}				
+			}
+		},
 		"last_updated": {
 			"type": "date"
 		},
@@ -161,9 +222,18 @@ const (
 		"policy_revision_idx": {
 			"type": "integer"
 		},
+		"replaced_agent_id": {
+			"type": "keyword"
+		},
 		"shared_id": {
 			"type": "keyword"
 		},
+		"status": {
+			"type": "keyword"
+		},
+		"tags": {
+			"type": "keyword"
+		},
 		"type": {
 			"type": "keyword"
 		},
@@ -192,6 +262,64 @@ const (
 	}
 }`
 
+	// AgentEvent An event reported by an Elastic Agent on checkin
+	MappingAgentEvent = `{
+	"properties": {
+		"action_data": {
+			"enabled" : false,
+			"type": "object"
+		},
+		"action_id": {
+			"type": "keyword"
+		},
+		"action_response": {
+			"enabled" : false,
+			"type": "object"
+		},
+		"agent_id": {
+			"type": "keyword"
+		},
+		"completed_at": {
+			"type": "date"
+		},
+		"data": {
+			"enabled" : false,
+			"type": "object"
+		},
+		"error": {
+			"type": "text"
+		},
+		"message": {
+			"type": "keyword"
+		},
+		"payload": {
+			"enabled" : false,
+			"type": "object"
+		},
+		"policy_id": {
+			"type": "keyword"
+		},
+		"policy_revision_idx": {
+			"type": "integer"
+		},
+		"started_at": {
+			"type": "date"
+		},
+		"stream_id": {
+			"type": "keyword"
+		},
+		"subtype": {
+			"type": "keyword"
+		},
+		"@timestamp": {
+			"type": "date"
+		},
+		"type": {
+			"type": "keyword"
+		}		
+	}
+}`
+
 	// AgentMetadata An Elastic Agent metadata
 	MappingAgentMetadata = `{
 	"properties": {
@@ -204,6 +332,30 @@ const (
 	}
 }`
 
+	// AgentStatusHistory A transition of the status of an Elastic Agent
+	MappingAgentStatusHistory = `{
+	"properties": {
+		"agent_id": {
+			"type": "keyword"
+		},
+		"from_status": {
+			"type": "keyword"
+		},
+		"policy_id": {
+			"type": "keyword"
+		},
+		"policy_revision_idx": {
+			"type": "integer"
+		},
+		"@timestamp": {
+			"type": "date"
+		},
+		"to_status": {
+			"type": "keyword"
+		}		
+	}
+}`
+
 	// Artifact An artifact served by Fleet
 	MappingArtifact = `{
 	"properties": {
@@ -282,9 +434,21 @@ const (
 		"created_at": {
 			"type": "date"
 		},
+		"enrollment_window": {
+			"type": "integer"
+		},
+		"enrollment_window_start": {
+			"type": "date"
+		},
+		"enrollments": {
+			"type": "integer"
+		},
 		"expire_at": {
 			"type": "date"
 		},
+		"max_enrollments": {
+			"type": "integer"
+		},
 		"name": {
 			"type": "keyword"
 		},
@@ -350,6 +514,27 @@ const (
 	}
 }`
 
+	// PolicyApplyError A policy revision the Elastic Agent failed to apply
+	MappingPolicyApplyError = `{
+	"properties": {
+		"coordinator_idx": {
+			"type": "integer"
+		},
+		"error": {
+			"type": "text"
+		},
+		"policy_id": {
+			"type": "keyword"
+		},
+		"revision_idx": {
+			"type": "integer"
+		},
+		"timestamp": {
+			"type": "date"
+		}		
+	}
+}`
+
 	// PolicyLeader The current leader Fleet Server for a policy
 	MappingPolicyLeader = `{
 	"properties": {
@@ -17,6 +17,10 @@ type ErrorT struct {
 	Cause  struct {
 		Type   string `json:"type"`
 		Reason string `json:"reason"`
+		Cause  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"caused_by"`
 	} `json:"caused_by"`
 }
 
@@ -27,12 +31,13 @@ type AckResponse struct {
 }
 
 type HitT struct {
-	Id      string          `json:"_id"`
-	SeqNo   int64           `json:"_seq_no"`
-	Version int64           `json:"version"`
-	Index   string          `json:"_index"`
-	Source  json.RawMessage `json:"_source"`
-	Score   *float64        `json:"_score"`
+	Id      string            `json:"_id"`
+	SeqNo   int64             `json:"_seq_no"`
+	Version int64             `json:"version"`
+	Index   string            `json:"_index"`
+	Source  json.RawMessage   `json:"_source"`
+	Score   *float64          `json:"_score"`
+	Sort    []json.RawMessage `json:"sort,omitempty"`
 }
 
 func (hit *HitT) Unmarshal(v interface{}) error {
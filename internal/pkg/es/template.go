@@ -0,0 +1,178 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+const (
+	ilmPolicySuffix  = "-ilm-policy"
+	ilmRolloverAge   = "1d"
+	ilmRolloverSize  = "50gb"
+	templatePriority = 200
+)
+
+// ILMPolicyName returns the name of the lifecycle policy of the data stream.
+func ILMPolicyName(name string) string {
+	return name + ilmPolicySuffix
+}
+
+// EnsureDataStreamTemplate installs the lifecycle policy and the index template of
+// a hidden data stream.  The backing indices roll over daily and are deleted once
+// older than the retention; they are kept forever if the retention is zero.
+// Both are overwritten on each call so that a changed retention is applied.
+func EnsureDataStreamTemplate(ctx context.Context, esCli *elasticsearch.Client, name, mapping string, retention time.Duration) error {
+	policyName := ILMPolicyName(name)
+
+	policy, err := makeILMPolicy(retention)
+	if err != nil {
+		return err
+	}
+
+	res, err := esCli.ILM.PutLifecycle(
+		policyName,
+		esCli.ILM.PutLifecycle.WithBody(bytes.NewReader(policy)),
+		esCli.ILM.PutLifecycle.WithContext(ctx),
+	)
+	if err = checkAck(res, err); err != nil {
+		return fmt.Errorf("put ilm policy %s: %w", policyName, err)
+	}
+
+	template, err := makeDataStreamTemplate(name, mapping, policyName)
+	if err != nil {
+		return err
+	}
+
+	res, err = esCli.Indices.PutIndexTemplate(
+		name,
+		bytes.NewReader(template),
+		esCli.Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err = checkAck(res, err); err != nil {
+		return fmt.Errorf("put index template %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// EnsureIndexTemplate installs the index template of a hidden index written by fleet-server,
+// so that the index is created with its mapping rather than a dynamic one.  The mapping is
+// also put on the index if it already exists.
+func EnsureIndexTemplate(ctx context.Context, esCli *elasticsearch.Client, name, mapping string) error {
+	template, err := makeIndexTemplate(name, mapping)
+	if err != nil {
+		return err
+	}
+
+	res, err := esCli.Indices.PutIndexTemplate(
+		name,
+		bytes.NewReader(template),
+		esCli.Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err = checkAck(res, err); err != nil {
+		return fmt.Errorf("put index template %s: %w", name, err)
+	}
+
+	res, err = esCli.Indices.PutMapping(
+		bytes.NewReader([]byte(mapping)),
+		esCli.Indices.PutMapping.WithIndex(name),
+		esCli.Indices.PutMapping.WithContext(ctx),
+	)
+	if err = checkAck(res, err); err != nil && !errors.Is(err, ErrIndexNotFound) {
+		return fmt.Errorf("put mapping %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func makeILMPolicy(retention time.Duration) ([]byte, error) {
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{
+				"rollover": map[string]interface{}{
+					"max_age":  ilmRolloverAge,
+					"max_size": ilmRolloverSize,
+				},
+			},
+		},
+	}
+
+	if retention > 0 {
+		phases["delete"] = map[string]interface{}{
+			"min_age": fmt.Sprintf("%ds", int64(retention/time.Second)),
+			"actions": map[string]interface{}{
+				"delete": map[string]interface{}{},
+			},
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": phases,
+		},
+	})
+}
+
+func makeDataStreamTemplate(name, mapping, policyName string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"index_patterns": []string{name},
+		"data_stream": map[string]interface{}{
+			"hidden": true,
+		},
+		"priority": templatePriority,
+		"template": map[string]interface{}{
+			"settings": map[string]interface{}{
+				"index.hidden":         true,
+				"index.lifecycle.name": policyName,
+			},
+			"mappings": json.RawMessage(mapping),
+		},
+		"_meta": map[string]interface{}{
+			"managed_by": "fleet-server",
+		},
+	})
+}
+
+func makeIndexTemplate(name, mapping string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"index_patterns": []string{name},
+		"priority":       templatePriority,
+		"template": map[string]interface{}{
+			"settings": map[string]interface{}{
+				"index.hidden": true,
+			},
+			"mappings": json.RawMessage(mapping),
+		},
+		"_meta": map[string]interface{}{
+			"managed_by": "fleet-server",
+		},
+	})
+}
+
+func checkAck(res *esapi.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var ares AckResponse
+	if err = json.NewDecoder(res.Body).Decode(&ares); err != nil {
+		return err
+	}
+	if !ares.Acknowledged {
+		return TranslateError(res.StatusCode, &ares.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureDataStreamTemplate(t *testing.T) {
+	bodies := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`{"version":{"number":"7.16.0","build_flavor":"default"},"tagline":"You Know, for Search"}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.Method+" "+r.URL.Path] = body
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	}))
+	defer srv.Close()
+
+	cli, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	require.NoError(t, err)
+
+	const name = ".test-history"
+	err = EnsureDataStreamTemplate(context.Background(), cli, name, `{"properties":{"@timestamp":{"type":"date"}}}`, 30*24*time.Hour)
+	require.NoError(t, err)
+
+	var policy struct {
+		Policy struct {
+			Phases struct {
+				Delete struct {
+					MinAge string `json:"min_age"`
+				} `json:"delete"`
+			} `json:"phases"`
+		} `json:"policy"`
+	}
+	require.Contains(t, bodies, "PUT /_ilm/policy/"+ILMPolicyName(name))
+	require.NoError(t, json.Unmarshal(bodies["PUT /_ilm/policy/"+ILMPolicyName(name)], &policy))
+	assert.Equal(t, "2592000s", policy.Policy.Phases.Delete.MinAge)
+
+	var template struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Template      struct {
+			Settings map[string]interface{} `json:"settings"`
+			Mappings map[string]interface{} `json:"mappings"`
+		} `json:"template"`
+	}
+	require.Contains(t, bodies, "PUT /_index_template/"+name)
+	require.NoError(t, json.Unmarshal(bodies["PUT /_index_template/"+name], &template))
+	assert.Equal(t, []string{name}, template.IndexPatterns)
+	assert.Equal(t, ILMPolicyName(name), template.Template.Settings["index.lifecycle.name"])
+	assert.Contains(t, template.Template.Mappings, "properties")
+}
+
+func TestEnsureIndexTemplate(t *testing.T) {
+	bodies := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			_, _ = w.Write([]byte(`{"version":{"number":"7.16.0","build_flavor":"default"},"tagline":"You Know, for Search"}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.Method+" "+r.URL.Path] = body
+		if r.URL.Path == "/.test-status/_mapping" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	}))
+	defer srv.Close()
+
+	cli, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	require.NoError(t, err)
+
+	// The index not existing yet is not an error
+	const name = ".test-status"
+	err = EnsureIndexTemplate(context.Background(), cli, name, `{"properties":{"expiration":{"type":"date"}}}`)
+	require.NoError(t, err)
+
+	var template struct {
+		IndexPatterns []string  `json:"index_patterns"`
+		DataStream    *struct{} `json:"data_stream"`
+		Template      struct {
+			Settings map[string]interface{} `json:"settings"`
+			Mappings map[string]interface{} `json:"mappings"`
+		} `json:"template"`
+	}
+	require.Contains(t, bodies, "PUT /_index_template/"+name)
+	require.NoError(t, json.Unmarshal(bodies["PUT /_index_template/"+name], &template))
+	assert.Equal(t, []string{name}, template.IndexPatterns)
+	assert.Nil(t, template.DataStream)
+	assert.Equal(t, true, template.Template.Settings["index.hidden"])
+	assert.Contains(t, template.Template.Mappings, "properties")
+	assert.Contains(t, bodies, "PUT /"+name+"/_mapping")
+}
+
+func TestMakeILMPolicyNoRetention(t *testing.T) {
+	body, err := makeILMPolicy(0)
+	require.NoError(t, err)
+
+	var policy struct {
+		Policy struct {
+			Phases map[string]interface{} `json:"phases"`
+		} `json:"policy"`
+	}
+	require.NoError(t, json.Unmarshal(body, &policy))
+	assert.Contains(t, policy.Policy.Phases, "hot")
+	assert.NotContains(t, policy.Policy.Phases, "delete")
+}
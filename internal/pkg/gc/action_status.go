@@ -0,0 +1,86 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gc
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
+	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
+)
+
+const defaultActionStatusSelectSize = 1000
+
+func getActionStatusGCFunc(bulker bulk.Bulk) scheduler.WorkFunc {
+	return func(ctx context.Context) error {
+		return cleanupActionStatus(ctx, dl.FleetActionsStatus, dl.FleetActions, bulker, defaultActionStatusSelectSize)
+	}
+}
+
+// The status documents of actions with an expiration are deleted by the range delete on
+// the expiration.  Actions without one are never deleted by the GC, so their status
+// documents are deleted once the action itself is gone.
+func cleanupActionStatus(ctx context.Context, statusIndex, actionsIndex string, bulker bulk.Bulk, selectSize int) error {
+	log := log.With().Str("ctx", "fleet action status cleanup").Str("index", statusIndex).Logger()
+
+	log.Debug().Msg("delete status of deleted actions")
+
+	var (
+		after   string
+		deleted int
+	)
+	for {
+		statuses, err := dl.FindActionStatusWithoutExpiration(ctx, bulker, after, selectSize, dl.WithIndexName(statusIndex))
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to find action status")
+			return err
+		}
+		if len(statuses) == 0 {
+			break
+		}
+
+		ids := make([]string, 0, len(statuses))
+		for _, status := range statuses {
+			ids = append(ids, status.ActionId)
+		}
+
+		actions, err := dl.FindActions(ctx, bulker, ids, dl.WithIndexName(actionsIndex))
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to find actions")
+			return err
+		}
+
+		found := make(map[string]struct{}, len(actions))
+		for _, action := range actions {
+			found[action.ActionId] = struct{}{}
+		}
+
+		var ops []bulk.MultiOp
+		for _, status := range statuses {
+			if _, ok := found[status.ActionId]; !ok {
+				ops = append(ops, bulk.MultiOp{Id: status.Id, Index: statusIndex})
+			}
+		}
+
+		if len(ops) > 0 {
+			if _, err := bulker.MDelete(ctx, ops); err != nil {
+				log.Debug().Err(err).Msg("failed to delete action status")
+				return err
+			}
+			deleted += len(ops)
+		}
+
+		if len(statuses) < selectSize {
+			break
+		}
+		after = statuses[len(statuses)-1].ActionId
+	}
+
+	log.Debug().Int("count", deleted).Msg("deleted status of deleted actions")
+	return nil
+}
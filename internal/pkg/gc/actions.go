@@ -54,9 +54,9 @@ func WithCleanupIntervalAfterExpired(cleanupIntervalAfterExpired string) Actions
 	}
 }
 
-func getActionsGCFunc(bulker bulk.Bulk, cleanupIntervalAfterExpired string) scheduler.WorkFunc {
+func getActionsGCFunc(index string, bulker bulk.Bulk, cleanupIntervalAfterExpired string) scheduler.WorkFunc {
 	return func(ctx context.Context) error {
-		return cleanupActions(ctx, dl.FleetActions, bulker,
+		return cleanupActions(ctx, index, bulker,
 			WithCleanupIntervalAfterExpired(cleanupIntervalAfterExpired))
 	}
 }
@@ -70,7 +70,7 @@ func cleanupActions(ctx context.Context, index string, bulker bulk.Bulk, opts ..
 		opt(&c)
 	}
 
-	log := log.With().Str("ctx", "fleet actions cleanup").Str("interval", "now-"+c.cleanupIntervalAfterExpired).Logger()
+	log := log.With().Str("ctx", "fleet actions cleanup").Str("index", index).Str("interval", "now-"+c.cleanupIntervalAfterExpired).Logger()
 
 	log.Debug().Msg("delete expired actions")
 
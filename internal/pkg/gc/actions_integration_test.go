@@ -9,6 +9,7 @@ package gc
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -132,3 +133,66 @@ func testCleanupActionsWithSelectSize(t *testing.T, skipIndexInitialization bool
 		t.Errorf("unexpected number of hits, got %d, want %d", len(hits), len(nonExpiredActions))
 	}
 }
+
+func TestCleanupActionStatus(t *testing.T) {
+	ctx := context.Background()
+
+	actionsIndex, bulker := ftesting.SetupIndexWithBulk(ctx, t, es.MappingAction)
+	statusIndex := ftesting.SetupIndex(ctx, t, bulker, es.MappingActionStatus)
+
+	actions, err := ftesting.CreateRandomActions(
+		ftesting.CreateActionsWithMinActionsCount(7),
+		ftesting.CreateActionsWithMaxActionsCount(7),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range actions {
+		actions[i].Expiration = ""
+	}
+
+	// The first actions are kept, the status of the others is orphaned
+	const kept = 3
+	err = ftesting.StoreActions(ctx, bulker, actionsIndex, actions[:kept])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []bulk.MultiOp
+	for _, action := range actions {
+		body, err := json.Marshal(model.ActionStatus{ActionId: action.ActionId, Delivered: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, bulk.MultiOp{Id: action.ActionId, Index: statusIndex, Body: body})
+	}
+	// The status of an action with an expiration is left to the expiration cleanup
+	body, err := json.Marshal(model.ActionStatus{ActionId: "expiring", Expiration: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops = append(ops, bulk.MultiOp{Id: "expiring", Index: statusIndex, Body: body})
+
+	if _, err = bulker.MCreate(ctx, ops, bulk.WithRefresh()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Page through the status in more than one pass
+	err = cleanupActionStatus(ctx, statusIndex, actionsIndex, bulker, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+
+	statuses, err := dl.FindActionStatusWithoutExpiration(ctx, bulker, "", 100, dl.WithIndexName(statusIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != kept {
+		t.Errorf("unexpected number of status, got %d, want %d", len(statuses), kept)
+	}
+	if _, err = bulker.Read(ctx, statusIndex, "expiring"); err != nil {
+		t.Errorf("status with expiration was deleted: %v", err)
+	}
+}
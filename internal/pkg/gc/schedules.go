@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/elastic/fleet-server/v7/internal/pkg/bulk"
+	"github.com/elastic/fleet-server/v7/internal/pkg/dl"
 	"github.com/elastic/fleet-server/v7/internal/pkg/scheduler"
 )
 
@@ -29,7 +30,18 @@ func Schedules(bulker bulk.Bulk, scheduleInterval time.Duration, cleanupInterval
 		{
 			Name:     "fleet actions cleanup",
 			Interval: scheduleInterval,
-			WorkFn:   getActionsGCFunc(bulker, cleanupIntervalAfterExpired),
+			WorkFn:   getActionsGCFunc(dl.FleetActions, bulker, cleanupIntervalAfterExpired),
+		},
+		{
+			// The status documents carry the expiration of their action
+			Name:     "fleet actions status cleanup",
+			Interval: scheduleInterval,
+			WorkFn:   getActionsGCFunc(dl.FleetActionsStatus, bulker, cleanupIntervalAfterExpired),
+		},
+		{
+			Name:     "fleet actions status without expiration cleanup",
+			Interval: scheduleInterval,
+			WorkFn:   getActionStatusGCFunc(bulker),
 		},
 	}
 }
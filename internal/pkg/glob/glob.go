@@ -0,0 +1,63 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package glob matches enrollment request attributes against the glob patterns
+// of the enrollment rules.
+package glob
+
+import (
+	"errors"
+	"path"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+)
+
+// Validate checks the syntax of the patterns up front, path.Match only reports
+// a bad pattern when the match gets to it.
+func Validate(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateFields checks that the metadata fields are set and their patterns are valid.
+func ValidateFields(fields []config.MetadataField) error {
+	for _, f := range fields {
+		if f.Field == "" {
+			return errors.New("metadata field must be set")
+		}
+		if _, err := path.Match(f.Pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchAny reports whether s matches any of the patterns.
+func MatchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matched, _ := path.Match(p, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchFields reports whether every field is set in the metadata and matches its pattern.
+func MatchFields(fields []config.MetadataField, m smap.Map) bool {
+	for _, f := range fields {
+		v, ok := m.GetValue(f.Field)
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(f.Pattern, v); !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package glob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+)
+
+func TestMatchAny(t *testing.T) {
+	assert.True(t, MatchAny([]string{"prod-*", "staging"}, "prod-eu"))
+	assert.True(t, MatchAny([]string{"prod-*", "staging"}, "staging"))
+	assert.False(t, MatchAny([]string{"prod-*", "staging"}, "dev"))
+	assert.False(t, MatchAny(nil, "dev"))
+}
+
+func TestMatchFields(t *testing.T) {
+	m, err := smap.Parse([]byte(`{"host": {"hostname": "web-01", "os": {"family": "debian"}}}`))
+	require.NoError(t, err)
+
+	assert.True(t, MatchFields(nil, m))
+	assert.True(t, MatchFields([]config.MetadataField{
+		{Field: "host.hostname", Pattern: "web-*"},
+		{Field: "host.os.family", Pattern: "debian"},
+	}, m))
+	assert.False(t, MatchFields([]config.MetadataField{
+		{Field: "host.hostname", Pattern: "web-*"},
+		{Field: "host.os.family", Pattern: "redhat"},
+	}, m))
+	assert.False(t, MatchFields([]config.MetadataField{{Field: "host.missing", Pattern: "*"}}, m))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate([]string{"prod-*"}))
+	assert.Error(t, Validate([]string{"[a-"}))
+	assert.NoError(t, ValidateFields([]config.MetadataField{{Field: "host.hostname", Pattern: "*"}}))
+	assert.Error(t, ValidateFields([]config.MetadataField{{Pattern: "*"}}))
+	assert.Error(t, ValidateFields([]config.MetadataField{{Field: "host.hostname", Pattern: "[a-"}}))
+}
@@ -78,6 +78,13 @@ func (rc *ResponseCounter) WriteHeader(statusCode int) {
 	}
 }
 
+// Flush implements http.Flusher for streaming responses.
+func (rc *ResponseCounter) Flush() {
+	if f, ok := rc.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (rc *ResponseCounter) Count() uint64 {
 	return atomic.LoadUint64(&rc.count)
 }
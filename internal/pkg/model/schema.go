@@ -48,6 +48,12 @@ type Action struct {
 	// The input type the actions should be routed to.
 	InputType string `json:"input_type,omitempty"`
 
+	// The optional duration in seconds over which the delivery of the action is spread across the agents
+	RolloutDuration int64 `json:"rollout_duration,omitempty"`
+
+	// The optional date/time the delivery of the action starts
+	StartTime string `json:"start_time,omitempty"`
+
 	// The optional action timeout in seconds
 	Timeout int64 `json:"timeout,omitempty"`
 
@@ -101,6 +107,29 @@ type ActionResult struct {
 	Timestamp string `json:"@timestamp,omitempty"`
 }
 
+// ActionStatus The delivery and completion counters of an Elastic Agent action
+type ActionStatus struct {
+	ESDocument
+
+	// The number of Elastic Agents that acked the action
+	Acked int64 `json:"acked,omitempty"`
+
+	// The action id.
+	ActionId string `json:"action_id,omitempty"`
+
+	// The number of times the action was delivered to an Elastic Agent
+	Delivered int64 `json:"delivered,omitempty"`
+
+	// The action expiration date/time
+	Expiration string `json:"expiration,omitempty"`
+
+	// The number of Elastic Agents that failed the action
+	Failed int64 `json:"failed,omitempty"`
+
+	// Date/time the counters were last updated
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
 // Agent An Elastic Agent that has enrolled into Fleet
 type Agent struct {
 	ESDocument
@@ -127,11 +156,24 @@ type Agent struct {
 	// Date/time the Elastic Agent enrolled
 	EnrolledAt string `json:"enrolled_at"`
 
+	// ID of the enrollment API key the Elastic Agent enrolled with
+	EnrollmentApiKeyId string `json:"enrollment_api_key_id,omitempty"`
+
+	// Host ID reported in the local metadata at enrollment
+	HostId string `json:"host_id,omitempty"`
+
+	// Fingerprint of the enrollment request supplied with the idempotency key
+	IdempotencyFingerprint string `json:"idempotency_fingerprint,omitempty"`
+
+	// Idempotency key supplied with the enrollment request
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
 	// Date/time the Elastic Agent checked in last time
 	LastCheckin string `json:"last_checkin,omitempty"`
 
 	// Lst checkin status
-	LastCheckinStatus string `json:"last_checkin_status,omitempty"`
+	LastCheckinStatus    string            `json:"last_checkin_status,omitempty"`
+	LastPolicyApplyError *PolicyApplyError `json:"last_policy_apply_error,omitempty"`
 
 	// Date/time the Elastic Agent was last updated
 	LastUpdated string `json:"last_updated,omitempty"`
@@ -154,9 +196,18 @@ type Agent struct {
 	// The current policy revision_idx for the Elastic Agent
 	PolicyRevisionIdx int64 `json:"policy_revision_idx,omitempty"`
 
+	// ID of the Elastic Agent record this agent replaced at enrollment
+	ReplacedAgentId string `json:"replaced_agent_id,omitempty"`
+
 	// Shared ID
 	SharedId string `json:"shared_id,omitempty"`
 
+	// Status of the Elastic Agent derived by Fleet Server from the last checkin
+	Status string `json:"status,omitempty"`
+
+	// Tags assigned to the Elastic Agent
+	Tags []string `json:"tags,omitempty"`
+
 	// Type
 	Type string `json:"type"`
 
@@ -182,6 +233,59 @@ type Agent struct {
 	UserProvidedMetadata json.RawMessage `json:"user_provided_metadata,omitempty"`
 }
 
+// AgentEvent An event reported by an Elastic Agent on checkin
+type AgentEvent struct {
+	ESDocument
+
+	// The data of the action the event relates to
+	ActionData json.RawMessage `json:"action_data,omitempty"`
+
+	// The ID of the action the event relates to
+	ActionId string `json:"action_id,omitempty"`
+
+	// The response to the action the event relates to
+	ActionResponse json.RawMessage `json:"action_response,omitempty"`
+
+	// The ID of the Elastic Agent
+	AgentId string `json:"agent_id"`
+
+	// Date/time the action the event relates to completed
+	CompletedAt string `json:"completed_at,omitempty"`
+
+	// The event data
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// The error reported by the Elastic Agent
+	Error string `json:"error,omitempty"`
+
+	// The event message
+	Message string `json:"message,omitempty"`
+
+	// The event payload
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// The policy ID of the Elastic Agent
+	PolicyId string `json:"policy_id,omitempty"`
+
+	// The policy revision_idx of the Elastic Agent when the event was reported
+	PolicyRevisionIdx int64 `json:"policy_revision_idx,omitempty"`
+
+	// Date/time the action the event relates to started
+	StartedAt string `json:"started_at,omitempty"`
+
+	// The ID of the stream the event relates to
+	StreamId string `json:"stream_id,omitempty"`
+
+	// The subtype of the event
+	Subtype string `json:"subtype"`
+
+	// Date/time the event was reported, the time it was received if not valid
+	Timestamp string `json:"@timestamp,omitempty"`
+
+	// The type of the event
+	Type string `json:"type"`
+}
+
 // AgentMetadata An Elastic Agent metadata
 type AgentMetadata struct {
 
@@ -192,6 +296,29 @@ type AgentMetadata struct {
 	Version string `json:"version"`
 }
 
+// AgentStatusHistory A transition of the status of an Elastic Agent
+type AgentStatusHistory struct {
+	ESDocument
+
+	// The ID of the Elastic Agent
+	AgentId string `json:"agent_id"`
+
+	// The status before the transition
+	FromStatus string `json:"from_status"`
+
+	// The policy ID of the Elastic Agent
+	PolicyId string `json:"policy_id,omitempty"`
+
+	// The policy revision_idx of the Elastic Agent at the time of the transition
+	PolicyRevisionIdx int64 `json:"policy_revision_idx,omitempty"`
+
+	// Date/time the status transition was detected
+	Timestamp string `json:"@timestamp,omitempty"`
+
+	// The status after the transition
+	ToStatus string `json:"to_status"`
+}
+
 // Artifact An artifact served by Fleet
 type Artifact struct {
 	ESDocument
@@ -258,7 +385,19 @@ type EnrollmentApiKey struct {
 	// The unique identifier for the enrollment key, currently xid
 	ApiKeyId  string `json:"api_key_id"`
 	CreatedAt string `json:"created_at,omitempty"`
-	ExpireAt  string `json:"expire_at,omitempty"`
+
+	// Length (seconds) of the window the enrollment quota applies to; the quota applies to the lifetime of the key when unset
+	EnrollmentWindow int64 `json:"enrollment_window,omitempty"`
+
+	// Date/time the current enrollment quota window started
+	EnrollmentWindowStart string `json:"enrollment_window_start,omitempty"`
+
+	// Number of enrollments counted against the quota in the current window
+	Enrollments int64  `json:"enrollments,omitempty"`
+	ExpireAt    string `json:"expire_at,omitempty"`
+
+	// Maximum number of enrollments allowed with the key; per window when enrollment_window is set
+	MaxEnrollments int64 `json:"max_enrollments,omitempty"`
 
 	// Enrollment key name
 	Name      string `json:"name,omitempty"`
@@ -312,6 +451,26 @@ type Policy struct {
 	UnenrollTimeout int64 `json:"unenroll_timeout,omitempty"`
 }
 
+// PolicyApplyError A policy revision the Elastic Agent failed to apply
+type PolicyApplyError struct {
+	ESDocument
+
+	// The coordinator index of the policy
+	CoordinatorIdx int64 `json:"coordinator_idx,omitempty"`
+
+	// The error reported by the Elastic Agent
+	Error string `json:"error,omitempty"`
+
+	// The ID of the policy
+	PolicyId string `json:"policy_id,omitempty"`
+
+	// The revision index of the policy
+	RevisionIdx int64 `json:"revision_idx,omitempty"`
+
+	// Date/time the Elastic Agent reported the error
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
 // PolicyLeader The current leader Fleet Server for a policy
 type PolicyLeader struct {
 	ESDocument
@@ -60,6 +60,9 @@ type Monitor interface {
 
 	// Unsubscribe removes the current subscription.
 	Unsubscribe(sub Subscription) error
+
+	// LatestPolicy returns the latest known revision of a policy.
+	LatestPolicy(policyId string) (*ParsedPolicy, bool)
 }
 
 type policyFetcher func(ctx context.Context, bulker bulk.Bulk, opt ...dl.Option) ([]model.Policy, error)
@@ -459,3 +462,18 @@ func (m *monitorT) Unsubscribe(sub Subscription) error {
 
 	return nil
 }
+
+// LatestPolicy returns the latest known revision of a policy.
+func (m *monitorT) LatestPolicy(policyId string) (*ParsedPolicy, bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	// A policy that is pending a force load has not been parsed yet.
+	p, ok := m.policies[policyId]
+	if !ok || p.pp.Policy.PolicyId == "" {
+		return nil, false
+	}
+
+	pp := p.pp
+	return &pp, true
+}
@@ -18,6 +18,7 @@ const (
 	FieldOutputFleetServer  = "fleet_server"
 	FieldOutputServiceToken = "service_token"
 	FieldOutputPermissions  = "output_permissions"
+	FieldInputs             = "inputs"
 
 	OutputTypeElasticsearch = "elasticsearch"
 )
@@ -41,11 +42,20 @@ type ParsedPolicyDefaults struct {
 	Role *RoleT
 }
 
+// ArtifactKeyT identifies an artifact by its identifier and decoded sha256.
+type ArtifactKeyT struct {
+	Ident string
+	Sha2  string
+}
+
+type ArtifactSetT map[ArtifactKeyT]struct{}
+
 type ParsedPolicy struct {
-	Policy  model.Policy
-	Fields  map[string]json.RawMessage
-	Roles   RoleMapT
-	Default ParsedPolicyDefaults
+	Policy    model.Policy
+	Fields    map[string]json.RawMessage
+	Roles     RoleMapT
+	Default   ParsedPolicyDefaults
+	Artifacts ArtifactSetT
 }
 
 func NewParsedPolicy(p model.Policy) (*ParsedPolicy, error) {
@@ -87,11 +97,56 @@ func NewParsedPolicy(p model.Policy) (*ParsedPolicy, error) {
 			Name: defaultName,
 			Role: roleP,
 		},
+		Artifacts: parseArtifacts(fields[FieldInputs]),
 	}
 
 	return pp, nil
 }
 
+// HasArtifact returns true if one of the policy inputs references the artifact.
+func (pp *ParsedPolicy) HasArtifact(ident, sha2 string) bool {
+	_, ok := pp.Artifacts[ArtifactKeyT{Ident: ident, Sha2: sha2}]
+	return ok
+}
+
+type inputManifestT struct {
+	ArtifactManifest struct {
+		Artifacts map[string]struct {
+			DecodedSha256 string `json:"decoded_sha256"`
+		} `json:"artifacts"`
+	} `json:"artifact_manifest"`
+}
+
+// Collect the artifacts referenced by the artifact manifests on the inputs.
+// Parsing is lenient; an input that cannot be interpreted contributes no artifacts.
+func parseArtifacts(inputsRaw json.RawMessage) ArtifactSetT {
+	artifacts := make(ArtifactSetT)
+	if len(inputsRaw) == 0 {
+		return artifacts
+	}
+
+	var inputs []json.RawMessage
+	if err := json.Unmarshal(inputsRaw, &inputs); err != nil {
+		return artifacts
+	}
+
+	for _, raw := range inputs {
+		var input inputManifestT
+		if err := json.Unmarshal(raw, &input); err != nil {
+			continue
+		}
+
+		for ident, v := range input.ArtifactManifest.Artifacts {
+			if v.DecodedSha256 == "" {
+				continue
+			}
+			artifacts[ArtifactKeyT{Ident: ident, Sha2: v.DecodedSha256}] = struct{}{}
+		}
+	}
+
+	return artifacts
+}
+
 func parsePerms(permsRaw json.RawMessage) (RoleMapT, error) {
 	permMap, err := smap.Parse(permsRaw)
 	if err != nil {
@@ -524,3 +524,60 @@ func TestNewParsedPolicy(t *testing.T) {
 		}
 	}
 }
+
+func TestParsedPolicyArtifacts(t *testing.T) {
+
+	var m model.Policy
+	m.Data = json.RawMessage(testPolicy)
+
+	pp, err := NewParsedPolicy(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Five artifacts are referenced by the endpoint input manifest
+	if len(pp.Artifacts) != 5 {
+		t.Fatal(fmt.Sprintf("Expected 5 artifacts, got %d", len(pp.Artifacts)))
+	}
+
+	tests := []struct {
+		ident  string
+		sha2   string
+		expect bool
+	}{
+		{"endpoint-trustlist-windows-v1", "74c2255ce31e0b48ada298ed6dacf6d1be7b0fb40c1bcb251d2da66f4b060acf", true},
+		{"endpoint-trustlist-macos-v1", "d801aa1fb7ddcc330a5e3173372ea6af4a3d08ec58074478e85aa5603e926658", true},
+		{"endpoint-trustlist-windows-v1", "d801aa1fb7ddcc330a5e3173372ea6af4a3d08ec58074478e85aa5603e926658", false},
+		{"endpoint-trustlist-windows-v1", "8e70ce05d25709b6bbd4fd6981e86e24e1a2f85e3f69d2733058c568830f25d2", false},
+		{"endpoint-bogus-v1", "74c2255ce31e0b48ada298ed6dacf6d1be7b0fb40c1bcb251d2da66f4b060acf", false},
+	}
+
+	for _, tc := range tests {
+		if got := pp.HasArtifact(tc.ident, tc.sha2); got != tc.expect {
+			t.Error(fmt.Sprintf("HasArtifact(%s, %s) expected %v", tc.ident, tc.sha2, tc.expect))
+		}
+	}
+}
+
+func TestParsedPolicyArtifactsMalformed(t *testing.T) {
+
+	const payload = `{
+		"outputs": {"default": {"type": "elasticsearch"}},
+		"inputs": [
+			{"id": "a", "artifact_manifest": "bogus"},
+			{"id": "b", "artifact_manifest": {"artifacts": {"ident-v1": {"decoded_sha256": "abcd"}}}}
+		]
+	}`
+
+	pp, err := NewParsedPolicy(model.Policy{Data: json.RawMessage(payload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pp.HasArtifact("ident-v1", "abcd") {
+		t.Error("Expected artifact from well formed input")
+	}
+	if len(pp.Artifacts) != 1 {
+		t.Error("Expected malformed input to be ignored")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+	"github.com/elastic/fleet-server/v7/internal/pkg/glob"
+	"github.com/elastic/fleet-server/v7/internal/pkg/smap"
+)
+
+// SelectRequest holds the attributes of an enrollment request that the policy
+// selection rules match against.
+type SelectRequest struct {
+	KeyName   string
+	LocalMeta json.RawMessage
+	UserMeta  json.RawMessage
+}
+
+type selectRuleT struct {
+	name      string
+	policyId  string
+	keys      []string
+	localMeta []config.MetadataField
+	userMeta  []config.MetadataField
+}
+
+// Selector picks the policy an agent is assigned to at enrollment.
+type Selector struct {
+	mut   sync.RWMutex
+	rules []selectRuleT
+}
+
+// NewSelector creates the policy selector from configuration.
+func NewSelector(cfg *config.PolicySelection) (*Selector, error) {
+	s := &Selector{}
+	if err := s.configure(cfg); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload swaps in the policy selection rules from the updated configuration.
+func (s *Selector) Reload(_ context.Context, cfg *config.Config) error {
+	return s.configure(&cfg.Inputs[0].PolicySelection)
+}
+
+func (s *Selector) configure(cfg *config.PolicySelection) error {
+	rules := make([]selectRuleT, 0, len(cfg.Rules))
+	for i, rc := range cfg.Rules {
+		r, err := compileSelectRule(rc)
+		if err != nil {
+			return fmt.Errorf("policy selection rule %d %q: %w", i, rc.Name, err)
+		}
+		rules = append(rules, r)
+	}
+
+	s.mut.Lock()
+	s.rules = rules
+	s.mut.Unlock()
+	return nil
+}
+
+func compileSelectRule(rc config.PolicySelectionRule) (selectRuleT, error) {
+	r := selectRuleT{
+		name:      rc.Name,
+		policyId:  rc.PolicyID,
+		keys:      rc.EnrollmentKeys,
+		localMeta: rc.LocalMetadata,
+		userMeta:  rc.UserMetadata,
+	}
+
+	if r.policyId == "" {
+		return r, errors.New("policy_id must be set")
+	}
+
+	// Validate the glob patterns up front
+	if err := glob.Validate(r.keys); err != nil {
+		return r, err
+	}
+	for _, fields := range [][]config.MetadataField{r.localMeta, r.userMeta} {
+		if err := glob.ValidateFields(fields); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+// Select returns the policy id and name of the first rule that matches the request.
+// The returned policy id is empty when no rule matches.
+func (s *Selector) Select(req SelectRequest) (policyId, rule string) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if len(s.rules) == 0 {
+		return "", ""
+	}
+
+	localMeta, _ := smap.Parse(req.LocalMeta)
+	userMeta, _ := smap.Parse(req.UserMeta)
+
+	for _, r := range s.rules {
+		if r.match(req.KeyName, localMeta, userMeta) {
+			return r.policyId, r.name
+		}
+	}
+
+	return "", ""
+}
+
+func (r *selectRuleT) match(keyName string, localMeta, userMeta smap.Map) bool {
+	if len(r.keys) > 0 && !glob.MatchAny(r.keys, keyName) {
+		return false
+	}
+	return glob.MatchFields(r.localMeta, localMeta) && glob.MatchFields(r.userMeta, userMeta)
+}
@@ -0,0 +1,135 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package policy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+func TestSelectorSelect(t *testing.T) {
+	s, err := NewSelector(&config.PolicySelection{
+		Rules: []config.PolicySelectionRule{
+			{
+				Name:          "containers",
+				PolicyID:      "container-policy",
+				UserMetadata:  []config.MetadataField{{Field: "deployment.kind", Pattern: "container"}},
+				LocalMetadata: []config.MetadataField{{Field: "os.family", Pattern: "*"}},
+			},
+			{
+				Name:           "linux-servers",
+				PolicyID:       "linux-policy",
+				EnrollmentKeys: []string{"site-a-*"},
+				LocalMetadata:  []config.MetadataField{{Field: "os.family", Pattern: "debian"}},
+			},
+			{
+				Name:          "windows",
+				PolicyID:      "windows-policy",
+				LocalMetadata: []config.MetadataField{{Field: "os.family", Pattern: "windows"}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		req      SelectRequest
+		policyId string
+		rule     string
+	}{
+		{
+			name:     "user metadata",
+			req:      SelectRequest{KeyName: "site-a-default", LocalMeta: []byte(`{"os": {"family": "debian"}}`), UserMeta: []byte(`{"deployment": {"kind": "container"}}`)},
+			policyId: "container-policy",
+			rule:     "containers",
+		},
+		{
+			name:     "local metadata and key",
+			req:      SelectRequest{KeyName: "site-a-default", LocalMeta: []byte(`{"os": {"family": "debian"}}`)},
+			policyId: "linux-policy",
+			rule:     "linux-servers",
+		},
+		{
+			name: "key mismatch",
+			req:  SelectRequest{KeyName: "site-b-default", LocalMeta: []byte(`{"os": {"family": "debian"}}`)},
+		},
+		{
+			name:     "any key",
+			req:      SelectRequest{KeyName: "site-b-default", LocalMeta: []byte(`{"os": {"family": "windows"}}`)},
+			policyId: "windows-policy",
+			rule:     "windows",
+		},
+		{
+			name: "no metadata",
+			req:  SelectRequest{KeyName: "site-a-default"},
+		},
+		{
+			name: "bad metadata",
+			req:  SelectRequest{KeyName: "site-a-default", LocalMeta: []byte(`bogus`)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policyId, rule := s.Select(tc.req)
+			assert.Equal(t, tc.policyId, policyId)
+			assert.Equal(t, tc.rule, rule)
+		})
+	}
+}
+
+func TestSelectorReload(t *testing.T) {
+	s, err := NewSelector(&config.PolicySelection{})
+	require.NoError(t, err)
+
+	req := SelectRequest{LocalMeta: []byte(`{"os": {"family": "darwin"}}`)}
+	policyId, _ := s.Select(req)
+	assert.Empty(t, policyId)
+
+	cfg := &config.Config{
+		Inputs: []config.Input{{
+			PolicySelection: config.PolicySelection{
+				Rules: []config.PolicySelectionRule{
+					{Name: "mac", PolicyID: "mac-policy", LocalMetadata: []config.MetadataField{{Field: "os.family", Pattern: "darwin"}}},
+				},
+			},
+		}},
+	}
+	require.NoError(t, s.Reload(context.Background(), cfg))
+	policyId, _ = s.Select(req)
+	assert.Equal(t, "mac-policy", policyId)
+
+	// A bad configuration leaves the current rules in place
+	cfg.Inputs[0].PolicySelection.Rules = []config.PolicySelectionRule{
+		{Name: "bad", PolicyID: "bad-policy", EnrollmentKeys: []string{"[a-"}},
+	}
+	assert.Error(t, s.Reload(context.Background(), cfg))
+	policyId, _ = s.Select(req)
+	assert.Equal(t, "mac-policy", policyId)
+}
+
+func TestNewSelectorInvalid(t *testing.T) {
+	tests := map[string]config.PolicySelectionRule{
+		"policy":  {},
+		"key":     {PolicyID: "p", EnrollmentKeys: []string{"[a-"}},
+		"pattern": {PolicyID: "p", UserMetadata: []config.MetadataField{{Field: "role", Pattern: "[a-"}}},
+		"field":   {PolicyID: "p", LocalMetadata: []config.MetadataField{{Pattern: "*"}}},
+	}
+
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewSelector(&config.PolicySelection{Rules: []config.PolicySelectionRule{rule}})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"strconv"
+	"strings"
 )
 
 type Map map[string]interface{}
@@ -38,6 +40,30 @@ func (m Map) GetString(k string) string {
 	return ""
 }
 
+// GetValue returns the scalar at the dotted path formatted as a string.
+func (m Map) GetValue(path string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		if m = m.GetMap(k); m == nil {
+			return "", false
+		}
+	}
+
+	switch v := m[keys[len(keys)-1]].(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
 func (m Map) Hash() (string, error) {
 	if m == nil {
 		return "", nil
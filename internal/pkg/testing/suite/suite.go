@@ -21,6 +21,7 @@ import (
 var prepareIndexes = map[string]string{
 	dl.FleetActions:           es.MappingAction,
 	dl.FleetActionsResults:    es.MappingActionResult,
+	dl.FleetActionsStatus:     es.MappingActionStatus,
 	dl.FleetAgents:            es.MappingAgent,
 	dl.FleetArtifacts:         es.MappingArtifact,
 	dl.FleetEnrollmentAPIKeys: es.MappingEnrollmentApiKey,
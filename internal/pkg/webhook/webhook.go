@@ -0,0 +1,313 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+// Package webhook notifies the configured endpoints of the agent lifecycle events.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+// Agent lifecycle events
+const (
+	EventAgentEnrolled   = "agent.enrolled"
+	EventAgentUnenrolled = "agent.unenrolled"
+	EventAgentUpgraded   = "agent.upgraded"
+	EventAgentOffline    = "agent.offline"
+	EventActionFailed    = "action.failed"
+)
+
+// Request headers
+const (
+	HeaderEvent     = "X-Fleet-Event"
+	HeaderDelivery  = "X-Fleet-Delivery"
+	HeaderSignature = "X-Fleet-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+var knownEvents = map[string]struct{}{
+	EventAgentEnrolled:   {},
+	EventAgentUnenrolled: {},
+	EventAgentUpgraded:   {},
+	EventAgentOffline:    {},
+	EventActionFailed:    {},
+}
+
+var (
+	registry     = monitoring.Default.NewRegistry("webhooks")
+	cntQueued    = monitoring.NewUint(registry, "queued")
+	cntDelivered = monitoring.NewUint(registry, "delivered")
+	cntRetried   = monitoring.NewUint(registry, "retried")
+	cntFailed    = monitoring.NewUint(registry, "failed")
+	cntDropped   = monitoring.NewUint(registry, "dropped")
+)
+
+// Event is the JSON payload of a webhook notification.
+type Event struct {
+	Id        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp string `json:"@timestamp"`
+	AgentId   string `json:"agent_id"`
+	PolicyId  string `json:"policy_id,omitempty"`
+	ActionId  string `json:"action_id,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type endpointT struct {
+	name   string
+	url    string
+	secret []byte
+	events map[string]struct{}
+	queue  chan *deliveryT
+}
+
+func (ep *endpointT) accepts(eventType string) bool {
+	if len(ep.events) == 0 {
+		return true
+	}
+	_, ok := ep.events[eventType]
+	return ok
+}
+
+type deliveryT struct {
+	ep      *endpointT
+	id      string
+	event   string
+	body    []byte
+	attempt int
+}
+
+// Dispatcher delivers the events to the endpoints out of band of the
+// requests that produced them.  Deliveries are queued in memory per
+// endpoint and posted by a fixed number of workers per endpoint, so a
+// slow or down endpoint only delays its own deliveries.  A delivery that
+// fails is retried with exponential backoff and dropped once the retries
+// are exhausted or when the endpoint queue is full.
+type Dispatcher struct {
+	client         *http.Client
+	endpoints      []endpointT
+	workers        int
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// New creates a dispatcher for the configured endpoints.
+func New(cfg *config.Webhooks) (*Dispatcher, error) {
+	endpoints := make([]endpointT, len(cfg.Endpoints))
+	for i, e := range cfg.Endpoints {
+		ep := endpointT{
+			name:   e.Name,
+			url:    e.URL,
+			secret: []byte(e.Secret),
+			queue:  make(chan *deliveryT, cfg.QueueSize),
+		}
+		if len(e.Events) > 0 {
+			ep.events = make(map[string]struct{}, len(e.Events))
+			for _, ev := range e.Events {
+				if _, ok := knownEvents[ev]; !ok {
+					return nil, fmt.Errorf("webhook %q: unknown event %q", e.Name, ev)
+				}
+				ep.events[ev] = struct{}{}
+			}
+		}
+		endpoints[i] = ep
+	}
+
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Dispatcher{
+		client:         &http.Client{Timeout: cfg.Timeout},
+		endpoints:      endpoints,
+		workers:        workers,
+		maxRetries:     cfg.MaxRetries,
+		initialBackoff: cfg.InitialBackoff,
+		maxBackoff:     cfg.MaxBackoff,
+	}, nil
+}
+
+// Notify queues the event for delivery to the endpoints that accept it
+// without blocking.  It is a no-op on a nil dispatcher so that callers
+// do not need to check whether webhooks are configured.
+func (d *Dispatcher) Notify(ev Event) {
+	if d == nil {
+		return
+	}
+
+	if ev.Id == "" {
+		ev.Id = uuid.Must(uuid.NewV4()).String()
+	}
+	if ev.Timestamp == "" {
+		ev.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	var body []byte
+	for i := range d.endpoints {
+		ep := &d.endpoints[i]
+		if !ep.accepts(ev.Type) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(ev); err != nil {
+				log.Error().Err(err).Str("event", ev.Type).Msg("fail marshal webhook event")
+				return
+			}
+		}
+
+		d.enqueue(&deliveryT{
+			ep:    ep,
+			id:    ev.Id,
+			event: ev.Type,
+			body:  body,
+		})
+	}
+}
+
+func (d *Dispatcher) enqueue(dv *deliveryT) {
+	select {
+	case dv.ep.queue <- dv:
+		cntQueued.Inc()
+	default:
+		cntDropped.Inc()
+		log.Warn().
+			Str("webhook", dv.ep.name).
+			Str("event", dv.event).
+			Str("delivery", dv.id).
+			Msg("webhook queue full, dropping delivery")
+	}
+}
+
+// Run delivers the queued events until the context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := range d.endpoints {
+		ep := &d.endpoints[i]
+		for n := 0; n < d.workers; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.worker(ctx, ep)
+			}()
+		}
+	}
+
+	<-ctx.Done()
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (d *Dispatcher) worker(ctx context.Context, ep *endpointT) {
+	for {
+		select {
+		case dv := <-ep.queue:
+			d.deliver(ctx, dv)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, dv *deliveryT) {
+	zlog := log.With().
+		Str("webhook", dv.ep.name).
+		Str("event", dv.event).
+		Str("delivery", dv.id).
+		Int("attempt", dv.attempt).
+		Logger()
+
+	retry, err := d.post(ctx, dv)
+	if err == nil {
+		cntDelivered.Inc()
+		zlog.Debug().Msg("webhook delivered")
+		return
+	}
+
+	if !retry || dv.attempt >= d.maxRetries || ctx.Err() != nil {
+		cntFailed.Inc()
+		zlog.Warn().Err(err).Msg("webhook delivery failed")
+		return
+	}
+
+	backoff := d.backoff(dv.attempt)
+	zlog.Debug().Err(err).Dur("backoff", backoff).Msg("webhook delivery failed, retrying")
+
+	cntRetried.Inc()
+	dv.attempt++
+	time.AfterFunc(backoff, func() {
+		if ctx.Err() == nil {
+			d.enqueue(dv)
+		}
+	})
+}
+
+// Post the delivery; returns whether a failed delivery may be retried.
+func (d *Dispatcher) post(ctx context.Context, dv *deliveryT) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dv.ep.url, bytes.NewReader(dv.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, dv.event)
+	req.Header.Set(HeaderDelivery, dv.id)
+	if len(dv.ep.secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(dv.ep.secret, dv.body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook response status %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("webhook response status %d", resp.StatusCode)
+}
+
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	backoff := d.initialBackoff
+	for i := 0; i < attempt && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+	return backoff
+}
+
+// Sign returns the signature header value of the payload for the secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,225 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+//go:build !integration
+// +build !integration
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/fleet-server/v7/internal/pkg/config"
+)
+
+type receivedT struct {
+	header http.Header
+	body   []byte
+}
+
+type receiver struct {
+	mut      sync.Mutex
+	received []receivedT
+	statuses []int // response status for each request, 200 once exhausted
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rc.mut.Lock()
+	n := len(rc.received)
+	rc.received = append(rc.received, receivedT{header: r.Header.Clone(), body: body})
+	status := http.StatusOK
+	if n < len(rc.statuses) {
+		status = rc.statuses[n]
+	}
+	rc.mut.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) requests() []receivedT {
+	rc.mut.Lock()
+	defer rc.mut.Unlock()
+	return append([]receivedT(nil), rc.received...)
+}
+
+func testConfig(endpoints ...config.WebhookEndpoint) *config.Webhooks {
+	var cfg config.Webhooks
+	cfg.InitDefaults()
+	cfg.InitialBackoff = 5 * time.Millisecond
+	cfg.MaxBackoff = 20 * time.Millisecond
+	cfg.Endpoints = endpoints
+	return &cfg
+}
+
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go d.Run(ctx)
+}
+
+func TestNotifySigned(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New(testConfig(config.WebhookEndpoint{Name: "cmdb", URL: srv.URL, Secret: "s3cr3t"}))
+	require.NoError(t, err)
+	runDispatcher(t, d)
+
+	d.Notify(Event{Type: EventAgentEnrolled, AgentId: "agent-id", PolicyId: "policy-id"})
+
+	require.Eventually(t, func() bool { return len(rc.requests()) == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	req := rc.requests()[0]
+	assert.Equal(t, EventAgentEnrolled, req.header.Get(HeaderEvent))
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	assert.Equal(t, Sign([]byte("s3cr3t"), req.body), req.header.Get(HeaderSignature))
+
+	var ev Event
+	require.NoError(t, json.Unmarshal(req.body, &ev))
+	assert.Equal(t, req.header.Get(HeaderDelivery), ev.Id)
+	assert.Equal(t, EventAgentEnrolled, ev.Type)
+	assert.Equal(t, "agent-id", ev.AgentId)
+	assert.Equal(t, "policy-id", ev.PolicyId)
+	assert.NotEmpty(t, ev.Timestamp)
+}
+
+func TestNotifyFilter(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New(testConfig(config.WebhookEndpoint{
+		Name:   "paging",
+		URL:    srv.URL,
+		Events: []string{EventAgentOffline, EventActionFailed},
+	}))
+	require.NoError(t, err)
+	runDispatcher(t, d)
+
+	d.Notify(Event{Type: EventAgentEnrolled, AgentId: "agent-id"})
+	d.Notify(Event{Type: EventAgentOffline, AgentId: "agent-id"})
+
+	require.Eventually(t, func() bool { return len(rc.requests()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	req := rc.requests()[0]
+	assert.Equal(t, EventAgentOffline, req.header.Get(HeaderEvent))
+	assert.Empty(t, req.header.Get(HeaderSignature))
+}
+
+func TestNotifyRetry(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, err := New(testConfig(config.WebhookEndpoint{Name: "cmdb", URL: srv.URL}))
+	require.NoError(t, err)
+	runDispatcher(t, d)
+
+	d.Notify(Event{Type: EventAgentUnenrolled, AgentId: "agent-id"})
+
+	require.Eventually(t, func() bool { return len(rc.requests()) == 3 }, 5*time.Second, 5*time.Millisecond)
+
+	reqs := rc.requests()
+	for _, req := range reqs {
+		assert.Equal(t, reqs[0].header.Get(HeaderDelivery), req.header.Get(HeaderDelivery))
+		assert.Equal(t, reqs[0].body, req.body)
+	}
+}
+
+func TestNotifyNoRetry(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	cfg := testConfig(config.WebhookEndpoint{Name: "cmdb", URL: srv.URL})
+	cfg.MaxRetries = 1
+	d, err := New(cfg)
+	require.NoError(t, err)
+	runDispatcher(t, d)
+
+	// Client error is not retried, server error retried once
+	d.Notify(Event{Type: EventAgentUpgraded, AgentId: "agent-1"})
+	d.Notify(Event{Type: EventAgentUpgraded, AgentId: "agent-2"})
+
+	require.Eventually(t, func() bool { return len(rc.requests()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, rc.requests(), 3)
+}
+
+func TestNotifyQueueFull(t *testing.T) {
+	cfg := testConfig(config.WebhookEndpoint{Name: "cmdb", URL: "http://localhost:1"})
+	cfg.QueueSize = 1
+	d, err := New(cfg)
+	require.NoError(t, err)
+
+	dropped := cntDropped.Get()
+	d.Notify(Event{Type: EventAgentEnrolled, AgentId: "agent-1"})
+	d.Notify(Event{Type: EventAgentEnrolled, AgentId: "agent-2"})
+
+	assert.Len(t, d.endpoints[0].queue, 1)
+	assert.Equal(t, dropped+1, cntDropped.Get())
+}
+
+func TestNotifySlowEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	rc := &receiver{}
+	fast := httptest.NewServer(rc)
+	defer fast.Close()
+
+	cfg := testConfig(
+		config.WebhookEndpoint{Name: "slow", URL: slow.URL},
+		config.WebhookEndpoint{Name: "fast", URL: fast.URL},
+	)
+	cfg.Workers = 1
+	d, err := New(cfg)
+	require.NoError(t, err)
+	runDispatcher(t, d)
+
+	// The slow endpoint holding its only worker does not delay the other endpoint
+	const count = 10
+	for i := 0; i < count; i++ {
+		d.Notify(Event{Type: EventAgentEnrolled, AgentId: "agent-id"})
+	}
+
+	require.Eventually(t, func() bool { return len(rc.requests()) == count }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestNotifyNil(t *testing.T) {
+	var d *Dispatcher
+	assert.NotPanics(t, func() {
+		d.Notify(Event{Type: EventAgentEnrolled})
+	})
+}
+
+func TestNewUnknownEvent(t *testing.T) {
+	_, err := New(testConfig(config.WebhookEndpoint{Name: "cmdb", URL: "http://localhost", Events: []string{"agent.exploded"}}))
+	assert.Error(t, err)
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{initialBackoff: time.Second, maxBackoff: 10 * time.Second}
+	assert.Equal(t, time.Second, d.backoff(0))
+	assert.Equal(t, 2*time.Second, d.backoff(1))
+	assert.Equal(t, 8*time.Second, d.backoff(3))
+	assert.Equal(t, 10*time.Second, d.backoff(4))
+	assert.Equal(t, 10*time.Second, d.backoff(40))
+}
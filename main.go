@@ -6,6 +6,7 @@
 //go:generate go fmt internal/pkg/model/schema.go
 //go:generate schema-generate -m es -o internal/pkg/es/mapping.go -p es model/schema.json
 //go:generate go fmt internal/pkg/es/mapping.go
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:internal/pkg/proto -I model model/fleet.proto
 
 package main
 